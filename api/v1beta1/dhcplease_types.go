@@ -0,0 +1,103 @@
+/*
+Copyright 2024 Magnus Bengtsson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DHCPLeaseServerLabel is set on every DHCPLease to the name of the Server
+// handing out the address
+const DHCPLeaseServerLabel = "hyperdhcp.blahonga.me/server"
+
+// DHCPLeaseState is the state of an address handed out by a Server
+// +kubebuilder:validation:Enum=Bound;Declined
+type DHCPLeaseState string
+
+const (
+	// DHCPLeaseBound means the address is leased to a client
+	DHCPLeaseBound DHCPLeaseState = "Bound"
+	// DHCPLeaseDeclined means a client declined the address with DHCPDECLINE
+	// and it is kept out of the pool until the lease expires
+	DHCPLeaseDeclined DHCPLeaseState = "Declined"
+)
+
+// DHCPLeaseSpec defines a lease of an address handed out by a Server
+type DHCPLeaseSpec struct {
+	// +kubebuilder:validation:Required
+	Server string `json:"server"`
+	// +kubebuilder:validation:Optional
+	MAC string `json:"mac,omitempty"`
+	// ClientID is the client identifier (DHCP option 61) of the client, when it
+	// sent one, in hexadecimal
+	// +kubebuilder:validation:Optional
+	ClientID string `json:"clientID,omitempty"`
+	// +kubebuilder:validation:Required
+	IP string `json:"ip"`
+	// +kubebuilder:validation:Required
+	State DHCPLeaseState `json:"state"`
+	// +kubebuilder:validation:Required
+	Expires metav1.Time `json:"expires"`
+	// Hostname is the host name the client sent
+	// +kubebuilder:validation:Optional
+	Hostname string `json:"hostname,omitempty"`
+	// VMI is the VirtualMachineInstance the client runs in
+	// +kubebuilder:validation:Optional
+	VMI string `json:"vmi,omitempty"`
+	// FirstSeen is when the client was leased the address
+	// +kubebuilder:validation:Optional
+	FirstSeen *metav1.Time `json:"firstSeen,omitempty"`
+	// LastSeen is when the lease was last extended
+	// +kubebuilder:validation:Optional
+	LastSeen *metav1.Time `json:"lastSeen,omitempty"`
+	// Nonce authenticates the DHCPFORCERENEW sent to the client, RFC 6704, in
+	// hexadecimal
+	// +kubebuilder:validation:Optional
+	Nonce string `json:"nonce,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:printcolumn:name="Server",type=string,JSONPath=`.spec.server`
+//+kubebuilder:printcolumn:name="IP",type=string,JSONPath=`.spec.ip`
+//+kubebuilder:printcolumn:name="MAC",type=string,JSONPath=`.spec.mac`
+//+kubebuilder:printcolumn:name="Client ID",type=string,JSONPath=`.spec.clientID`,priority=1
+//+kubebuilder:printcolumn:name="Hostname",type=string,JSONPath=`.spec.hostname`,priority=1
+//+kubebuilder:printcolumn:name="VMI",type=string,JSONPath=`.spec.vmi`,priority=1
+//+kubebuilder:printcolumn:name="State",type=string,JSONPath=`.spec.state`
+//+kubebuilder:printcolumn:name="Expires",type=string,format=date-time,JSONPath=`.spec.expires`
+
+// DHCPLease is the Schema for the dhcpleases API. There is one DHCPLease per
+// address in use, written by the DHCP server of the Server owning it.
+type DHCPLease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DHCPLeaseSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DHCPLeaseList contains a list of DHCPLease
+type DHCPLeaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DHCPLease `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DHCPLease{}, &DHCPLeaseList{})
+}
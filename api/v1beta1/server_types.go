@@ -21,6 +21,7 @@ import (
 )
 
 // ServerSpec defines the desired state of Server
+// +kubebuilder:validation:XValidation:rule="!has(self.dhcpConfig.leaseStorage) || self.dhcpConfig.leaseStorage != 'Raft' || (has(self.dhcpConfig.serverID) && has(self.networkAttachment.ips) && self.networkAttachment.ips.exists(ip, ip == self.dhcpConfig.serverID || ip.startsWith(self.dhcpConfig.serverID + '/')))",message="with Raft lease storage the network attachment IPs float to the leader and must include the server ID"
 type ServerSpec struct {
 	DHCPConfig        DHCPConfigSpec        `json:"dhcpConfig,omitempty"`
 	NetworkAttachment NetworkAttachmentSpec `json:"networkAttachment,omitempty"`
@@ -31,7 +32,14 @@ type NetworkAttachmentSpec struct {
 	Name string `json:"name,omitempty"`
 	// +kubebuilder:validation:Required
 	NameSpace string `json:"namespace,omitempty"`
+	// IPs are the addresses of the DHCP server pod on the network. With Raft
+	// lease storage the replicas get an address of their own from the IPAM of
+	// the NetworkAttachmentDefinition, which must assign them, and only the
+	// leader holds these IPs, which must include the server ID so clients
+	// renew with the leader
 	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:MaxItems=16
+	// +kubebuilder:validation:items:MaxLength=18
 	IPs []string `json:"ips,omitempty"`
 }
 
@@ -49,15 +57,85 @@ func (s *NetworkAttachmentSpec) GetIPs() string {
 }
 
 type DHCPConfigSpec struct {
-	Listen       string        `json:"listen,omitempty"`
+	Listen string `json:"listen,omitempty"`
+	// ServerID is the IPv4 address the DHCP server identifies itself with,
+	// which clients send their renewals to
+	// +kubebuilder:validation:MaxLength=15
 	ServerID     string        `json:"serverID,omitempty"`
 	DNS          []string      `json:"dns,omitempty"`
 	Router       string        `json:"router,omitempty"`
 	SubnetMask   string        `json:"subnetMask,omitempty"`
 	StaticRoutes []string      `json:"staticRoutes,omitempty"`
 	Range        DHCPRangeSpec `json:"range,omitempty"`
+	// LeaseStorage selects where the DHCP server keeps its leases, either in a
+	// database on a PersistentVolumeClaim, as DHCPLease objects or replicated
+	// with Raft between three DHCP server pods
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=PersistentVolumeClaim;Kubernetes;Raft
+	// +kubebuilder:default=PersistentVolumeClaim
+	LeaseStorage LeaseStorageType `json:"leaseStorage,omitempty"`
+	// Events tells other systems when leases are allocated, renewed,
+	// released, declined or expire
+	// +kubebuilder:validation:Optional
+	Events *EventsSpec `json:"events,omitempty"`
+	// ForceRenew has the DHCP server send DHCPFORCERENEW to its bound clients
+	// when its configuration changes, so they pick up new DNS servers or
+	// routes right away instead of when their lease renews
+	// +kubebuilder:validation:Optional
+	ForceRenew *ForceRenewSpec `json:"forceRenew,omitempty"`
+}
+
+// ForceRenewSpec is how a DHCP server asks its bound clients to renew
+type ForceRenewSpec struct {
+	// Rate is how many DHCPFORCERENEW are sent per second, 20 by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	Rate *int32 `json:"rate,omitempty"`
+	// Nonce authenticates the DHCPFORCERENEW sent to clients supporting it
+	// with a nonce handed out in every DHCPACK, RFC 6704
+	// +kubebuilder:validation:Optional
+	Nonce bool `json:"nonce,omitempty"`
 }
 
+// EventsSpec are the receivers of the lease events of a DHCP server
+type EventsSpec struct {
+	// Webhooks are URLs the events are POSTed to as JSON
+	// +kubebuilder:validation:Optional
+	Webhooks []WebhookURL `json:"webhooks,omitempty"`
+	// Exec are executables of the DHCP server image run for every event,
+	// which is written as JSON to their standard input
+	// +kubebuilder:validation:Optional
+	Exec []ExecPath `json:"exec,omitempty"`
+	// Retries is how many times the delivery of an event to a webhook is
+	// retried before it is dropped
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Retries *int32 `json:"retries,omitempty"`
+}
+
+// WebhookURL is an HTTP or HTTPS URL. It is passed to the DHCP server as a
+// plugin argument, which cannot contain whitespace.
+// +kubebuilder:validation:Pattern="^https?://[^\\s]+$"
+type WebhookURL string
+
+// ExecPath is the path of an executable, without arguments
+// +kubebuilder:validation:Pattern="^[^\\s]+$"
+type ExecPath string
+
+// LeaseStorageType is where the DHCP server of a Server keeps its leases
+type LeaseStorageType string
+
+const (
+	// LeaseStoragePVC keeps the leases in a database on a PersistentVolumeClaim
+	LeaseStoragePVC LeaseStorageType = "PersistentVolumeClaim"
+	// LeaseStorageKubernetes keeps the leases as DHCPLease objects
+	LeaseStorageKubernetes LeaseStorageType = "Kubernetes"
+	// LeaseStorageRaft replicates the leases with Raft between several DHCP
+	// server pods, which keep the log on a volume each. Only the leader
+	// answers clients and holds the IPs of the network attachment.
+	LeaseStorageRaft LeaseStorageType = "Raft"
+)
+
 type DHCPRangeSpec struct {
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:Pattern="((^((([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5]))$)|(^(([0-9a-fA-F]{1,4}:){7,7}[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,7}:|([0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,5}(:[0-9a-fA-F]{1,4}){1,2}|([0-9a-fA-F]{1,4}:){1,4}(:[0-9a-fA-F]{1,4}){1,3}|([0-9a-fA-F]{1,4}:){1,3}(:[0-9a-fA-F]{1,4}){1,4}|([0-9a-fA-F]{1,4}:){1,2}(:[0-9a-fA-F]{1,4}){1,5}|[0-9a-fA-F]{1,4}:((:[0-9a-fA-F]{1,4}){1,6})|:((:[0-9a-fA-F]{1,4}){1,7}|:))$))"
@@ -73,8 +151,11 @@ type DHCPRangeSpec struct {
 
 // ServerStatus defines the observed state of Server
 type ServerStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ForceRenewedConfig is the hash of the configuration the bound clients
+	// were last asked to renew for with DHCPFORCERENEW, set by the DHCP
+	// server keeping its leases as DHCPLease objects
+	// +optional
+	ForceRenewedConfig string `json:"forceRenewedConfig,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -40,6 +40,16 @@ func (in *DHCPConfigSpec) DeepCopyInto(out *DHCPConfigSpec) {
 		copy(*out, *in)
 	}
 	in.Range.DeepCopyInto(&out.Range)
+	if in.Events != nil {
+		in, out := &in.Events, &out.Events
+		*out = new(EventsSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ForceRenew != nil {
+		in, out := &in.ForceRenew, &out.ForceRenew
+		*out = new(ForceRenewSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPConfigSpec.
@@ -52,6 +62,88 @@ func (in *DHCPConfigSpec) DeepCopy() *DHCPConfigSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPLease) DeepCopyInto(out *DHCPLease) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPLease.
+func (in *DHCPLease) DeepCopy() *DHCPLease {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPLease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DHCPLease) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPLeaseList) DeepCopyInto(out *DHCPLeaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]DHCPLease, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPLeaseList.
+func (in *DHCPLeaseList) DeepCopy() *DHCPLeaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPLeaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DHCPLeaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPLeaseSpec) DeepCopyInto(out *DHCPLeaseSpec) {
+	*out = *in
+	in.Expires.DeepCopyInto(&out.Expires)
+	if in.FirstSeen != nil {
+		in, out := &in.FirstSeen, &out.FirstSeen
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSeen != nil {
+		in, out := &in.LastSeen, &out.LastSeen
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPLeaseSpec.
+func (in *DHCPLeaseSpec) DeepCopy() *DHCPLeaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPLeaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DHCPRangeSpec) DeepCopyInto(out *DHCPRangeSpec) {
 	*out = *in
@@ -72,6 +164,56 @@ func (in *DHCPRangeSpec) DeepCopy() *DHCPRangeSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EventsSpec) DeepCopyInto(out *EventsSpec) {
+	*out = *in
+	if in.Webhooks != nil {
+		in, out := &in.Webhooks, &out.Webhooks
+		*out = make([]WebhookURL, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exec != nil {
+		in, out := &in.Exec, &out.Exec
+		*out = make([]ExecPath, len(*in))
+		copy(*out, *in)
+	}
+	if in.Retries != nil {
+		in, out := &in.Retries, &out.Retries
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EventsSpec.
+func (in *EventsSpec) DeepCopy() *EventsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EventsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ForceRenewSpec) DeepCopyInto(out *ForceRenewSpec) {
+	*out = *in
+	if in.Rate != nil {
+		in, out := &in.Rate, &out.Rate
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ForceRenewSpec.
+func (in *ForceRenewSpec) DeepCopy() *ForceRenewSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ForceRenewSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NetworkAttachmentSpec) DeepCopyInto(out *NetworkAttachmentSpec) {
 	*out = *in
@@ -18,13 +18,18 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -36,6 +41,31 @@ var (
 	DHCPImage = "cldmnky/hyperdhcp:latest"
 )
 
+const (
+	// raftReplicas is the number of DHCP server pods replicating the leases
+	// with Raft, a majority of them has to run for the server to answer
+	raftReplicas = 3
+	// raftPort is the port the DHCP server pods replicate the leases on
+	raftPort = 7000
+	// raftStatusPort is the port the DHCP server pods report whether they
+	// joined the replicas on, to each other and to their readiness probe
+	raftStatusPort = raftPort + 1
+	// raftDir is where the DHCP server pods keep the Raft log and snapshots
+	raftDir = "/var/lib/dhcp/raft"
+	// raftInterface is the interface the replicas are attached to the network
+	// of the server with, on which the leader holds the addresses of the server
+	raftInterface = "net1"
+	// networksAnnotation is the Multus annotation attaching the DHCP server
+	// pods to the network of the server
+	networksAnnotation = "k8s.v1.cni.cncf.io/networks"
+	// configHashAnnotation is the annotation of the DHCP server pods holding
+	// the hash of their configuration, so they are restarted when it changes
+	// and ask their clients to renew if configured to. The leases survive:
+	// a stopping DHCP server writes them out, the single writer is stopped
+	// before the next one starts, and replicas are restarted one at a time
+	configHashAnnotation = "hyperdhcp.blahonga.me/config-hash"
+)
+
 // ServerReconciler reconciles a Server object
 type ServerReconciler struct {
 	client.Client
@@ -45,12 +75,17 @@ type ServerReconciler struct {
 // +kubebuilder:rbac:groups=hyperdhcp.blahonga.me,resources=servers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=hyperdhcp.blahonga.me,resources=servers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=hyperdhcp.blahonga.me,resources=servers/finalizers,verbs=update
+// +kubebuilder:rbac:groups=hyperdhcp.blahonga.me,resources=dhcpleases,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
 func (r *ServerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
@@ -96,17 +131,39 @@ func (r *ServerReconciler) ensureDHCPDeployment(ctx context.Context, server *hyp
 		return err
 	}
 
-	// Ensure PVC
-	pvc := newDHCPPVC(server)
-	if err := ctrl.SetControllerReference(server, pvc, r.Scheme); err != nil {
-		log.Error(err, "unable to set owner reference on PVC")
-		return err
+	// Ensure PVC, leases kept as DHCPLease objects need none, and replicated
+	// ones are kept on the volumes of the StatefulSet
+	if usesPVCLeaseStorage(server) {
+		pvc := newDHCPPVC(server)
+		if err := ctrl.SetControllerReference(server, pvc, r.Scheme); err != nil {
+			log.Error(err, "unable to set owner reference on PVC")
+			return err
+		}
+		if _, err := CreateOrUpdateWithRetries(ctx, r.Client, pvc, func() error {
+			return ctrl.SetControllerReference(server, pvc, r.Scheme)
+		}); err != nil {
+			log.Error(err, "unable to ensure PVC")
+			return err
+		}
 	}
-	if _, err := CreateOrUpdateWithRetries(ctx, r.Client, pvc, func() error {
-		return ctrl.SetControllerReference(server, pvc, r.Scheme)
-	}); err != nil {
-		log.Error(err, "unable to ensure PVC")
-		return err
+
+	// Ensure the headless Service the DHCP server pods find each other with
+	if usesRaftLeaseStorage(server) {
+		service := newDHCPRaftService(server)
+		if err := ctrl.SetControllerReference(server, service, r.Scheme); err != nil {
+			log.Error(err, "unable to set owner reference on Service")
+			return err
+		}
+		if _, err := CreateOrUpdateWithRetries(ctx, r.Client, service, func() error {
+			desired := newDHCPRaftService(server)
+			service.Spec.Ports = desired.Spec.Ports
+			service.Spec.Selector = desired.Spec.Selector
+			service.Spec.PublishNotReadyAddresses = desired.Spec.PublishNotReadyAddresses
+			return ctrl.SetControllerReference(server, service, r.Scheme)
+		}); err != nil {
+			log.Error(err, "unable to ensure Service")
+			return err
+		}
 	}
 
 	// Ensure ServiceAccount
@@ -122,7 +179,48 @@ func (r *ServerReconciler) ensureDHCPDeployment(ctx context.Context, server *hyp
 		return err
 	}
 
-	// Ensure Deployment
+	// Ensure Role and RoleBinding, allowing the DHCP server to manage its leases
+	role := newDHCPRole(server)
+	if err := ctrl.SetControllerReference(server, role, r.Scheme); err != nil {
+		log.Error(err, "unable to set owner reference on Role")
+		return err
+	}
+	if _, err := CreateOrUpdateWithRetries(ctx, r.Client, role, func() error {
+		role.Rules = newDHCPRole(server).Rules
+		return ctrl.SetControllerReference(server, role, r.Scheme)
+	}); err != nil {
+		log.Error(err, "unable to ensure Role")
+		return err
+	}
+	roleBinding := newDHCPRoleBinding(server)
+	if err := ctrl.SetControllerReference(server, roleBinding, r.Scheme); err != nil {
+		log.Error(err, "unable to set owner reference on RoleBinding")
+		return err
+	}
+	if _, err := CreateOrUpdateWithRetries(ctx, r.Client, roleBinding, func() error {
+		roleBinding.Subjects = newDHCPRoleBinding(server).Subjects
+		return ctrl.SetControllerReference(server, roleBinding, r.Scheme)
+	}); err != nil {
+		log.Error(err, "unable to ensure RoleBinding")
+		return err
+	}
+
+	// Ensure the StatefulSet of the replicas or the Deployment, and remove the
+	// other one when the lease storage is switched
+	if usesRaftLeaseStorage(server) {
+		if err := r.ensureDHCPStatefulSet(ctx, server); err != nil {
+			return err
+		}
+		if err := r.Delete(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: server.Name, Namespace: server.Namespace}}); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to delete DHCP deployment")
+			return err
+		}
+		return nil
+	}
+	if err := r.Delete(ctx, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: server.Name, Namespace: server.Namespace}}); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to delete DHCP statefulset")
+		return err
+	}
 	deployment := newDHCPDeployment(server)
 	if err := ctrl.SetControllerReference(server, deployment, r.Scheme); err != nil {
 		log.Error(err, "unable to set owner reference on DHCP deployment")
@@ -130,6 +228,12 @@ func (r *ServerReconciler) ensureDHCPDeployment(ctx context.Context, server *hyp
 	}
 
 	_, err := CreateOrUpdateWithRetries(ctx, r.Client, deployment, func() error {
+		// Switching the lease storage changes the volumes of the pods,
+		// changing the configuration restarts them
+		desired := newDHCPDeployment(server)
+		deployment.Spec.Strategy = desired.Spec.Strategy
+		deployment.Spec.Template.Spec.Volumes = desired.Spec.Template.Spec.Volumes
+		updatePodTemplate(&deployment.Spec.Template, &desired.Spec.Template)
 		return ctrl.SetControllerReference(server, deployment, r.Scheme)
 	})
 	if err != nil {
@@ -140,42 +244,58 @@ func (r *ServerReconciler) ensureDHCPDeployment(ctx context.Context, server *hyp
 	return nil
 }
 
-func newDHCPConfigMap(server *hyperdhcpv1beta1.Server) *corev1.ConfigMap {
-	// Convert DNS slice to comma-separated string
-	dns := ""
-	if len(server.Spec.DHCPConfig.DNS) > 0 {
-		dns = server.Spec.DHCPConfig.DNS[0]
-		for i := 1; i < len(server.Spec.DHCPConfig.DNS); i++ {
-			dns += "," + server.Spec.DHCPConfig.DNS[i]
-		}
+// ensureDHCPStatefulSet ensures that the StatefulSet of the DHCP server pods
+// replicating the leases exists
+func (r *ServerReconciler) ensureDHCPStatefulSet(ctx context.Context, server *hyperdhcpv1beta1.Server) error {
+	log := log.FromContext(ctx)
+
+	statefulSet := newDHCPStatefulSet(server)
+	if err := ctrl.SetControllerReference(server, statefulSet, r.Scheme); err != nil {
+		log.Error(err, "unable to set owner reference on DHCP statefulset")
+		return err
 	}
+	_, err := CreateOrUpdateWithRetries(ctx, r.Client, statefulSet, func() error {
+		// The volume claim templates cannot change, the volumes of the pods
+		// are kept as created
+		desired := newDHCPStatefulSet(server)
+		statefulSet.Spec.Replicas = desired.Spec.Replicas
+		statefulSet.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+		updatePodTemplate(&statefulSet.Spec.Template, &desired.Spec.Template)
+		return ctrl.SetControllerReference(server, statefulSet, r.Scheme)
+	})
+	if err != nil {
+		log.Error(err, "unable to ensure DHCP statefulset")
+		return err
+	}
+	return nil
+}
 
-	// Format lease time
-	leaseTime := "1h"
-	if server.Spec.DHCPConfig.Range.LeaseTime != nil {
-		leaseTime = server.Spec.DHCPConfig.Range.LeaseTime.Duration.String()
+// updatePodTemplate updates the parts of the pod template of the DHCP server
+// that depend on the server
+func updatePodTemplate(template, desired *corev1.PodTemplateSpec) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[configHashAnnotation] = desired.Annotations[configHashAnnotation]
+	template.Annotations[networksAnnotation] = desired.Annotations[networksAnnotation]
+	if len(template.Spec.Containers) > 0 {
+		container := &template.Spec.Containers[0]
+		container.Ports = desired.Spec.Containers[0].Ports
+		container.VolumeMounts = desired.Spec.Containers[0].VolumeMounts
+		container.ReadinessProbe = desired.Spec.Containers[0].ReadinessProbe
 	}
+}
 
-	config := fmt.Sprintf(`server:
-  address: %s
-  range: %s-%s
-dhcp:
-  router: %s
-  dns: %s
-  subnetMask: %s
-  leaseTime: %s
-  serverIdentifier: %s
-kubevirt:
-  enabled: true
-  namespace: default
-`, server.Spec.NetworkAttachment.GetIPs(),
-		server.Spec.DHCPConfig.Range.Start,
-		server.Spec.DHCPConfig.Range.End,
-		server.Spec.DHCPConfig.Router,
-		dns,
-		server.Spec.DHCPConfig.SubnetMask,
-		leaseTime,
-		server.Spec.DHCPConfig.ServerID)
+// newDHCPConfigMap holds the configuration the DHCP server loads, the plugins
+// of server4 with their arguments separated by spaces
+func newDHCPConfigMap(server *hyperdhcpv1beta1.Server) *corev1.ConfigMap {
+	config := renderDHCPConfig(server, "")
+	if server.Spec.DHCPConfig.ForceRenew != nil {
+		// The DHCP server asks the clients to renew once for every
+		// configuration, told apart by the hash of the rest of it
+		sum := sha256.Sum256([]byte(config))
+		config = renderDHCPConfig(server, hex.EncodeToString(sum[:]))
+	}
 
 	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -191,8 +311,36 @@ kubevirt:
 	}
 }
 
+// renderDHCPConfig returns the configuration file of the DHCP server of a
+// server, forceRenewConfig being the configuration the clients are asked to
+// renew for, if any
+func renderDHCPConfig(server *hyperdhcpv1beta1.Server, forceRenewConfig string) string {
+	dhcpConfig := server.Spec.DHCPConfig
+	var plugins []string
+	if dhcpConfig.ServerID != "" {
+		plugins = append(plugins, "server_id: "+dhcpConfig.ServerID)
+	}
+	if len(dhcpConfig.DNS) > 0 {
+		plugins = append(plugins, "dns: "+strings.Join(dhcpConfig.DNS, " "))
+	}
+	if dhcpConfig.Router != "" {
+		plugins = append(plugins, "router: "+dhcpConfig.Router)
+	}
+	if dhcpConfig.SubnetMask != "" {
+		plugins = append(plugins, "netmask: "+dhcpConfig.SubnetMask)
+	}
+	// The kubevirt plugin names the VMIs in the replies before the range
+	// plugin records them with the leases
+	plugins = append(plugins, "kubevirt:", "range: "+strings.Join(rangeArgs(server, forceRenewConfig), " "))
+
+	config := "server4:\n  plugins:\n"
+	for _, plugin := range plugins {
+		config += "    - " + plugin + "\n"
+	}
+	return config
+}
+
 func newDHCPPVC(server *hyperdhcpv1beta1.Server) *corev1.PersistentVolumeClaim {
-	storageClassName := "longhorn"
 	return &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      server.Name,
@@ -201,14 +349,179 @@ func newDHCPPVC(server *hyperdhcpv1beta1.Server) *corev1.PersistentVolumeClaim {
 				"app": server.Name,
 			},
 		},
-		Spec: corev1.PersistentVolumeClaimSpec{
-			StorageClassName: &storageClassName,
-			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteOnce,
+		Spec: newDHCPPVCSpec(),
+	}
+}
+
+// newDHCPPVCSpec is the volume the DHCP server keeps its leases or Raft log on
+func newDHCPPVCSpec() corev1.PersistentVolumeClaimSpec {
+	storageClassName := "longhorn"
+	return corev1.PersistentVolumeClaimSpec{
+		StorageClassName: &storageClassName,
+		AccessModes: []corev1.PersistentVolumeAccessMode{
+			corev1.ReadWriteOnce,
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse("25Mi"),
 			},
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse("25Mi"),
+		},
+	}
+}
+
+// usesKubernetesLeaseStorage tells if the leases of a server are kept as
+// DHCPLease objects rather than on a PVC
+func usesKubernetesLeaseStorage(server *hyperdhcpv1beta1.Server) bool {
+	return server.Spec.DHCPConfig.LeaseStorage == hyperdhcpv1beta1.LeaseStorageKubernetes
+}
+
+// usesRaftLeaseStorage tells if the leases of a server are replicated between
+// its DHCP server pods
+func usesRaftLeaseStorage(server *hyperdhcpv1beta1.Server) bool {
+	return server.Spec.DHCPConfig.LeaseStorage == hyperdhcpv1beta1.LeaseStorageRaft
+}
+
+// usesPVCLeaseStorage tells if the leases of a server are kept in a database on
+// a PVC, which is the default
+func usesPVCLeaseStorage(server *hyperdhcpv1beta1.Server) bool {
+	return !usesKubernetesLeaseStorage(server) && !usesRaftLeaseStorage(server)
+}
+
+// rangeArgs returns the arguments of the range plugin of the DHCP server of a
+// server: the lease store, the range and the lease time, followed by the
+// key=value arguments
+func rangeArgs(server *hyperdhcpv1beta1.Server, forceRenewConfig string) []string {
+	leaseTime := "1h"
+	if server.Spec.DHCPConfig.Range.LeaseTime != nil {
+		leaseTime = server.Spec.DHCPConfig.Range.LeaseTime.Duration.String()
+	}
+	args := []string{
+		leaseStoreURI(server),
+		server.Spec.DHCPConfig.Range.Start,
+		server.Spec.DHCPConfig.Range.End,
+		leaseTime,
+	}
+	args = append(args, floatingIPArgs(server)...)
+	args = append(args, eventsArgs(server)...)
+	return append(args, forceRenewArgs(server, forceRenewConfig)...)
+}
+
+// floatingIPArgs returns the range plugin arguments making the addresses of a
+// server replicating its leases with Raft floating IPs, which only the leader
+// of the replicas holds
+func floatingIPArgs(server *hyperdhcpv1beta1.Server) []string {
+	if !usesRaftLeaseStorage(server) {
+		return nil
+	}
+	args := make([]string, 0, len(server.Spec.NetworkAttachment.IPs))
+	for _, ip := range server.Spec.NetworkAttachment.IPs {
+		args = append(args, "floating-ip="+ip+"%"+raftInterface)
+	}
+	return args
+}
+
+// eventsArgs returns the range plugin arguments configuring the receivers of
+// the lease events of a server, if it has any
+func eventsArgs(server *hyperdhcpv1beta1.Server) []string {
+	events := server.Spec.DHCPConfig.Events
+	if events == nil {
+		return nil
+	}
+	var args []string
+	for _, webhook := range events.Webhooks {
+		args = append(args, "webhook="+string(webhook))
+	}
+	for _, exec := range events.Exec {
+		args = append(args, "exec="+string(exec))
+	}
+	if events.Retries != nil {
+		args = append(args, fmt.Sprintf("event-retries=%d", *events.Retries))
+	}
+	return args
+}
+
+// forceRenewArgs returns the range plugin arguments configuring the
+// DHCPFORCERENEW sent to the bound clients of a server, if it sends any, for
+// the configuration forceRenewConfig
+func forceRenewArgs(server *hyperdhcpv1beta1.Server, forceRenewConfig string) []string {
+	forceRenew := server.Spec.DHCPConfig.ForceRenew
+	if forceRenew == nil {
+		return nil
+	}
+	args := []string{
+		"forcerenew=" + server.Spec.DHCPConfig.ServerID,
+		fmt.Sprintf("forcerenew-nonce=%t", forceRenew.Nonce),
+	}
+	if forceRenew.Rate != nil {
+		args = append(args, fmt.Sprintf("forcerenew-rate=%d", *forceRenew.Rate))
+	}
+	if forceRenewConfig != "" {
+		args = append(args, "forcerenew-config="+forceRenewConfig)
+	}
+	return args
+}
+
+// configHash returns the hash of the configuration of the DHCP server of a
+// server
+func configHash(server *hyperdhcpv1beta1.Server) string {
+	sum := sha256.Sum256([]byte(newDHCPConfigMap(server).Data["hyperdhcp.yaml"]))
+	return hex.EncodeToString(sum[:])
+}
+
+// leaseStoreURI returns the lease store the DHCP server of a server uses
+func leaseStoreURI(server *hyperdhcpv1beta1.Server) string {
+	switch {
+	case usesKubernetesLeaseStorage(server):
+		return fmt.Sprintf("kubernetes://%s/%s", server.Namespace, server.Name)
+	case usesRaftLeaseStorage(server):
+		return fmt.Sprintf("raft://:%d?dir=%s&peers=%s", raftPort, raftDir, strings.Join(raftPeers(server), ","))
+	}
+	return "chai:///var/lib/dhcp/leases"
+}
+
+// raftPeers returns the DNS names of the DHCP server pods of a server
+// replicating the leases, which the pods of its StatefulSet keep across
+// restarts
+func raftPeers(server *hyperdhcpv1beta1.Server) []string {
+	peers := make([]string, raftReplicas)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("%s-%d.%s.%s.svc", server.Name, i, raftServiceName(server), server.Namespace)
+	}
+	return peers
+}
+
+// raftServiceName returns the name of the headless Service of a server
+func raftServiceName(server *hyperdhcpv1beta1.Server) string {
+	return server.Name + "-raft"
+}
+
+// newDHCPRaftService resolves the names of the DHCP server pods of a server,
+// including the ones not ready yet, so they can find each other and elect a
+// leader before any of them is ready
+func newDHCPRaftService(server *hyperdhcpv1beta1.Server) *corev1.Service {
+	labels := map[string]string{
+		"app": server.Name,
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      raftServiceName(server),
+			Namespace: server.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:                corev1.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Selector:                 labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "raft",
+					Port:     raftPort,
+					Protocol: corev1.ProtocolTCP,
+				},
+				{
+					Name:     "raft-status",
+					Port:     raftStatusPort,
+					Protocol: corev1.ProtocolTCP,
 				},
 			},
 		},
@@ -227,15 +540,71 @@ func newDHCPServiceAccount(server *hyperdhcpv1beta1.Server) *corev1.ServiceAccou
 	}
 }
 
+// newDHCPRole allows the DHCP server to keep its leases as DHCPLease objects
+func newDHCPRole(server *hyperdhcpv1beta1.Server) *rbacv1.Role {
+	return &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      server.Name,
+			Namespace: server.Namespace,
+			Labels: map[string]string{
+				"app": server.Name,
+			},
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{hyperdhcpv1beta1.GroupVersion.Group},
+				Resources: []string{"dhcpleases"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+			},
+			{
+				APIGroups:     []string{hyperdhcpv1beta1.GroupVersion.Group},
+				Resources:     []string{"servers"},
+				ResourceNames: []string{server.Name},
+				Verbs:         []string{"get"},
+			},
+			{
+				APIGroups:     []string{hyperdhcpv1beta1.GroupVersion.Group},
+				Resources:     []string{"servers/status"},
+				ResourceNames: []string{server.Name},
+				Verbs:         []string{"get", "patch"},
+			},
+		},
+	}
+}
+
+func newDHCPRoleBinding(server *hyperdhcpv1beta1.Server) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      server.Name,
+			Namespace: server.Namespace,
+			Labels: map[string]string{
+				"app": server.Name,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     server.Name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      server.Name,
+				Namespace: server.Namespace,
+			},
+		},
+	}
+}
+
+// newDHCPDeployment runs the DHCP server of a server keeping its leases on a
+// PVC or as DHCPLease objects, which have a single writer. The pod is stopped
+// before the next one starts, so the leases it wrote out on stopping are the
+// ones the next one loads.
 func newDHCPDeployment(server *hyperdhcpv1beta1.Server) *appsv1.Deployment {
 	labels := map[string]string{
 		"app": server.Name,
 	}
-
 	replicas := int32(1)
-	runAsUser := int64(1000)
-	privileged := true
-
 	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      server.Name,
@@ -244,87 +613,188 @@ func newDHCPDeployment(server *hyperdhcpv1beta1.Server) *appsv1.Deployment {
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      server.Name,
-					Namespace: server.Namespace,
-					Labels:    labels,
-					Annotations: map[string]string{
-						"k8s.v1.cni.cncf.io/networks": fmt.Sprintf(`[
+			Template: newDHCPPodTemplate(server),
+		},
+	}
+}
+
+// newDHCPStatefulSet runs the DHCP server pods of a server replicating the
+// leases. The pods are named after the StatefulSet and keep their Raft log on
+// a volume of their own, so they rejoin the replicas under the same name and
+// with their leases when restarted. They start together, and are only ready
+// once they joined, so they are restarted one at a time, each after the
+// previous one is back.
+func newDHCPStatefulSet(server *hyperdhcpv1beta1.Server) *appsv1.StatefulSet {
+	labels := map[string]string{
+		"app": server.Name,
+	}
+	replicas := int32(raftReplicas)
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      server.Name,
+			Namespace: server.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            &replicas,
+			ServiceName:         raftServiceName(server),
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.RollingUpdateStatefulSetStrategyType,
+			},
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: newDHCPPodTemplate(server),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "raft-log",
+						Labels: labels,
+					},
+					Spec: newDHCPPVCSpec(),
+				},
+			},
+		},
+	}
+}
+
+// networks returns the Multus annotation attaching the DHCP server pods of a
+// server to its network. A single pod is given the addresses of the server.
+// Replicas share their pod template and would all get them, so they get an
+// address of their own from the IPAM of the NetworkAttachmentDefinition
+// instead, and the leader adds the addresses of the server to raftInterface.
+func networks(server *hyperdhcpv1beta1.Server) string {
+	addresses := fmt.Sprintf(`"ips": %s`, server.Spec.NetworkAttachment.GetIPs())
+	if usesRaftLeaseStorage(server) {
+		addresses = fmt.Sprintf(`"interface": %q`, raftInterface)
+	}
+	return fmt.Sprintf(`[
 							{
 							  "name": "%s",
 							  "namespace": "%s",
-							  "ips": %s
+							  %s
 							}
-						  ]`, server.Spec.NetworkAttachment.Name, server.Spec.NetworkAttachment.NameSpace, server.Spec.NetworkAttachment.GetIPs()),
+						  ]`, server.Spec.NetworkAttachment.Name, server.Spec.NetworkAttachment.NameSpace, addresses)
+}
+
+// newDHCPPodTemplate returns the pods running the DHCP server of a server
+func newDHCPPodTemplate(server *hyperdhcpv1beta1.Server) corev1.PodTemplateSpec {
+	labels := map[string]string{
+		"app": server.Name,
+	}
+	runAsUser := int64(1000)
+	privileged := true
+
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "dhcp-config",
+			MountPath: "/etc/dhcp",
+			ReadOnly:  true,
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "dhcp-config",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: server.Name,
 					},
-				},
-				Spec: corev1.PodSpec{
-					ServiceAccountName: server.Name,
-					Containers: []corev1.Container{
+					Items: []corev1.KeyToPath{
 						{
-							Name:  server.Name,
-							Image: DHCPImage,
-							Args: []string{
-								"server",
-								"--config",
-								"/etc/dhcp/hyperdhcp.yaml",
-							},
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "dhcp",
-									ContainerPort: 67,
-									Protocol:      corev1.ProtocolUDP,
-								},
-							},
-							SecurityContext: &corev1.SecurityContext{
-								RunAsUser:  &runAsUser,
-								Privileged: &privileged,
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "dhcp-config",
-									MountPath: "/etc/dhcp",
-									ReadOnly:  true,
-								},
-								{
-									Name:      "dhcp-leases",
-									MountPath: "/var/lib/dhcp",
-								},
-							},
+							Key:  "hyperdhcp.yaml",
+							Path: "hyperdhcp.yaml",
 						},
 					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "dhcp-config",
-							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: server.Name,
-									},
-									Items: []corev1.KeyToPath{
-										{
-											Key:  "hyperdhcp.yaml",
-											Path: "hyperdhcp.yaml",
-										},
-									},
-								},
-							},
-						},
-						{
-							Name: "dhcp-leases",
-							VolumeSource: corev1.VolumeSource{
-								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-									ClaimName: server.Name,
-								},
-							},
-						},
+				},
+			},
+		},
+	}
+	ports := []corev1.ContainerPort{
+		{
+			Name:          "dhcp",
+			ContainerPort: 67,
+			Protocol:      corev1.ProtocolUDP,
+		},
+	}
+	var readinessProbe *corev1.Probe
+	if usesRaftLeaseStorage(server) {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          "raft",
+			ContainerPort: raftPort,
+			Protocol:      corev1.ProtocolTCP,
+		}, corev1.ContainerPort{
+			Name:          "raft-status",
+			ContainerPort: raftStatusPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "raft-log",
+			MountPath: raftDir,
+		})
+		readinessProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/readyz",
+					Port: intstr.FromString("raft-status"),
+				},
+			},
+			PeriodSeconds: 5,
+		}
+	}
+	if usesPVCLeaseStorage(server) {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "dhcp-leases",
+			MountPath: "/var/lib/dhcp",
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "dhcp-leases",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: server.Name,
+				},
+			},
+		})
+	}
+
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      server.Name,
+			Namespace: server.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				networksAnnotation:   networks(server),
+				configHashAnnotation: configHash(server),
+			},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: server.Name,
+			Containers: []corev1.Container{
+				{
+					Name:  server.Name,
+					Image: DHCPImage,
+					Args: []string{
+						"server",
+						"--config",
+						"/etc/dhcp/hyperdhcp.yaml",
+					},
+					Ports:          ports,
+					ReadinessProbe: readinessProbe,
+					SecurityContext: &corev1.SecurityContext{
+						RunAsUser:  &runAsUser,
+						Privileged: &privileged,
 					},
+					VolumeMounts: volumeMounts,
 				},
 			},
+			Volumes: volumes,
 		},
 	}
 }
@@ -2,13 +2,21 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	dhcpconfig "github.com/coredhcp/coredhcp/config"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -85,14 +93,17 @@ var _ = Describe("Server controller", func() {
 			By("By verifying ConfigMap data")
 			Expect(createdConfigMap.Data).To(HaveKey("hyperdhcp.yaml"))
 			config := createdConfigMap.Data["hyperdhcp.yaml"]
-			Expect(config).To(ContainSubstring("address: [\"10.202.123.1\"]"))
-			Expect(config).To(ContainSubstring("range: 10.202.2.10-10.202.2.20"))
-			Expect(config).To(ContainSubstring("router: 10.202.0.1"))
-			Expect(config).To(ContainSubstring("dns: 192.168.1.1"))
-			Expect(config).To(ContainSubstring("subnetMask: 255.255.253.0"))
-			Expect(config).To(ContainSubstring("leaseTime: 5m0s"))
-			Expect(config).To(ContainSubstring("kubevirt:"))
-			Expect(config).To(ContainSubstring("enabled: true"))
+			Expect(config).To(ContainSubstring("    - range: chai:///var/lib/dhcp/leases 10.202.2.10 10.202.2.20 5m0s\n"))
+
+			By("By loading the configuration like the DHCP server")
+			Expect(loadDHCPConfig(config)).To(Equal([]dhcpconfig.PluginConfig{
+				{Name: "server_id", Args: []string{"10.202.0.1"}},
+				{Name: "dns", Args: []string{"192.168.1.1"}},
+				{Name: "router", Args: []string{"10.202.0.1"}},
+				{Name: "netmask", Args: []string{"255.255.253.0"}},
+				{Name: "kubevirt", Args: []string{}},
+				{Name: "range", Args: []string{"chai:///var/lib/dhcp/leases", "10.202.2.10", "10.202.2.20", "5m0s"}},
+			}))
 		})
 
 		It("Should create a PersistentVolumeClaim", func() {
@@ -244,7 +255,7 @@ var _ = Describe("Server controller", func() {
 			}, timeout, interval).Should(BeTrue())
 
 			// Verify initial DNS configuration
-			Expect(createdConfigMap.Data["hyperdhcp.yaml"]).To(ContainSubstring("dns: 192.168.1.1"))
+			Expect(createdConfigMap.Data["hyperdhcp.yaml"]).To(ContainSubstring("- dns: 192.168.1.1\n"))
 
 			By("By updating the server DNS configuration")
 			Eventually(func() error {
@@ -263,7 +274,7 @@ var _ = Describe("Server controller", func() {
 					return false
 				}
 				config := cm.Data["hyperdhcp.yaml"]
-				return strings.Contains(config, "dns: 8.8.8.8,8.8.4.4")
+				return strings.Contains(config, "- dns: 8.8.8.8 8.8.4.4\n")
 			}, timeout*2, interval).Should(BeTrue())
 
 			By("By cleaning up the update test server")
@@ -316,7 +327,7 @@ var _ = Describe("Server controller", func() {
 			}, timeout, interval).Should(BeTrue())
 
 			// Verify initial range configuration
-			Expect(createdConfigMap.Data["hyperdhcp.yaml"]).To(ContainSubstring("range: 10.202.4.10-10.202.4.20"))
+			Expect(createdConfigMap.Data["hyperdhcp.yaml"]).To(ContainSubstring("- range: chai:///var/lib/dhcp/leases 10.202.4.10 10.202.4.20 5m0s\n"))
 
 			By("By updating the server range configuration")
 			Eventually(func() error {
@@ -336,7 +347,7 @@ var _ = Describe("Server controller", func() {
 					return false
 				}
 				config := cm.Data["hyperdhcp.yaml"]
-				return strings.Contains(config, "range: 10.202.4.100-10.202.4.200")
+				return strings.Contains(config, "- range: chai:///var/lib/dhcp/leases 10.202.4.100 10.202.4.200 5m0s\n")
 			}, timeout*2, interval).Should(BeTrue())
 
 			By("By cleaning up the range test server")
@@ -344,6 +355,383 @@ var _ = Describe("Server controller", func() {
 		})
 	})
 
+	Context("When storing leases as DHCPLease objects", func() {
+		It("Should not create a PVC and allow the DHCP server to manage its leases", func() {
+			By("By creating a new server with Kubernetes lease storage")
+			ctx := context.Background()
+			kubeServerName := "kube-leases-server"
+			server := &serverv1beta1.Server{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "hyperdhcp.blahonga.me/v1beta1",
+					Kind:       "Server",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      kubeServerName,
+					Namespace: serverNamespace,
+				},
+				Spec: serverv1beta1.ServerSpec{
+					DHCPConfig: serverv1beta1.DHCPConfigSpec{
+						ServerID: "10.202.0.1",
+						Range: serverv1beta1.DHCPRangeSpec{
+							Start: "10.202.5.10",
+							End:   "10.202.5.20",
+						},
+						Router:       "10.202.0.1",
+						SubnetMask:   "255.255.253.0",
+						LeaseStorage: serverv1beta1.LeaseStorageKubernetes,
+					},
+					NetworkAttachment: serverv1beta1.NetworkAttachmentSpec{
+						Name:      "test-net",
+						NameSpace: "default",
+						IPs:       []string{"10.202.126.1"},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, server)).Should(Succeed())
+
+			By("By checking the lease store in the ConfigMap")
+			serverLookupKey := types.NamespacedName{Name: kubeServerName, Namespace: serverNamespace}
+			createdConfigMap := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdConfigMap)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(createdConfigMap.Data["hyperdhcp.yaml"]).To(ContainSubstring("- range: kubernetes://default/kube-leases-server "))
+
+			By("By checking the Role and RoleBinding of the DHCP server")
+			createdRole := &rbacv1.Role{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdRole)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(createdRole.Rules[0].Resources).To(ContainElement("dhcpleases"))
+			createdRoleBinding := &rbacv1.RoleBinding{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdRoleBinding)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(createdRoleBinding.Subjects).To(ContainElement(rbacv1.Subject{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      kubeServerName,
+				Namespace: serverNamespace,
+			}))
+
+			By("By checking the Deployment has no lease volume")
+			createdDeployment := &appsv1.Deployment{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdDeployment)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			for _, vol := range createdDeployment.Spec.Template.Spec.Volumes {
+				Expect(vol.Name).NotTo(Equal("dhcp-leases"))
+			}
+
+			By("By checking no PVC has been created")
+			Expect(apierrors.IsNotFound(k8sClient.Get(ctx, serverLookupKey, &corev1.PersistentVolumeClaim{}))).To(BeTrue())
+
+			By("By cleaning up the lease storage test server")
+			Expect(k8sClient.Delete(ctx, server)).Should(Succeed())
+		})
+	})
+
+	Context("When replicating leases with Raft", func() {
+		It("Should run three DHCP server pods of a StatefulSet behind a headless Service", func() {
+			By("By creating a new server with Raft lease storage")
+			ctx := context.Background()
+			raftServerName := "raft-leases-server"
+			server := &serverv1beta1.Server{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "hyperdhcp.blahonga.me/v1beta1",
+					Kind:       "Server",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      raftServerName,
+					Namespace: serverNamespace,
+				},
+				Spec: serverv1beta1.ServerSpec{
+					DHCPConfig: serverv1beta1.DHCPConfigSpec{
+						ServerID: "10.203.126.1",
+						Range: serverv1beta1.DHCPRangeSpec{
+							Start: "10.203.5.10",
+							End:   "10.203.5.20",
+						},
+						Router:       "10.203.0.1",
+						SubnetMask:   "255.255.253.0",
+						LeaseStorage: serverv1beta1.LeaseStorageRaft,
+					},
+					NetworkAttachment: serverv1beta1.NetworkAttachmentSpec{
+						Name:      "test-net",
+						NameSpace: "default",
+						IPs:       []string{"10.203.126.1/22"},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, server)).Should(Succeed())
+
+			By("By checking the server ID has to float to the leader")
+			for _, ips := range [][]string{nil, {"10.203.126.2/22"}, {"10.203.126.10/22"}} {
+				invalid := server.DeepCopy()
+				invalid.ObjectMeta = metav1.ObjectMeta{Name: "invalid-raft-leases-server", Namespace: serverNamespace}
+				invalid.Spec.NetworkAttachment.IPs = ips
+				Expect(k8sClient.Create(ctx, invalid)).ShouldNot(Succeed())
+			}
+
+			By("By checking the lease store in the ConfigMap")
+			serverLookupKey := types.NamespacedName{Name: raftServerName, Namespace: serverNamespace}
+			createdConfigMap := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdConfigMap)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			plugins := loadDHCPConfig(createdConfigMap.Data["hyperdhcp.yaml"])
+			Expect(plugins[len(plugins)-1].Args[0]).To(Equal("raft://:7000?dir=/var/lib/dhcp/raft&peers=" +
+				"raft-leases-server-0.raft-leases-server-raft.default.svc," +
+				"raft-leases-server-1.raft-leases-server-raft.default.svc," +
+				"raft-leases-server-2.raft-leases-server-raft.default.svc"))
+			Expect(plugins[len(plugins)-1].Args).To(ContainElement("floating-ip=10.203.126.1/22%net1"))
+
+			By("By checking the headless Service")
+			createdService := &corev1.Service{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, types.NamespacedName{Name: raftServerName + "-raft", Namespace: serverNamespace}, createdService)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(createdService.Spec.ClusterIP).To(Equal(corev1.ClusterIPNone))
+			Expect(createdService.Spec.PublishNotReadyAddresses).To(BeTrue())
+			Expect(createdService.Spec.Selector).To(Equal(map[string]string{"app": raftServerName}))
+			Expect(createdService.Spec.Ports[0].Port).To(Equal(int32(7000)))
+			Expect(createdService.Spec.Ports[1].Port).To(Equal(int32(7001)))
+
+			By("By checking the StatefulSet runs three replicas keeping their Raft log")
+			createdStatefulSet := &appsv1.StatefulSet{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdStatefulSet)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(*createdStatefulSet.Spec.Replicas).To(Equal(int32(3)))
+			Expect(createdStatefulSet.Spec.ServiceName).To(Equal(raftServerName + "-raft"))
+			Expect(createdStatefulSet.Spec.PodManagementPolicy).To(Equal(appsv1.ParallelPodManagement))
+			Expect(createdStatefulSet.Spec.UpdateStrategy.Type).To(Equal(appsv1.RollingUpdateStatefulSetStrategyType))
+			Expect(createdStatefulSet.Spec.VolumeClaimTemplates).To(HaveLen(1))
+			Expect(createdStatefulSet.Spec.VolumeClaimTemplates[0].Name).To(Equal("raft-log"))
+			container := createdStatefulSet.Spec.Template.Spec.Containers[0]
+			Expect(container.Ports).To(ContainElement(corev1.ContainerPort{
+				Name:          "raft",
+				ContainerPort: 7000,
+				Protocol:      corev1.ProtocolTCP,
+			}))
+			Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name:      "raft-log",
+				MountPath: "/var/lib/dhcp/raft",
+			}))
+			Expect(container.ReadinessProbe).NotTo(BeNil())
+			Expect(container.ReadinessProbe.HTTPGet.Path).To(Equal("/readyz"))
+			Expect(container.ReadinessProbe.HTTPGet.Port.String()).To(Equal("raft-status"))
+			for _, vol := range createdStatefulSet.Spec.Template.Spec.Volumes {
+				Expect(vol.Name).NotTo(Equal("dhcp-leases"))
+			}
+
+			By("By checking every replica gets an address of its own")
+			// The replicas are all created from the template, which leaves
+			// their address to the IPAM of the network
+			var networks []map[string]string
+			Expect(json.Unmarshal([]byte(createdStatefulSet.Spec.Template.Annotations["k8s.v1.cni.cncf.io/networks"]), &networks)).To(Succeed())
+			Expect(networks).To(Equal([]map[string]string{{
+				"name":      "test-net",
+				"namespace": "default",
+				"interface": "net1",
+			}}))
+
+			By("By checking no Deployment or PVC has been created")
+			Expect(apierrors.IsNotFound(k8sClient.Get(ctx, serverLookupKey, &appsv1.Deployment{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(k8sClient.Get(ctx, serverLookupKey, &corev1.PersistentVolumeClaim{}))).To(BeTrue())
+
+			By("By cleaning up the lease storage test server")
+			Expect(k8sClient.Delete(ctx, server)).Should(Succeed())
+		})
+	})
+
+	Context("When sending lease events", func() {
+		It("Should configure the webhooks and exec hooks of the DHCP server", func() {
+			By("By creating a new server with event receivers")
+			ctx := context.Background()
+			eventsServerName := "events-server"
+			retries := int32(3)
+			server := &serverv1beta1.Server{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "hyperdhcp.blahonga.me/v1beta1",
+					Kind:       "Server",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      eventsServerName,
+					Namespace: serverNamespace,
+				},
+				Spec: serverv1beta1.ServerSpec{
+					DHCPConfig: serverv1beta1.DHCPConfigSpec{
+						ServerID: "10.204.0.1",
+						Range: serverv1beta1.DHCPRangeSpec{
+							Start: "10.204.5.10",
+							End:   "10.204.5.20",
+						},
+						Router:     "10.204.0.1",
+						SubnetMask: "255.255.253.0",
+						Events: &serverv1beta1.EventsSpec{
+							Webhooks: []serverv1beta1.WebhookURL{"https://cmdb.example.com/leases"},
+							Exec:     []serverv1beta1.ExecPath{"/usr/local/bin/update-firewall"},
+							Retries:  &retries,
+						},
+					},
+					NetworkAttachment: serverv1beta1.NetworkAttachmentSpec{
+						Name:      "test-net",
+						NameSpace: "default",
+						IPs:       []string{"10.204.126.1"},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, server)).Should(Succeed())
+
+			By("By checking the event receivers in the ConfigMap")
+			serverLookupKey := types.NamespacedName{Name: eventsServerName, Namespace: serverNamespace}
+			createdConfigMap := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdConfigMap)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			config := createdConfigMap.Data["hyperdhcp.yaml"]
+			Expect(config).To(ContainSubstring("    - range: chai:///var/lib/dhcp/leases 10.204.5.10 10.204.5.20 1h webhook=https://cmdb.example.com/leases exec=/usr/local/bin/update-firewall event-retries=3\n"))
+			plugins := loadDHCPConfig(config)
+			Expect(plugins[len(plugins)-1].Args).To(Equal([]string{
+				"chai:///var/lib/dhcp/leases", "10.204.5.10", "10.204.5.20", "1h",
+				"webhook=https://cmdb.example.com/leases", "exec=/usr/local/bin/update-firewall", "event-retries=3",
+			}))
+
+			By("By checking invalid webhook URLs are refused")
+			invalid := server.DeepCopy()
+			invalid.ObjectMeta = metav1.ObjectMeta{Name: "invalid-events-server", Namespace: serverNamespace}
+			invalid.Spec.DHCPConfig.Events.Webhooks = []serverv1beta1.WebhookURL{"cmdb.example.com/leases"}
+			Expect(k8sClient.Create(ctx, invalid)).ShouldNot(Succeed())
+
+			By("By checking receivers the DHCP server cannot be passed are refused")
+			invalid.Spec.DHCPConfig.Events.Webhooks = []serverv1beta1.WebhookURL{"https://cmdb.example.com/leases?site=eu west"}
+			Expect(k8sClient.Create(ctx, invalid)).ShouldNot(Succeed())
+			invalid.Spec.DHCPConfig.Events.Webhooks = nil
+			invalid.Spec.DHCPConfig.Events.Exec = []serverv1beta1.ExecPath{"/usr/local/bin/update-firewall --zone dmz"}
+			Expect(k8sClient.Create(ctx, invalid)).ShouldNot(Succeed())
+
+			By("By cleaning up the events test server")
+			Expect(k8sClient.Delete(ctx, server)).Should(Succeed())
+		})
+	})
+
+	Context("When asking clients to renew", func() {
+		It("Should configure DHCPFORCERENEW and restart the DHCP server on configuration changes", func() {
+			By("By creating a new server sending DHCPFORCERENEW")
+			ctx := context.Background()
+			forceRenewServerName := "forcerenew-server"
+			rate := int32(50)
+			server := &serverv1beta1.Server{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "hyperdhcp.blahonga.me/v1beta1",
+					Kind:       "Server",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      forceRenewServerName,
+					Namespace: serverNamespace,
+				},
+				Spec: serverv1beta1.ServerSpec{
+					DHCPConfig: serverv1beta1.DHCPConfigSpec{
+						DNS:      []string{"192.168.1.1"},
+						ServerID: "10.205.0.1",
+						Range: serverv1beta1.DHCPRangeSpec{
+							Start: "10.205.5.10",
+							End:   "10.205.5.20",
+						},
+						Router:     "10.205.0.1",
+						SubnetMask: "255.255.253.0",
+						ForceRenew: &serverv1beta1.ForceRenewSpec{
+							Rate:  &rate,
+							Nonce: true,
+						},
+					},
+					NetworkAttachment: serverv1beta1.NetworkAttachmentSpec{
+						Name:      "test-net",
+						NameSpace: "default",
+						IPs:       []string{"10.205.126.1"},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, server)).Should(Succeed())
+
+			By("By checking the DHCPFORCERENEW configuration in the ConfigMap")
+			serverLookupKey := types.NamespacedName{Name: forceRenewServerName, Namespace: serverNamespace}
+			createdConfigMap := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdConfigMap)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			config := createdConfigMap.Data["hyperdhcp.yaml"]
+			Expect(config).To(ContainSubstring("    - range: chai:///var/lib/dhcp/leases 10.205.5.10 10.205.5.20 1h forcerenew=10.205.0.1 forcerenew-nonce=true forcerenew-rate=50 forcerenew-config="))
+			plugins := loadDHCPConfig(config)
+			args := plugins[len(plugins)-1].Args
+			Expect(args[:len(args)-1]).To(Equal([]string{
+				"chai:///var/lib/dhcp/leases", "10.205.5.10", "10.205.5.20", "1h",
+				"forcerenew=10.205.0.1", "forcerenew-nonce=true", "forcerenew-rate=50",
+			}))
+			// The clients are asked to renew once for the hash of the rest
+			// of the configuration
+			forceRenewConfig := strings.TrimPrefix(args[len(args)-1], "forcerenew-config=")
+			sum := sha256.Sum256([]byte(strings.Replace(config, " forcerenew-config="+forceRenewConfig, "", 1)))
+			Expect(forceRenewConfig).To(Equal(hex.EncodeToString(sum[:])))
+
+			By("By checking the Deployment carries the hash of the configuration")
+			createdDeployment := &appsv1.Deployment{}
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serverLookupKey, createdDeployment)
+				return err == nil
+			}, timeout, interval).Should(BeTrue())
+			hash := createdDeployment.Spec.Template.Annotations[configHashAnnotation]
+			Expect(hash).NotTo(BeEmpty())
+			// The pod writing the leases stops before the next one loads them
+			Expect(createdDeployment.Spec.Strategy.Type).To(Equal(appsv1.RecreateDeploymentStrategyType))
+
+			By("By changing the DNS servers")
+			Eventually(func() error {
+				updatedServer := &serverv1beta1.Server{}
+				if err := k8sClient.Get(ctx, serverLookupKey, updatedServer); err != nil {
+					return err
+				}
+				updatedServer.Spec.DHCPConfig.DNS = []string{"8.8.8.8"}
+				return k8sClient.Update(ctx, updatedServer)
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking the DHCP server pods are restarted with the new configuration")
+			Eventually(func() string {
+				deployment := &appsv1.Deployment{}
+				if err := k8sClient.Get(ctx, serverLookupKey, deployment); err != nil {
+					return hash
+				}
+				return deployment.Spec.Template.Annotations[configHashAnnotation]
+			}, timeout*2, interval).ShouldNot(Equal(hash))
+			Eventually(func() string {
+				configMap := &corev1.ConfigMap{}
+				if err := k8sClient.Get(ctx, serverLookupKey, configMap); err != nil {
+					return ""
+				}
+				return configMap.Data["hyperdhcp.yaml"]
+			}, timeout, interval).ShouldNot(ContainSubstring("forcerenew-config=" + forceRenewConfig))
+
+			By("By checking invalid rates are refused")
+			invalid := server.DeepCopy()
+			invalid.ObjectMeta = metav1.ObjectMeta{Name: "invalid-forcerenew-server", Namespace: serverNamespace}
+			zero := int32(0)
+			invalid.Spec.DHCPConfig.ForceRenew.Rate = &zero
+			Expect(k8sClient.Create(ctx, invalid)).ShouldNot(Succeed())
+
+			By("By cleaning up the forcerenew test server")
+			Expect(k8sClient.Delete(ctx, server)).Should(Succeed())
+		})
+	})
+
 	Context("When deleting a server", func() {
 		It("Should clean up the original test server", func() {
 			By("By deleting the original test server")
@@ -358,3 +746,14 @@ var _ = Describe("Server controller", func() {
 		})
 	})
 })
+
+// loadDHCPConfig loads a configuration rendered for the DHCP server the way
+// it does, and returns its DHCPv4 plugins
+func loadDHCPConfig(config string) []dhcpconfig.PluginConfig {
+	path := filepath.Join(GinkgoT().TempDir(), "hyperdhcp.yaml")
+	Expect(os.WriteFile(path, []byte(config), 0o600)).To(Succeed())
+	cfg, err := dhcpconfig.Load(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(cfg.Server4).NotTo(BeNil())
+	return cfg.Server4.Plugins
+}
@@ -0,0 +1,271 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	dhcpconfig "github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	dhcplogger "github.com/coredhcp/coredhcp/logger"
+	dhcpplugins "github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"golang.org/x/net/ipv4"
+
+	pl_leasedb "github.com/cldmnky/hyperdhcp/internal/dhcp/plugins/leasedb"
+)
+
+var log = dhcplogger.GetLogger("server")
+
+// The coredhcp listener only passes DISCOVER and REQUEST messages to the
+// plugins. Ours hands every message type to the plugin chain, so plugins can
+// handle messages like DHCPRELEASE and DHCPDECLINE themselves.
+
+// replyTypes maps the message types we handle to the message type of the
+// reply. MessageTypeNone means the plugins decide if and how to reply.
+var replyTypes = map[dhcpv4.MessageType]dhcpv4.MessageType{
+	dhcpv4.MessageTypeDiscover: dhcpv4.MessageTypeOffer,
+	dhcpv4.MessageTypeRequest:  dhcpv4.MessageTypeAck,
+	dhcpv4.MessageTypeInform:   dhcpv4.MessageTypeAck,
+	dhcpv4.MessageTypeRelease:  dhcpv4.MessageTypeNone,
+	dhcpv4.MessageTypeDecline:  dhcpv4.MessageTypeNone,
+	// The range plugin answers leasequeries, RFC 4388
+	pl_leasedb.MessageTypeLeaseQuery: dhcpv4.MessageTypeNone,
+}
+
+type listener4 struct {
+	*ipv4.PacketConn
+	net.Interface
+	handlers []handler.Handler4
+	// conn is the connection under PacketConn
+	conn *net.UDPConn
+}
+
+// servers contains state for a running server (with possibly multiple interfaces/listeners)
+type servers struct {
+	listeners []*listener4
+	errors    chan error
+}
+
+func listen4(a *net.UDPAddr) (*listener4, error) {
+	var err error
+	l4 := listener4{}
+	udpConn, err := server4.NewIPv4UDPConn(a.Zone, a)
+	if err != nil {
+		return nil, err
+	}
+	l4.conn = udpConn
+	l4.PacketConn = ipv4.NewPacketConn(udpConn)
+	var ifi *net.Interface
+	if a.Zone != "" {
+		ifi, err = net.InterfaceByName(a.Zone)
+		if err != nil {
+			return nil, fmt.Errorf("DHCPv4: Listen could not find interface %s: %v", a.Zone, err)
+		}
+		l4.Interface = *ifi
+	} else {
+		// When not bound to an interface, we need the information in each
+		// packet to know which interface it came on
+		err = l4.SetControlMessage(ipv4.FlagInterface, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.IP.IsMulticast() {
+		err = l4.JoinGroup(ifi, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &l4, nil
+}
+
+// start loads the plugins and starts the DHCPv4 listeners asynchronously. See
+// `wait` to wait until the execution ends. Only DHCPv4 is served, a
+// configuration with a server6 section is refused rather than half applied.
+func start(config *dhcpconfig.Config) (*servers, error) {
+	if config.Server6 != nil {
+		return nil, fmt.Errorf("DHCPv6 is not supported, remove the server6 section")
+	}
+	handlers4, _, err := dhcpplugins.LoadPlugins(config)
+	if err != nil {
+		return nil, err
+	}
+	srv := servers{
+		errors: make(chan error),
+	}
+	if config.Server4 == nil {
+		return nil, fmt.Errorf("no DHCPv4 configuration found")
+	}
+
+	log.Println("Starting DHCPv4 server")
+	for _, addr := range config.Server4.Addresses {
+		addr := addr
+		l4, err := listen4(&addr)
+		if err != nil {
+			srv.close()
+			return nil, err
+		}
+		l4.handlers = handlers4
+		srv.listeners = append(srv.listeners, l4)
+		go func() {
+			srv.errors <- l4.serve()
+		}()
+	}
+	if len(srv.listeners) > 0 {
+		// DHCPFORCERENEW are sent from the server port too
+		pl_leasedb.SetServerConn(srv.listeners[0].conn)
+	}
+	return &srv, nil
+}
+
+// wait waits until the end of the execution of the server, or until it is
+// stopped by a signal received on stop.
+func (s *servers) wait(stop <-chan os.Signal) error {
+	log.Debug("Waiting")
+	var err error
+	select {
+	case err = <-s.errors:
+	case sig := <-stop:
+		log.Printf("Stopping on %v", sig)
+	}
+	s.close()
+	return err
+}
+
+// close closes all listening connections
+func (s *servers) close() {
+	pl_leasedb.SetServerConn(nil)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// handle4 passes a request through the plugin chain and returns the reply to
+// send, or nil if nothing should be sent.
+func handle4(handlers []handler.Handler4, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		log.Printf("MainHandler4: unsupported opcode %d. Only BootRequest (%d) is supported", req.OpCode, dhcpv4.OpcodeBootRequest)
+		return nil
+	}
+	replyType, ok := replyTypes[req.MessageType()]
+	if !ok {
+		log.Printf("MainHandler4: Unhandled message type: %v", req.MessageType())
+		return nil
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		log.Printf("MainHandler4: failed to build reply: %v", err)
+		return nil
+	}
+	if replyType != dhcpv4.MessageTypeNone {
+		resp.UpdateOption(dhcpv4.OptMessageType(replyType))
+	}
+	var stop bool
+	for _, h := range handlers {
+		resp, stop = h(req, resp)
+		if stop {
+			break
+		}
+	}
+	if resp != nil && resp.MessageType() == dhcpv4.MessageTypeNone {
+		log.Printf("MainHandler4: no reply to %v from the plugins", req.MessageType())
+		return nil
+	}
+	return resp
+}
+
+func (l *listener4) handleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr) {
+	req, err := dhcpv4.FromBytes(buf)
+	bufpool.Put(&buf)
+	if err != nil {
+		log.Printf("Error parsing DHCPv4 request: %v", err)
+		return
+	}
+
+	resp := handle4(l.handlers, req)
+	if resp == nil {
+		log.Print("MainHandler4: dropping request because response is nil")
+		return
+	}
+
+	useEthernet := false
+	var peer *net.UDPAddr
+	if !req.GatewayIPAddr.IsUnspecified() {
+		// TODO: make RFC8357 compliant
+		peer = &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	} else if resp.MessageType() == dhcpv4.MessageTypeNak {
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	} else if !req.ClientIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+	} else if req.IsBroadcast() {
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	} else {
+		//sends a layer2 frame so that we can define the destination MAC address
+		peer = &net.UDPAddr{IP: resp.YourIPAddr, Port: dhcpv4.ClientPort}
+		useEthernet = true
+	}
+
+	var woob *ipv4.ControlMessage
+	if peer.IP.Equal(net.IPv4bcast) || peer.IP.IsLinkLocalUnicast() || useEthernet {
+		// Direct broadcasts, link-local and layer2 unicasts to the interface the request was
+		// received on. Other packets should use the normal routing table in
+		// case of asymetric routing
+		switch {
+		case l.Interface.Index != 0:
+			woob = &ipv4.ControlMessage{IfIndex: l.Interface.Index}
+		case oob != nil && oob.IfIndex != 0:
+			woob = &ipv4.ControlMessage{IfIndex: oob.IfIndex}
+		default:
+			log.Errorf("HandleMsg4: Did not receive interface information")
+		}
+	}
+
+	if useEthernet {
+		if woob == nil {
+			return
+		}
+		intf, err := net.InterfaceByIndex(woob.IfIndex)
+		if err != nil {
+			log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
+			return
+		}
+		if err := sendEthernet(*intf, resp); err != nil {
+			log.Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
+		}
+	} else {
+		if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
+			log.Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
+		}
+	}
+}
+
+// XXX: performance-wise, Pool may or may not be good (see https://github.com/golang/go/issues/23199)
+// Interface is good for what we want. Maybe "just" trust the GC and we'll be fine ?
+var bufpool = sync.Pool{New: func() interface{} { r := make([]byte, maxDatagram); return &r }}
+
+// maxDatagram is the maximum length of message that can be received.
+const maxDatagram = 1 << 16
+
+// serve handles datagrams received on conn and passes them to the pluginchain
+func (l *listener4) serve() error {
+	log.Printf("Listen %s", l.LocalAddr())
+	for {
+		b := *bufpool.Get().(*[]byte)
+		b = b[:maxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
+
+		n, oob, peer, err := l.ReadFrom(b)
+		if err != nil {
+			log.Printf("Error reading from connection: %v", err)
+			return err
+		}
+		go l.handleMsg4(b[:n], oob, peer)
+	}
+}
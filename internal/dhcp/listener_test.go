@@ -0,0 +1,165 @@
+package dhcp
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	dhcpconfig "github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pl_leasedb "github.com/cldmnky/hyperdhcp/internal/dhcp/plugins/leasedb"
+)
+
+func TestHandle4(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	passthrough := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		return resp, false
+	}
+	drop := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		return nil, true
+	}
+
+	tests := []struct {
+		name     string
+		msgType  dhcpv4.MessageType
+		handlers []handler.Handler4
+		wantType dhcpv4.MessageType
+		wantNil  bool
+	}{
+		{
+			name:     "discover gets an offer",
+			msgType:  dhcpv4.MessageTypeDiscover,
+			handlers: []handler.Handler4{passthrough},
+			wantType: dhcpv4.MessageTypeOffer,
+		},
+		{
+			name:     "request gets an ack",
+			msgType:  dhcpv4.MessageTypeRequest,
+			handlers: []handler.Handler4{passthrough},
+			wantType: dhcpv4.MessageTypeAck,
+		},
+		{
+			name:     "inform gets an ack",
+			msgType:  dhcpv4.MessageTypeInform,
+			handlers: []handler.Handler4{passthrough},
+			wantType: dhcpv4.MessageTypeAck,
+		},
+		{
+			name:     "release reaches the plugins",
+			msgType:  dhcpv4.MessageTypeRelease,
+			handlers: []handler.Handler4{drop},
+			wantNil:  true,
+		},
+		{
+			name:     "release without a reply type is not answered",
+			msgType:  dhcpv4.MessageTypeRelease,
+			handlers: []handler.Handler4{passthrough},
+			wantNil:  true,
+		},
+		{
+			name:     "decline without a reply type is not answered",
+			msgType:  dhcpv4.MessageTypeDecline,
+			handlers: []handler.Handler4{passthrough},
+			wantNil:  true,
+		},
+		{
+			name:     "leasequery without a reply from the plugins is not answered",
+			msgType:  pl_leasedb.MessageTypeLeaseQuery,
+			handlers: []handler.Handler4{passthrough},
+			wantNil:  true,
+		},
+		{
+			name:    "leasequery is answered by the plugins",
+			msgType: pl_leasedb.MessageTypeLeaseQuery,
+			handlers: []handler.Handler4{func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+				resp.UpdateOption(dhcpv4.OptMessageType(pl_leasedb.MessageTypeLeaseUnknown))
+				return resp, true
+			}},
+			wantType: pl_leasedb.MessageTypeLeaseUnknown,
+		},
+		{
+			name:     "unknown message type is dropped",
+			msgType:  dhcpv4.MessageType(200),
+			handlers: []handler.Handler4{passthrough},
+			wantNil:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen dhcpv4.MessageType
+			record := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+				seen = req.MessageType()
+				return resp, false
+			}
+			req, err := dhcpv4.New(
+				dhcpv4.WithHwAddr(mac),
+				dhcpv4.WithMessageType(tt.msgType),
+			)
+			require.NoError(t, err)
+
+			resp := handle4(append([]handler.Handler4{record}, tt.handlers...), req)
+			if tt.wantNil {
+				assert.Nil(t, resp)
+			} else {
+				require.NotNil(t, resp)
+				assert.Equal(t, tt.wantType, resp.MessageType())
+			}
+			if _, ok := replyTypes[tt.msgType]; ok {
+				assert.Equal(t, tt.msgType, seen)
+			}
+		})
+	}
+}
+
+func TestHandle4PluginReplyType(t *testing.T) {
+	req, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+	require.NoError(t, err)
+	// A plugin may answer a message we have no default reply type for
+	nak := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+		return resp, true
+	}
+	resp := handle4([]handler.Handler4{nak}, req)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+}
+
+func TestHandle4BootReply(t *testing.T) {
+	req, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	require.NoError(t, err)
+	req.OpCode = dhcpv4.OpcodeBootReply
+	called := false
+	h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		called = true
+		return resp, false
+	}
+	assert.Nil(t, handle4([]handler.Handler4{h}, req))
+	assert.False(t, called)
+}
+
+func TestStartServer6(t *testing.T) {
+	srv, err := start(&dhcpconfig.Config{
+		Server4: &dhcpconfig.ServerConfig{},
+		Server6: &dhcpconfig.ServerConfig{},
+	})
+	assert.ErrorContains(t, err, "DHCPv6 is not supported")
+	assert.Nil(t, srv)
+}
+
+func TestServerStop(t *testing.T) {
+	srv, err := start(&dhcpconfig.Config{
+		Server4: &dhcpconfig.ServerConfig{
+			Addresses: []net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+		},
+	})
+	require.NoError(t, err)
+	stop := make(chan os.Signal, 1)
+	stop <- syscall.SIGTERM
+	assert.NoError(t, srv.wait(stop))
+}
@@ -2,7 +2,10 @@ package kubevirt
 
 import (
 	"context"
-	"sync"
+	"fmt"
+	"net"
+	"sort"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -10,7 +13,10 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
@@ -24,26 +30,40 @@ var Plugin = plugins.Plugin{
 	Setup4: setupKubevirt,
 }
 
+const (
+	// kubevirtResync is how often the cached instances are resynced, on top
+	// of the changes watched
+	kubevirtResync = 10 * time.Minute
+	// kubevirtSyncTimeout is how long the setup waits for the instances to be
+	// cached. Packets are dropped until they are.
+	kubevirtSyncTimeout = 30 * time.Second
+	// macIndex indexes the cached instances by the MAC addresses of their
+	// interfaces
+	macIndex = "mac"
+	// messageTypeLeaseQuery is the message type of DHCPLEASEQUERY, RFC 4388,
+	// which the dhcpv4 package does not define
+	messageTypeLeaseQuery dhcpv4.MessageType = 10
+)
+
 type KubevirtInstance struct {
 	Name       string
 	Namespace  string
 	Interfaces []kubevirtv1.VirtualMachineInstanceNetworkInterface
 }
 
+// KubevirtState finds the instances of DHCP clients in a cache of the
+// VirtualMachineInstances of all namespaces, which an informer keeps up to
+// date by watching them
 type KubevirtState struct {
-	sync.Mutex
-	Client    versioned.Interface
-	Instances []KubevirtInstance
+	Client   versioned.Interface
+	informer cache.SharedIndexInformer
 }
 
 func setupKubevirt(args ...string) (handler.Handler4, error) {
 	var (
-		k   KubevirtState
 		err error
 		cfg *rest.Config
 	)
-	k.Lock()
-	defer k.Unlock()
 	if len(args) == 0 {
 		cfg, err = clientcmd.BuildConfigFromFlags("", "")
 		if err != nil {
@@ -58,27 +78,91 @@ func setupKubevirt(args ...string) (handler.Handler4, error) {
 			return nil, err
 		}
 	}
-	k.Client, err = versioned.NewForConfig(cfg)
+	client, err := versioned.NewForConfig(cfg)
 	if err != nil {
 		log.WithError(err).Error("failed to create kubevirt client")
 		return nil, err
 	}
+	k := newKubevirtState(client, kubevirtResync)
+	// Like the plugin, the informer runs for the lifetime of the process
+	go k.informer.Run(make(chan struct{}))
+	if !k.waitForSync(kubevirtSyncTimeout) {
+		log.WithField("timeout", kubevirtSyncTimeout).Warning("kubevirt instances not cached yet, dropping packets until they are")
+	}
 	return k.kubevirtHandler4, nil
 }
 
+// newKubevirtState returns the state of the plugin with an informer caching
+// the instances of client, resynced every resync. The informer has to be run.
+func newKubevirtState(client versioned.Interface, resync time.Duration) *KubevirtState {
+	instances := client.KubevirtV1().VirtualMachineInstances(v1.NamespaceAll)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return instances.List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return instances.Watch(context.Background(), options)
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &kubevirtv1.VirtualMachineInstance{}, resync, cache.Indexers{
+		macIndex: indexByMAC,
+	})
+	return &KubevirtState{
+		Client:   client,
+		informer: informer,
+	}
+}
+
+// waitForSync waits until the instances are cached, at most timeout. It
+// returns whether they are.
+func (k *KubevirtState) waitForSync(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cache.WaitForCacheSync(ctx.Done(), k.informer.HasSynced)
+}
+
+// indexByMAC returns the MAC addresses of the interfaces of an instance,
+// normalized so they match the ones of the DHCP clients
+func indexByMAC(obj interface{}) ([]string, error) {
+	vmi, ok := obj.(*kubevirtv1.VirtualMachineInstance)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	var macs []string
+	for _, i := range vmi.Status.Interfaces {
+		mac, err := net.ParseMAC(i.MAC)
+		if err != nil {
+			continue
+		}
+		macs = append(macs, mac.String())
+	}
+	return macs, nil
+}
+
 func (k *KubevirtState) kubevirtHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	k.Lock()
-	defer k.Unlock()
-	// refresh instances
-	if err := k.refreshKubevirtInstances(); err != nil {
-		log.WithError(err).Error("failed to refresh kubevirt instances")
+	// Leasequeries come from relays and tools, not from the VMIs. Hosts with
+	// an address of their own ask for their configuration with a DHCPINFORM,
+	// VMIs or not, and are not given a lease: VMIs are named, other hosts
+	// answered as they are.
+	inform := req.MessageType() == dhcpv4.MessageTypeInform
+	if req.MessageType() == messageTypeLeaseQuery {
+		return resp, false
+	}
+	if !k.informer.HasSynced() {
+		if inform {
+			return resp, false
+		}
+		// Clients retry, by then the instances are known
+		log.Warning("kubevirt instances not cached yet, dropping packet")
 		return nil, true
 	}
 	// get machine instance for MAC
 	mac := req.ClientHWAddr.String()
-	log.WithField("mac", mac).Info("looking for machine instance")
 	i := k.getKubevirtInstanceForMAC(mac)
 	if i == nil {
+		if inform {
+			return resp, false
+		}
 		log.WithField("mac", mac).Info("no machine instance found")
 		return nil, true
 	}
@@ -86,52 +170,29 @@ func (k *KubevirtState) kubevirtHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCP
 	return resp, false
 }
 
+// getKubevirtInstanceForMAC returns the cached instance with an interface of
+// MAC address mac, the first by namespace and name if there are several
 func (k *KubevirtState) getKubevirtInstanceForMAC(mac string) *KubevirtInstance {
-	log.WithField("mac", mac).Info("looking for machine instance")
-	log.WithField("instances", len(k.Instances)).Info("number of instances")
-	// instances
-	log.WithField("instances", k.Instances).Info("instances")
-	for _, i := range k.Instances {
-		log.WithField("checking instance", i).Info("instance")
-		for _, j := range i.Interfaces {
-			if j.MAC == mac {
-				return &i
-			}
-		}
-	}
-	log.WithField("mac", mac).Info("no machine instance found")
-	return nil
-}
-
-// addKubevirtInstance
-func (k *KubevirtState) addKubevirtInstance(i *KubevirtInstance) {
-	log.WithField("instance", i).Info("adding instance")
-	// append if new, update if exists
-	for idx, j := range k.Instances {
-		if j.Name == i.Name && j.Namespace == i.Namespace {
-			k.Instances[idx] = *i
-			return
-		}
-	}
-	k.Instances = append(k.Instances, *i)
-	log.WithField("instances", len(k.Instances)).Info("number of instances")
-}
-
-// refreshKubevirtInstances
-func (k *KubevirtState) refreshKubevirtInstances() error {
-	vmi, err := k.Client.KubevirtV1().VirtualMachineInstances(v1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	log.WithField("mac", mac).Debug("looking for machine instance")
+	objs, err := k.informer.GetIndexer().ByIndex(macIndex, mac)
 	if err != nil {
-		log.WithError(err).Error("failed to list virtual machine instances")
-		return err
+		log.WithError(err).Error("failed to look up machine instance")
+		return nil
+	}
+	if len(objs) == 0 {
+		return nil
 	}
-	k.Instances = []KubevirtInstance{}
-	for _, v := range vmi.Items {
-		log.WithField("name", v.Name).Info("found virtual machine instance")
-		k.addKubevirtInstance(&KubevirtInstance{
-			Name:       v.Name,
-			Namespace:  v.Namespace,
-			Interfaces: v.Status.Interfaces,
-		})
+	sort.Slice(objs, func(i, j int) bool {
+		a, b := objs[i].(*kubevirtv1.VirtualMachineInstance), objs[j].(*kubevirtv1.VirtualMachineInstance)
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	vmi := objs[0].(*kubevirtv1.VirtualMachineInstance)
+	return &KubevirtInstance{
+		Name:       vmi.Name,
+		Namespace:  vmi.Namespace,
+		Interfaces: vmi.Status.Interfaces,
 	}
-	return nil
 }
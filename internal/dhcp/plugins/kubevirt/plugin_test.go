@@ -4,16 +4,50 @@ import (
 	"context"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/clientcmd"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	"github.com/cldmnky/hyperdhcp/internal/dhcp/plugins/kubevirt/client/versioned/fake"
 )
 
+// newTestKubevirtState returns the state of the plugin caching the instances
+// of a fake clientset holding vmis, once they are cached
+func newTestKubevirtState(t *testing.T, vmis ...*kubevirtv1.VirtualMachineInstance) (*KubevirtState, *fake.Clientset) {
+	t.Helper()
+	objs := make([]runtime.Object, 0, len(vmis))
+	for _, vmi := range vmis {
+		objs = append(objs, vmi)
+	}
+	client := fake.NewSimpleClientset(objs...)
+	k := newKubevirtState(client, kubevirtResync)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go k.informer.Run(stop)
+	require.True(t, k.waitForSync(5*time.Second))
+	return k, client
+}
+
+// newVMI returns an instance with interfaces of the given MAC addresses
+func newVMI(namespace, name string, macs ...string) *kubevirtv1.VirtualMachineInstance {
+	vmi := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	for _, mac := range macs {
+		vmi.Status.Interfaces = append(vmi.Status.Interfaces, kubevirtv1.VirtualMachineInstanceNetworkInterface{MAC: mac})
+	}
+	return vmi
+}
+
 func TestSetupKubevirt(t *testing.T) {
 	// Test case 1: Valid argument
 	handler, err := setupKubevirt(clientcmd.RecommendedHomeFile)
@@ -27,15 +61,7 @@ func TestSetupKubevirt(t *testing.T) {
 }
 
 func TestKubevirtHandler4(t *testing.T) {
-	k := &KubevirtState{
-		Client: fake.NewSimpleClientset(),
-	}
-	req := &dhcpv4.DHCPv4{
-		ClientHWAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-	}
-	resp := &dhcpv4.DHCPv4{}
-	// add instance to fake client
-	k.Client.KubevirtV1().VirtualMachineInstances("test").Create(context.Background(), &kubevirtv1.VirtualMachineInstance{
+	k, _ := newTestKubevirtState(t, &kubevirtv1.VirtualMachineInstance{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "test",
 			Namespace: "test",
@@ -49,7 +75,11 @@ func TestKubevirtHandler4(t *testing.T) {
 				},
 			},
 		},
-	}, metav1.CreateOptions{})
+	})
+	req := &dhcpv4.DHCPv4{
+		ClientHWAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	resp := &dhcpv4.DHCPv4{}
 	expectedResp := resp
 	expectedContinue := false
 	actualResp, actualContinue := k.kubevirtHandler4(req, resp)
@@ -58,16 +88,8 @@ func TestKubevirtHandler4(t *testing.T) {
 }
 
 func TestKubevirtHandler4NoMatch(t *testing.T) {
-	k := &KubevirtState{
-		Client: fake.NewSimpleClientset(),
-	}
-	req := &dhcpv4.DHCPv4{
-		ClientHWAddr: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
-	}
-	resp := &dhcpv4.DHCPv4{}
-
 	// Create VM instance with different MAC
-	k.Client.KubevirtV1().VirtualMachineInstances("test").Create(context.Background(), &kubevirtv1.VirtualMachineInstance{
+	k, _ := newTestKubevirtState(t, &kubevirtv1.VirtualMachineInstance{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "test-vm",
 			Namespace: "test",
@@ -80,79 +102,138 @@ func TestKubevirtHandler4NoMatch(t *testing.T) {
 				},
 			},
 		},
-	}, metav1.CreateOptions{})
+	})
+	req := &dhcpv4.DHCPv4{
+		ClientHWAddr: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	resp := &dhcpv4.DHCPv4{}
 
 	actualResp, actualContinue := k.kubevirtHandler4(req, resp)
 	assert.Nil(t, actualResp)
 	assert.True(t, actualContinue)
 }
 
+func TestKubevirtHandler4LeaseQuery(t *testing.T) {
+	k, _ := newTestKubevirtState(t)
+	req, err := dhcpv4.New(dhcpv4.WithMessageType(messageTypeLeaseQuery))
+	assert.NoError(t, err)
+	resp := &dhcpv4.DHCPv4{}
+
+	// Leasequeries are answered for any client, VMI or not
+	actualResp, actualContinue := k.kubevirtHandler4(req, resp)
+	assert.Equal(t, resp, actualResp)
+	assert.False(t, actualContinue)
+}
+
+func TestKubevirtHandler4Inform(t *testing.T) {
+	k, _ := newTestKubevirtState(t, newVMI("default", "vm1", "aa:bb:cc:dd:ee:ff"))
+	req, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+		dhcpv4.WithHwAddr(net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	)
+	assert.NoError(t, err)
+	resp := &dhcpv4.DHCPv4{}
+
+	// Hosts that are not VMIs get their configuration too, unchanged
+	actualResp, actualContinue := k.kubevirtHandler4(req, resp)
+	assert.Equal(t, resp, actualResp)
+	assert.False(t, actualContinue)
+	assert.False(t, actualResp.Options.Has(dhcpv4.OptionHostName))
+
+	// VMIs are named
+	req, err = dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+		dhcpv4.WithHwAddr(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}),
+	)
+	assert.NoError(t, err)
+	actualResp, actualContinue = k.kubevirtHandler4(req, &dhcpv4.DHCPv4{})
+	assert.NotNil(t, actualResp)
+	assert.False(t, actualContinue)
+	assert.Equal(t, "vm1", actualResp.HostName())
+}
+
+func TestKubevirtHandler4NotSynced(t *testing.T) {
+	// The informer is not run, the instances are never cached
+	k := newKubevirtState(fake.NewSimpleClientset(newVMI("default", "vm1", "aa:bb:cc:dd:ee:ff")), kubevirtResync)
+	req := &dhcpv4.DHCPv4{
+		ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}
+	actualResp, actualContinue := k.kubevirtHandler4(req, &dhcpv4.DHCPv4{})
+	assert.Nil(t, actualResp)
+	assert.True(t, actualContinue)
+	assert.False(t, k.waitForSync(100*time.Millisecond))
+}
+
+func TestKubevirtHandler4FromCache(t *testing.T) {
+	k, client := newTestKubevirtState(t, newVMI("default", "vm1", "aa:bb:cc:dd:ee:ff"))
+	actions := len(client.Actions())
+	req := &dhcpv4.DHCPv4{
+		ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}
+	for i := 0; i < 10; i++ {
+		result, stop := k.kubevirtHandler4(req, &dhcpv4.DHCPv4{})
+		require.NotNil(t, result)
+		assert.False(t, stop)
+	}
+	// Packets are answered without asking the API server
+	assert.Len(t, client.Actions(), actions)
+}
+
 func TestGetKubevirtInstanceForMAC(t *testing.T) {
 	tests := []struct {
-		name      string
-		instances []KubevirtInstance
-		mac       string
-		wantName  string
-		wantNil   bool
+		name     string
+		vmis     []*kubevirtv1.VirtualMachineInstance
+		mac      string
+		wantName string
+		wantNil  bool
 	}{
 		{
-			name: "found matching MAC",
-			instances: []KubevirtInstance{
-				{
-					Name:      "vm1",
-					Namespace: "default",
-					Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-						{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.0.1"},
-					},
-				},
-			},
+			name:     "found matching MAC",
+			vmis:     []*kubevirtv1.VirtualMachineInstance{newVMI("default", "vm1", "aa:bb:cc:dd:ee:ff")},
 			mac:      "aa:bb:cc:dd:ee:ff",
 			wantName: "vm1",
 			wantNil:  false,
 		},
 		{
-			name: "MAC not found",
-			instances: []KubevirtInstance{
-				{
-					Name:      "vm1",
-					Namespace: "default",
-					Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-						{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.0.1"},
-					},
-				},
-			},
+			name:    "MAC not found",
+			vmis:    []*kubevirtv1.VirtualMachineInstance{newVMI("default", "vm1", "aa:bb:cc:dd:ee:ff")},
 			mac:     "11:22:33:44:55:66",
 			wantNil: true,
 		},
 		{
-			name: "multiple interfaces, found in second",
-			instances: []KubevirtInstance{
-				{
-					Name:      "vm2",
-					Namespace: "default",
-					Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-						{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.0.1"},
-						{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.0.2"},
-					},
-				},
-			},
+			name:     "multiple interfaces, found in second",
+			vmis:     []*kubevirtv1.VirtualMachineInstance{newVMI("default", "vm2", "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02")},
 			mac:      "aa:bb:cc:dd:ee:02",
 			wantName: "vm2",
 			wantNil:  false,
 		},
 		{
-			name:      "empty instances",
-			instances: []KubevirtInstance{},
-			mac:       "aa:bb:cc:dd:ee:ff",
-			wantNil:   true,
+			name:     "upper case MAC of the instance",
+			vmis:     []*kubevirtv1.VirtualMachineInstance{newVMI("default", "vm1", "AA:BB:CC:DD:EE:FF")},
+			mac:      "aa:bb:cc:dd:ee:ff",
+			wantName: "vm1",
+			wantNil:  false,
+		},
+		{
+			name: "several instances with the MAC",
+			vmis: []*kubevirtv1.VirtualMachineInstance{
+				newVMI("ns2", "vm1", "aa:bb:cc:dd:ee:ff"),
+				newVMI("ns1", "vm2", "aa:bb:cc:dd:ee:ff"),
+			},
+			mac:      "aa:bb:cc:dd:ee:ff",
+			wantName: "vm2",
+			wantNil:  false,
+		},
+		{
+			name:    "empty instances",
+			mac:     "aa:bb:cc:dd:ee:ff",
+			wantNil: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			k := &KubevirtState{
-				Instances: tt.instances,
-			}
+			k, _ := newTestKubevirtState(t, tt.vmis...)
 			result := k.getKubevirtInstanceForMAC(tt.mac)
 			if tt.wantNil {
 				assert.Nil(t, result)
@@ -164,142 +245,41 @@ func TestGetKubevirtInstanceForMAC(t *testing.T) {
 	}
 }
 
-func TestAddKubevirtInstance(t *testing.T) {
-	tests := []struct {
-		name           string
-		existing       []KubevirtInstance
-		newInstance    *KubevirtInstance
-		expectedCount  int
-		expectedUpdate bool
-	}{
-		{
-			name:     "add new instance to empty list",
-			existing: []KubevirtInstance{},
-			newInstance: &KubevirtInstance{
-				Name:      "vm1",
-				Namespace: "default",
-			},
-			expectedCount: 1,
-		},
-		{
-			name: "update existing instance",
-			existing: []KubevirtInstance{
-				{
-					Name:      "vm1",
-					Namespace: "default",
-					Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-						{MAC: "old:mac:addr"},
-					},
-				},
-			},
-			newInstance: &KubevirtInstance{
-				Name:      "vm1",
-				Namespace: "default",
-				Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-					{MAC: "new:mac:addr"},
-				},
-			},
-			expectedCount:  1,
-			expectedUpdate: true,
-		},
-		{
-			name: "add new instance to existing list",
-			existing: []KubevirtInstance{
-				{
-					Name:      "vm1",
-					Namespace: "default",
-				},
-			},
-			newInstance: &KubevirtInstance{
-				Name:      "vm2",
-				Namespace: "default",
-			},
-			expectedCount: 2,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			k := &KubevirtState{
-				Instances: tt.existing,
+func TestKubevirtInstancesWatched(t *testing.T) {
+	k, client := newTestKubevirtState(t, newVMI("ns1", "vm1", "aa:bb:cc:dd:ee:01"))
+	vmis := client.KubevirtV1().VirtualMachineInstances("ns2")
+	ctx := context.Background()
+	found := func(mac, name string) func() bool {
+		return func() bool {
+			i := k.getKubevirtInstanceForMAC(mac)
+			if name == "" {
+				return i == nil
 			}
-			k.addKubevirtInstance(tt.newInstance)
-			assert.Equal(t, tt.expectedCount, len(k.Instances))
-
-			if tt.expectedUpdate {
-				// Verify the instance was updated
-				found := false
-				for _, inst := range k.Instances {
-					if inst.Name == tt.newInstance.Name && inst.Namespace == tt.newInstance.Namespace {
-						found = true
-						assert.Equal(t, tt.newInstance.Interfaces, inst.Interfaces)
-					}
-				}
-				assert.True(t, found)
-			}
-		})
+			return i != nil && i.Name == name
+		}
 	}
-}
 
-func TestRefreshKubevirtInstances(t *testing.T) {
-	client := fake.NewSimpleClientset()
+	// Instances created in any namespace are cached
+	_, err := vmis.Create(ctx, newVMI("ns2", "vm2", "aa:bb:cc:dd:ee:02"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, found("aa:bb:cc:dd:ee:02", "vm2"), 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, k.getKubevirtInstanceForMAC("aa:bb:cc:dd:ee:01"))
 
-	// Create multiple VMs in different namespaces
-	client.KubevirtV1().VirtualMachineInstances("ns1").Create(context.Background(), &kubevirtv1.VirtualMachineInstance{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "vm1",
-			Namespace: "ns1",
-		},
-		Status: kubevirtv1.VirtualMachineInstanceStatus{
-			Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-				{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.1"},
-			},
-		},
-	}, metav1.CreateOptions{})
+	// Interfaces changing MAC address are found by the new one only
+	_, err = vmis.Update(ctx, newVMI("ns2", "vm2", "aa:bb:cc:dd:ee:03"), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, found("aa:bb:cc:dd:ee:03", "vm2"), 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, k.getKubevirtInstanceForMAC("aa:bb:cc:dd:ee:02"))
 
-	client.KubevirtV1().VirtualMachineInstances("ns2").Create(context.Background(), &kubevirtv1.VirtualMachineInstance{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "vm2",
-			Namespace: "ns2",
-		},
-		Status: kubevirtv1.VirtualMachineInstanceStatus{
-			Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
-				{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.2.1"},
-			},
-		},
-	}, metav1.CreateOptions{})
-
-	k := &KubevirtState{
-		Client: client,
-	}
-
-	err := k.refreshKubevirtInstances()
-	assert.NoError(t, err)
-	assert.Equal(t, 2, len(k.Instances))
-
-	// Verify instances were added correctly
-	foundVM1 := false
-	foundVM2 := false
-	for _, inst := range k.Instances {
-		if inst.Name == "vm1" && inst.Namespace == "ns1" {
-			foundVM1 = true
-		}
-		if inst.Name == "vm2" && inst.Namespace == "ns2" {
-			foundVM2 = true
-		}
-	}
-	assert.True(t, foundVM1)
-	assert.True(t, foundVM2)
+	// Deleted instances are dropped
+	require.NoError(t, vmis.Delete(ctx, "vm2", metav1.DeleteOptions{}))
+	assert.Eventually(t, found("aa:bb:cc:dd:ee:03", ""), 5*time.Second, 10*time.Millisecond)
 }
 
 func TestKubevirtHandler4WithHostname(t *testing.T) {
-	k := &KubevirtState{
-		Client: fake.NewSimpleClientset(),
-	}
-
 	// Create VM instance
 	vmName := "test-vm-hostname"
-	k.Client.KubevirtV1().VirtualMachineInstances("default").Create(context.Background(), &kubevirtv1.VirtualMachineInstance{
+	k, _ := newTestKubevirtState(t, &kubevirtv1.VirtualMachineInstance{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      vmName,
 			Namespace: "default",
@@ -309,7 +289,7 @@ func TestKubevirtHandler4WithHostname(t *testing.T) {
 				{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.0.1"},
 			},
 		},
-	}, metav1.CreateOptions{})
+	})
 
 	req := &dhcpv4.DHCPv4{
 		ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
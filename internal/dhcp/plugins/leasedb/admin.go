@@ -0,0 +1,95 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// adminHandler returns the handler of the admin endpoint of the plugin:
+//   - GET /history queries the lease history, see serveHistory
+//   - POST /forcerenew asks bound clients to renew, see serveForceRenew
+func (p *PluginState) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if p.history != nil {
+		mux.HandleFunc("/history", p.serveHistory)
+	}
+	if p.forceRenewer != nil {
+		mux.HandleFunc("/forcerenew", p.serveForceRenew)
+	}
+	return mux
+}
+
+// serveForceRenew asks the bound clients to renew their lease, all of them or
+// the one selected by the ip or mac query parameter. It answers with how many
+// clients are asked, which goes on in the background.
+func (p *PluginState) serveForceRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		ip     net.IP
+		mac    string
+		params = r.URL.Query()
+	)
+	if value := params.Get("ip"); value != "" {
+		if ip = net.ParseIP(value).To4(); ip == nil {
+			http.Error(w, fmt.Sprintf("invalid ip: %v", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := params.Get("mac"); value != "" {
+		hwaddr, err := net.ParseMAC(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid mac: %v", value), http.StatusBadRequest)
+			return
+		}
+		mac = hwaddr.String()
+	}
+	n, err := p.forceRenew(ip, mac)
+	switch {
+	case errors.Is(err, errForceRenewRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errForceRenewStandby):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Errorf("Could not ask clients to renew: %v", err)
+		http.Error(w, "could not ask clients to renew", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]int{"clients": n}); err != nil {
+		log.Warningf("Could not answer force renew request: %v", err)
+	}
+}
+
+// listenAdmin serves the admin endpoint of the plugin on addr. The server is
+// never shut down, it only stops serving if it fails, which is logged.
+func (p *PluginState) listenAdmin(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on admin address %s: %w", addr, err)
+	}
+	server := &http.Server{
+		Handler:           p.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Admin endpoint on %s failed: %v", addr, err)
+		}
+	}()
+	log.Printf("Serving the admin endpoint on %s", ln.Addr())
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// The message types of bulk leasequery, RFC 6926 section 6.2, which the
+// dhcpv4 package does not define
+const (
+	MessageTypeBulkLeaseQuery dhcpv4.MessageType = 14
+	MessageTypeLeaseQueryDone dhcpv4.MessageType = 15
+)
+
+// The status codes of the status-code option, RFC 6926 section 6.2.2
+const (
+	bulkSuccess        byte = 0
+	bulkUnspecFail     byte = 1
+	bulkMalformedQuery byte = 3
+	bulkNotAllowed     byte = 4
+)
+
+// The states of the dhcp-state option, RFC 6926 section 6.2.7
+const (
+	dhcpStateActive  byte = 2
+	dhcpStateExpired byte = 3
+)
+
+const (
+	// defaultBulkConns is how many bulk leasequery connections are served at
+	// once unless configured otherwise with the bulk-conns argument
+	defaultBulkConns = 4
+	// bulkIdleTimeout is how long a bulk leasequery connection may wait for
+	// a query before it is closed
+	bulkIdleTimeout = 30 * time.Second
+	// bulkWriteTimeout bounds the write of a single reply, so a consumer that
+	// stopped reading does not hold a connection forever
+	bulkWriteTimeout = 10 * time.Second
+)
+
+// relay agent information suboptions identifying relays and their clients,
+// which leases are not stored with
+const (
+	relayAgentRemoteID = 2
+	relayAgentRelayID  = 12
+)
+
+// listenBulk serves bulk leasequeries on addr. The listener is never closed,
+// connections are accepted until accepting fails.
+func (p *PluginState) listenBulk(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on bulk leasequery address %s: %w", addr, err)
+	}
+	go p.serveBulk(ln)
+	log.Printf("Serving bulk leasequeries on %s", ln.Addr())
+	return nil
+}
+
+// serveBulk accepts bulk leasequery connections on ln until it is closed.
+// Connections of requestors that are not allowed, RFC 6926 section 5.1, and
+// connections beyond BulkConns are closed right away.
+func (p *PluginState) serveBulk(ln net.Listener) {
+	slots := make(chan struct{}, p.BulkConns)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Could not accept bulk leasequery connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !p.bulkAllows(conn.RemoteAddr()) {
+			log.Warningf("Refusing bulk leasequery connection from %s, it is not an allowed requestor", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				p.serveBulkConn(conn)
+			}()
+		default:
+			log.Warningf("Refusing bulk leasequery connection from %s, %d are open already", conn.RemoteAddr(), p.BulkConns)
+			conn.Close()
+		}
+	}
+}
+
+// parseBulkAllow parses a bulk-allow argument, an address or a network in
+// CIDR notation
+func parseBulkAllow(value string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bulk leasequery requestor: %v", value)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// bulkAllows reports whether a requestor may query the leases in bulk
+func (p *PluginState) bulkAllows(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, allowed := range p.bulkAllowed {
+		if allowed.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveBulkConn answers the bulk leasequeries of a connection one after the
+// other, until the consumer closes it or stays idle for bulkIdleTimeout
+func (p *PluginState) serveBulkConn(conn net.Conn) {
+	defer conn.Close()
+	var sid net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		sid = addr.IP.To4()
+	}
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(bulkIdleTimeout)); err != nil {
+			return
+		}
+		req, err := readBulkMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Warningf("Closing bulk leasequery connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		send := func(reply *dhcpv4.DHCPv4) error {
+			if err := conn.SetWriteDeadline(time.Now().Add(bulkWriteTimeout)); err != nil {
+				return err
+			}
+			return writeBulkMessage(conn, reply)
+		}
+		if err := p.bulkLeasequery(req, sid, send); err != nil {
+			log.Warningf("Closing bulk leasequery connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// bulkLeasequery answers a DHCPBULKLEASEQUERY following RFC 6926, sending a
+// reply for every lease it selects and a DHCPLEASEQUERYDONE last. Leases are
+// selected by IP address in ciaddr, by client identifier in option 61 or by
+// MAC address in chaddr, in that order, and all leases without any of them.
+// Active leases are sent in a DHCPLEASEACTIVE. With a query-start-time
+// (option 154) or query-end-time (option 155) only the leases that changed
+// state in between are selected, including those that expired since, sent in
+// a DHCPLEASEUNASSIGNED. Leases are read from the lease store, so replicas on
+// standby answer too. It returns an error if a reply could not be sent.
+func (p *PluginState) bulkLeasequery(req *dhcpv4.DHCPv4, sid net.IP, send func(*dhcpv4.DHCPv4) error) error {
+	done := func(status byte, message string) error {
+		reply := leasequeryReply(req, sid, MessageTypeLeaseQueryDone)
+		if reply == nil {
+			return errors.New("could not build DHCPLEASEQUERYDONE")
+		}
+		if status != bulkSuccess {
+			log.Printf("Refusing bulk leasequery: %s", message)
+			reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionStatusCode, append([]byte{status}, message...)))
+		}
+		return send(reply)
+	}
+	if req.OpCode != dhcpv4.OpcodeBootRequest || req.MessageType() != MessageTypeBulkLeaseQuery {
+		return done(bulkMalformedQuery, fmt.Sprintf("unexpected %s message", req.MessageType()))
+	}
+	if agent := req.RelayAgentInfo(); agent != nil && (agent.Get(dhcpv4.GenericOptionCode(relayAgentRemoteID)) != nil || agent.Get(dhcpv4.GenericOptionCode(relayAgentRelayID)) != nil) {
+		return done(bulkNotAllowed, "queries by relay-id and remote-id are not supported")
+	}
+	since, until, err := bulkQueryTimes(req)
+	if err != nil {
+		return done(bulkMalformedQuery, err.Error())
+	}
+
+	p.flushWrites()
+	records, err := p.leasedb.Load()
+	if err != nil {
+		log.Errorf("Could not load leases for bulk leasequery: %v", err)
+		return done(bulkUnspecFail, "could not load the leases")
+	}
+	now := time.Now()
+	var clients []string
+	for client, record := range records {
+		if !bulkSelects(req, client, record) {
+			continue
+		}
+		changed := time.Unix(int64(stateStart(record, now)), 0)
+		if since.IsZero() && until.IsZero() {
+			if !record.active(now) {
+				continue
+			}
+		} else if changed.Before(since) || (!until.IsZero() && changed.After(until)) {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return bytes.Compare(records[clients[i]].IP.To4(), records[clients[j]].IP.To4()) < 0
+	})
+
+	for _, client := range clients {
+		record := records[client]
+		msgType, state := MessageTypeLeaseActive, dhcpStateActive
+		if !record.active(now) {
+			msgType, state = MessageTypeLeaseUnassigned, dhcpStateExpired
+		}
+		reply := leasequeryReply(req, sid, msgType)
+		if reply == nil {
+			return done(bulkUnspecFail, "could not describe the leases")
+		}
+		if state == dhcpStateActive {
+			p.describeLease(req, reply, client, record, now)
+		} else {
+			reply.ClientIPAddr = record.IP
+			if hwaddr, err := net.ParseMAC(record.HWAddr); err == nil {
+				reply.ClientHWAddr = hwaddr
+			}
+		}
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionBaseTime, uint32Bytes(uint32(now.Unix()))))
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionStartTimeOfState, uint32Bytes(uint32(max(now.Unix()-int64(stateStart(record, now)), 0)))))
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionDHCPState, []byte{state}))
+		if err := send(reply); err != nil {
+			return err
+		}
+	}
+	return done(bulkSuccess, "")
+}
+
+// bulkQueryTimes returns the query-start-time and query-end-time of a bulk
+// leasequery, zero if not given
+func bulkQueryTimes(req *dhcpv4.DHCPv4) (since, until time.Time, err error) {
+	parse := func(code dhcpv4.OptionCode) (time.Time, error) {
+		value := req.Options.Get(code)
+		if value == nil {
+			return time.Time{}, nil
+		}
+		if len(value) != 4 {
+			return time.Time{}, fmt.Errorf("invalid %s", code)
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(value)), 0), nil
+	}
+	if since, err = parse(dhcpv4.OptionQueryStartTime); err != nil {
+		return
+	}
+	if until, err = parse(dhcpv4.OptionQueryEndTime); err != nil {
+		return
+	}
+	if !until.IsZero() && until.Before(since) {
+		err = errors.New("query-end-time is before query-start-time")
+	}
+	return
+}
+
+// bulkSelects reports whether a bulk leasequery selects the lease of a client
+func bulkSelects(req *dhcpv4.DHCPv4, client string, record *Record) bool {
+	switch {
+	case !req.ClientIPAddr.IsUnspecified():
+		return record.IP.Equal(req.ClientIPAddr)
+	case len(req.Options.Get(dhcpv4.OptionClientIdentifier)) > 0:
+		return client == clientKey(req)
+	case len(req.ClientHWAddr) > 0 && !isZero(req.ClientHWAddr):
+		mac := req.ClientHWAddr.String()
+		return client == mac || record.HWAddr == mac
+	}
+	return true
+}
+
+// stateStart returns when a lease entered its state, as a Unix time: when it
+// expired, or when it was last extended if active
+func stateStart(record *Record, now time.Time) int {
+	if !record.active(now) {
+		return record.expires
+	}
+	if record.lastSeen > 0 {
+		return record.lastSeen
+	}
+	return record.firstSeen
+}
+
+// uint32Bytes returns v in network byte order
+func uint32Bytes(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// readBulkMessage reads a DHCP message from a bulk leasequery connection,
+// where messages are prefixed with their length, RFC 6926 section 5.1
+func readBulkMessage(r io.Reader) (*dhcpv4.DHCPv4, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errors.New("empty message")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return dhcpv4.FromBytes(buf)
+}
+
+// writeBulkMessage writes a DHCP message to a bulk leasequery connection
+func writeBulkMessage(w io.Writer, msg *dhcpv4.DHCPv4) error {
+	buf := msg.ToBytes()
+	if len(buf) > 0xffff {
+		return fmt.Errorf("message of %d bytes is too long", len(buf))
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...))
+	return err
+}
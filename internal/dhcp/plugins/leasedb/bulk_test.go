@@ -0,0 +1,159 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTestBulk serves the bulk leasequeries of pl on a local port and
+// returns its address. Local requestors are allowed unless others are.
+func serveTestBulk(t *testing.T, pl *PluginState) string {
+	t.Helper()
+	if pl.bulkAllowed == nil {
+		allowed, err := parseBulkAllow("127.0.0.1")
+		require.NoError(t, err)
+		pl.bulkAllowed = []*net.IPNet{allowed}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go pl.serveBulk(ln)
+	return ln.Addr().String()
+}
+
+// bulkQuery sends a bulk leasequery on conn and returns the replies, the
+// DHCPLEASEQUERYDONE last
+func bulkQuery(t *testing.T, conn net.Conn, modifiers ...dhcpv4.Modifier) []*dhcpv4.DHCPv4 {
+	t.Helper()
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(MessageTypeBulkLeaseQuery)}, modifiers...)...)
+	require.NoError(t, err)
+	require.NoError(t, writeBulkMessage(conn, req))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var replies []*dhcpv4.DHCPv4
+	for {
+		reply, err := readBulkMessage(conn)
+		require.NoError(t, err)
+		assert.Equal(t, req.TransactionID, reply.TransactionID)
+		replies = append(replies, reply)
+		if reply.MessageType() == MessageTypeLeaseQueryDone {
+			return replies
+		}
+	}
+}
+
+// timeOption returns a query time option
+func timeOption(code dhcpv4.OptionCode, at time.Time) dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptGeneric(code, binary.BigEndian.AppendUint32(nil, uint32(at.Unix()))))
+}
+
+func TestBulkLeasequery(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.BulkConns = 2
+	macs := []net.HardwareAddr{
+		{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01},
+		{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02},
+		{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03},
+	}
+	for _, mac := range macs {
+		lease(t, pl, mac)
+	}
+	now := time.Now()
+	// The first client was last seen long ago, the last one's lease expired
+	old := pl.Recordsv4[macs[0].String()]
+	old.lastSeen = int(now.Add(-2 * time.Hour).Unix())
+	require.NoError(t, pl.leasedb.Upsert(macs[0].String(), old))
+	expired := pl.Recordsv4[macs[2].String()]
+	expired.expires = int(now.Add(-time.Minute).Unix())
+	require.NoError(t, pl.leasedb.Upsert(macs[2].String(), expired))
+
+	conn, err := net.Dial("tcp", serveTestBulk(t, pl))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Run("all active leases", func(t *testing.T) {
+		replies := bulkQuery(t, conn)
+		require.Len(t, replies, 3)
+		for i, reply := range replies[:2] {
+			assert.Equal(t, MessageTypeLeaseActive, reply.MessageType())
+			assert.Equal(t, pl.Recordsv4[macs[i].String()].IP.String(), reply.ClientIPAddr.String())
+			assert.Equal(t, macs[i], reply.ClientHWAddr)
+			assert.Greater(t, reply.IPAddressLeaseTime(0), time.Duration(0))
+			assert.Equal(t, []byte{dhcpStateActive}, reply.Options.Get(dhcpv4.OptionDHCPState))
+			assert.Len(t, reply.Options.Get(dhcpv4.OptionBaseTime), 4)
+		}
+		assert.InDelta(t, (2 * time.Hour).Seconds(), float64(binary.BigEndian.Uint32(replies[0].Options.Get(dhcpv4.OptionStartTimeOfState))), 5)
+		assert.Nil(t, replies[2].Options.Get(dhcpv4.OptionStatusCode))
+	})
+
+	t.Run("leases changed since", func(t *testing.T) {
+		// The same connection serves several queries
+		replies := bulkQuery(t, conn, timeOption(dhcpv4.OptionQueryStartTime, now.Add(-time.Hour)))
+		require.Len(t, replies, 3)
+		assert.Equal(t, MessageTypeLeaseActive, replies[0].MessageType())
+		assert.Equal(t, macs[1], replies[0].ClientHWAddr)
+		assert.Equal(t, MessageTypeLeaseUnassigned, replies[1].MessageType())
+		assert.Equal(t, expired.IP.String(), replies[1].ClientIPAddr.String())
+		assert.Equal(t, []byte{dhcpStateExpired}, replies[1].Options.Get(dhcpv4.OptionDHCPState))
+	})
+
+	t.Run("by MAC address", func(t *testing.T) {
+		replies := bulkQuery(t, conn, dhcpv4.WithHwAddr(macs[1]))
+		require.Len(t, replies, 2)
+		assert.Equal(t, macs[1], replies[0].ClientHWAddr)
+	})
+
+	t.Run("malformed query", func(t *testing.T) {
+		replies := bulkQuery(t, conn,
+			timeOption(dhcpv4.OptionQueryStartTime, now),
+			timeOption(dhcpv4.OptionQueryEndTime, now.Add(-time.Hour)),
+		)
+		require.Len(t, replies, 1)
+		status := replies[0].Options.Get(dhcpv4.OptionStatusCode)
+		require.NotEmpty(t, status)
+		assert.Equal(t, bulkMalformedQuery, status[0])
+	})
+
+	t.Run("connection limit", func(t *testing.T) {
+		addr := serveTestBulk(t, pl)
+		for i := 0; i < pl.BulkConns; i++ {
+			open, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer open.Close()
+			bulkQuery(t, open, dhcpv4.WithHwAddr(macs[1]))
+		}
+		refused, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer refused.Close()
+		require.NoError(t, refused.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = refused.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestBulkLeasequeryRequestors(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.BulkConns = 1
+	allowed, err := parseBulkAllow("192.0.2.0/24")
+	require.NoError(t, err)
+	pl.bulkAllowed = []*net.IPNet{allowed}
+	lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01})
+
+	// Local requestors are not allowed, they are refused without an answer
+	refused, err := net.Dial("tcp", serveTestBulk(t, pl))
+	require.NoError(t, err)
+	defer refused.Close()
+	require.NoError(t, refused.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = refused.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
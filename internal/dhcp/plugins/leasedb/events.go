@@ -0,0 +1,207 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	// defaultEventRetries is how many times the delivery of an event to a
+	// webhook is retried unless configured otherwise with the event-retries
+	// argument
+	defaultEventRetries = 5
+	// eventQueueSize is how many events wait for a sink before new events
+	// are dropped
+	eventQueueSize = 1024
+	// eventTimeout bounds a single delivery of an event to a sink
+	eventTimeout = 10 * time.Second
+)
+
+// EventSink receives the events of the leases: allocations, renewals,
+// releases, expiries and declines. The events are described like in the lease
+// history.
+type EventSink interface {
+	// Send delivers an event, giving up when ctx is done
+	Send(ctx context.Context, entry HistoryEntry) error
+	// String describes the sink in logs
+	String() string
+}
+
+// eventBus publishes the events of the leases to sinks. Every sink has a
+// queue delivered in order in the background, so a slow or unavailable sink
+// holds up neither the clients nor the other sinks. Events are dropped when
+// the queue of a sink is full.
+type eventBus struct {
+	queues []chan HistoryEntry
+}
+
+// newEventBus returns a bus publishing to sinks, each delivered to by a
+// goroutine of its own. The events still queued when the process exits are
+// not delivered.
+func newEventBus(sinks ...EventSink) *eventBus {
+	bus := &eventBus{}
+	for _, sink := range sinks {
+		queue := make(chan HistoryEntry, eventQueueSize)
+		bus.queues = append(bus.queues, queue)
+		go deliver(sink, queue)
+	}
+	return bus
+}
+
+// deliver sends the events of a queue to a sink. Events the sink fails to
+// receive are logged and dropped.
+func deliver(sink EventSink, queue <-chan HistoryEntry) {
+	for entry := range queue {
+		if err := sink.Send(context.Background(), entry); err != nil {
+			log.Errorf("Could not send %s of IP %s for client %s to %s: %v", entry.Event, entry.IP, entry.Client, sink, err)
+		}
+	}
+}
+
+// publish queues an event for all the sinks, it does not wait for them
+func (b *eventBus) publish(entry HistoryEntry) {
+	if b == nil {
+		return
+	}
+	for _, queue := range b.queues {
+		select {
+		case queue <- entry:
+		default:
+			log.Warningf("Dropping %s of IP %s for client %s, too many events are waiting to be sent", entry.Event, entry.IP, entry.Client)
+		}
+	}
+}
+
+// webhookSink POSTs the events as JSON to a URL. Deliveries failing for
+// reasons that may go away are retried, waiting twice as long every time.
+type webhookSink struct {
+	url     string
+	client  *http.Client
+	retries int
+	// backoff is how long the first retry waits
+	backoff time.Duration
+}
+
+// newWebhookSink returns a sink POSTing the events to rawURL, retrying failed
+// deliveries retries times
+func newWebhookSink(rawURL string, retries int) (*webhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %v", rawURL)
+	}
+	return &webhookSink{
+		url:     rawURL,
+		client:  &http.Client{Timeout: eventTimeout},
+		retries: retries,
+		backoff: time.Second,
+	}, nil
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + s.url
+}
+
+// Send POSTs an event, retrying on network errors, 429 and 5xx responses
+func (s *webhookSink) Send(ctx context.Context, entry HistoryEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil || !retry || attempt >= s.retries {
+			return err
+		}
+		log.Debugf("Retrying %s in %s: %v", s, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failure is worth
+// retrying
+func (s *webhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return false, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// execSink runs a command for every event. The event is written as JSON to
+// its standard input and described in HYPERDHCP_* environment variables, for
+// scripts that do not parse JSON.
+type execSink struct {
+	path string
+}
+
+// newExecSink returns a sink running the executable at path
+func newExecSink(path string) (*execSink, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec hook: %w", err)
+	}
+	if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+		return nil, fmt.Errorf("invalid exec hook: %s is not executable", path)
+	}
+	return &execSink{path: path}, nil
+}
+
+func (s *execSink) String() string {
+	return "exec hook " + s.path
+}
+
+// Send runs the command for an event, which fails if the command does not
+// exit successfully within eventTimeout
+func (s *execSink) Send(ctx context.Context, entry HistoryEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.path)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"HYPERDHCP_EVENT="+string(entry.Event),
+		"HYPERDHCP_CLIENT="+entry.Client,
+		"HYPERDHCP_IP="+entry.IP.String(),
+		"HYPERDHCP_HWADDR="+entry.HWAddr,
+		"HYPERDHCP_HOSTNAME="+entry.Hostname,
+		"HYPERDHCP_VMI="+entry.VMI,
+		"HYPERDHCP_TIME="+entry.Time.UTC().Format(time.RFC3339),
+		"HYPERDHCP_EXPIRES="+entry.Expires.UTC().Format(time.RFC3339),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
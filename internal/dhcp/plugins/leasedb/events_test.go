@@ -0,0 +1,146 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEntry is an event as sent to the sinks
+var testEntry = HistoryEntry{
+	Time:     time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC),
+	Event:    EventAllocate,
+	Client:   "02:00:00:00:00:01",
+	IP:       net.IPv4(10, 0, 0, 57),
+	HWAddr:   "02:00:00:00:00:01",
+	Hostname: "web-1",
+	VMI:      "web-1-vmi",
+	Expires:  time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC),
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantErr      bool
+		wantAttempts int64
+	}{
+		{name: "delivered", statuses: []int{http.StatusNoContent}, retries: 3, wantAttempts: 1},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, retries: 3, wantAttempts: 3},
+		{name: "retries exhausted", statuses: []int{http.StatusBadGateway}, retries: 2, wantErr: true, wantAttempts: 3},
+		{name: "refused", statuses: []int{http.StatusBadRequest}, retries: 3, wantErr: true, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				var entry HistoryEntry
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+				assert.Equal(t, testEntry, entry)
+				w.WriteHeader(tt.statuses[min(int(n), len(tt.statuses))-1])
+			}))
+			defer server.Close()
+
+			sink, err := newWebhookSink(server.URL+"/leases", tt.retries)
+			require.NoError(t, err)
+			sink.backoff = time.Millisecond
+			err = sink.Send(context.Background(), testEntry)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantAttempts, attempts.Load())
+		})
+	}
+
+	_, err := newWebhookSink("ftp://example.com/leases", 1)
+	assert.ErrorContains(t, err, "invalid webhook URL")
+}
+
+func TestExecSink(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "event")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\ncat > " + out + ".json\necho \"$HYPERDHCP_EVENT $HYPERDHCP_IP $HYPERDHCP_VMI $HYPERDHCP_EXPIRES\" > " + out + ".env\n"
+	require.NoError(t, os.WriteFile(hook, []byte(script), 0o755))
+	sink, err := newExecSink(hook)
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(context.Background(), testEntry))
+
+	body, err := os.ReadFile(out + ".json")
+	require.NoError(t, err)
+	var entry HistoryEntry
+	require.NoError(t, json.Unmarshal(body, &entry))
+	assert.Equal(t, testEntry, entry)
+	env, err := os.ReadFile(out + ".env")
+	require.NoError(t, err)
+	assert.Equal(t, "allocate 10.0.0.57 web-1-vmi 2026-03-03T10:00:00Z\n", string(env))
+
+	failing := filepath.Join(dir, "failing.sh")
+	require.NoError(t, os.WriteFile(failing, []byte("#!/bin/sh\necho no route to CMDB\nexit 1\n"), 0o755))
+	sink, err = newExecSink(failing)
+	require.NoError(t, err)
+	assert.ErrorContains(t, sink.Send(context.Background(), testEntry), "no route to CMDB")
+
+	_, err = newExecSink(filepath.Join(dir, "missing.sh"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plain"), nil, 0o644))
+	_, err = newExecSink(filepath.Join(dir, "plain"))
+	assert.ErrorContains(t, err, "not executable")
+}
+
+func TestHandler4Events(t *testing.T) {
+	received := make(chan HistoryEntry, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry HistoryEntry
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+		received <- entry
+	}))
+	defer server.Close()
+	sink, err := newWebhookSink(server.URL, 0)
+	require.NoError(t, err)
+
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.events = newEventBus(sink)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(ip),
+	)
+	require.NoError(t, err)
+	pl.Handler4(req, nil)
+
+	// Events are sent in order, without a lease history
+	for _, want := range []LeaseEvent{EventAllocate, EventRelease} {
+		select {
+		case entry := <-received:
+			assert.Equal(t, want, entry.Event)
+			assert.Equal(t, mac.String(), entry.Client)
+			assert.True(t, entry.IP.Equal(ip))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event received", want)
+		}
+	}
+}
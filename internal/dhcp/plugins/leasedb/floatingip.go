@@ -0,0 +1,70 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// floatingIP is an address of the server that only the leader of the lease
+// store replicas holds, so unicast renewals to the server identifier reach it
+// and not a replica standing by
+type floatingIP struct {
+	addr  *net.IPNet
+	iface string
+}
+
+func (f floatingIP) String() string {
+	return f.addr.String() + "%" + f.iface
+}
+
+// parseFloatingIP parses a floating address given as
+// <IP>[/<prefix>]%<interface>, an address without prefix being a /32
+func parseFloatingIP(value string) (floatingIP, error) {
+	addr, iface, ok := strings.Cut(value, "%")
+	if !ok || iface == "" {
+		return floatingIP{}, fmt.Errorf("invalid floating IP %q: want <IP>[/<prefix>]%%<interface>", value)
+	}
+	if !strings.Contains(addr, "/") {
+		addr += "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil || ip.To4() == nil {
+		return floatingIP{}, fmt.Errorf("invalid floating IP %q: not an IPv4 address", value)
+	}
+	ipnet.IP = ip.To4()
+	return floatingIP{addr: ipnet, iface: iface}, nil
+}
+
+// holdFloatingIPs adds the floating addresses to their interfaces when this
+// replica leads, and removes them when it stops. Failures are logged, a
+// replica holding no address still answers broadcasts.
+func (p *PluginState) holdFloatingIPs(hold bool) {
+	if hold == p.floatingHeld {
+		return
+	}
+	p.floatingHeld = hold
+	set := p.setFloatingIP
+	if set == nil {
+		set = setInterfaceAddress
+	}
+	for _, f := range p.floatingIPs {
+		if err := set(f, hold); err != nil {
+			if hold {
+				log.Errorf("Could not add floating IP %s: %v", f, err)
+			} else {
+				log.Errorf("Could not remove floating IP %s: %v", f, err)
+			}
+			continue
+		}
+		if hold {
+			log.Printf("Holding floating IP %s", f)
+		} else {
+			log.Printf("Released floating IP %s", f)
+		}
+	}
+}
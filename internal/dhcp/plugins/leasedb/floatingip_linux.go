@@ -0,0 +1,135 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build linux
+
+package leasedb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// setInterfaceAddress adds an address to an interface with netlink and
+// announces it, or removes it. Removing an address the interface does not
+// have succeeds.
+func setInterfaceAddress(f floatingIP, hold bool) error {
+	iface, err := net.InterfaceByName(f.iface)
+	if err != nil {
+		return err
+	}
+	if !hold {
+		err := addressRequest(syscall.RTM_DELADDR, 0, iface.Index, f.addr)
+		if errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil
+		}
+		return err
+	}
+	if err := addressRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, iface.Index, f.addr); err != nil {
+		return err
+	}
+	// The hosts of the network still send to the previous leader until told
+	return announceAddress(iface, f.addr.IP)
+}
+
+// addressRequest sends a request adding or removing an IPv4 address of an
+// interface to the kernel and waits for its acknowledgement
+func addressRequest(msgType uint16, flags int, index int, addr *net.IPNet) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("cannot open netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("cannot bind netlink socket: %w", err)
+	}
+
+	prefix, _ := addr.Mask.Size()
+	ip := addr.IP.To4()
+	attrLen := syscall.SizeofRtAttr + len(ip)
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofIfAddrmsg+2*attrLen)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], msgType)
+	binary.NativeEndian.PutUint16(msg[6:], uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags))
+	binary.NativeEndian.PutUint32(msg[8:], 1)
+	ifa := msg[syscall.NLMSG_HDRLEN:]
+	ifa[0] = syscall.AF_INET
+	ifa[1] = byte(prefix)
+	binary.NativeEndian.PutUint32(ifa[4:], uint32(index))
+	attrs := ifa[syscall.SizeofIfAddrmsg:]
+	for i, attrType := range []uint16{syscall.IFA_LOCAL, syscall.IFA_ADDRESS} {
+		attr := attrs[i*attrLen:]
+		binary.NativeEndian.PutUint16(attr[0:], uint16(attrLen))
+		binary.NativeEndian.PutUint16(attr[2:], attrType)
+		copy(attr[syscall.SizeofRtAttr:], ip)
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("cannot send netlink request: %w", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return fmt.Errorf("cannot receive netlink acknowledgement: %w", err)
+	}
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return fmt.Errorf("malformed netlink acknowledgement: %w", err)
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+			continue
+		}
+		if errno := int32(binary.NativeEndian.Uint32(reply.Data)); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+	}
+	return nil
+}
+
+// announceAddress broadcasts a gratuitous ARP for an address of an interface
+func announceAddress(iface *net.Interface, ip net.IP) error {
+	eth := layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   iface.HardwareAddr,
+		SourceProtAddress: ip.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+		return fmt.Errorf("cannot serialize gratuitous ARP: %w", err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	var hwAddr [8]byte
+	copy(hwAddr[:], layers.EthernetBroadcast)
+	if err := syscall.Sendto(fd, buf.Bytes(), 0, &syscall.SockaddrLinklayer{
+		Ifindex: iface.Index,
+		Halen:   6,
+		Addr:    hwAddr,
+	}); err != nil {
+		return fmt.Errorf("cannot send gratuitous ARP: %w", err)
+	}
+	return nil
+}
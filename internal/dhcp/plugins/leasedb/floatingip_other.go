@@ -0,0 +1,13 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build !linux
+
+package leasedb
+
+import "errors"
+
+func setInterfaceAddress(floatingIP, bool) error {
+	return errors.New("floating IPs are only supported on linux")
+}
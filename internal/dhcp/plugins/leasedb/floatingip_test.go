@@ -0,0 +1,38 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFloatingIP(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "10.0.0.1%net1", want: "10.0.0.1/32%net1"},
+		{value: "10.0.0.1/24%net1", want: "10.0.0.1/24%net1"},
+		{value: "10.0.0.1", wantErr: true},
+		{value: "10.0.0.1%", wantErr: true},
+		{value: "2001:db8::1%net1", wantErr: true},
+		{value: "router%net1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			floating, err := parseFloatingIP(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, floating.String())
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// MessageTypeForceRenew is the message type of DHCPFORCERENEW, RFC 3203,
+// which the dhcpv4 package does not define
+const MessageTypeForceRenew dhcpv4.MessageType = 9
+
+const (
+	// defaultForceRenewRate is how many DHCPFORCERENEW are sent per second
+	// unless configured otherwise with the forcerenew-rate argument
+	defaultForceRenewRate = 20
+	// optionForceRenewNonceCapable is the option clients list the nonce
+	// algorithms they support in, RFC 6704 section 3.4
+	optionForceRenewNonceCapable = dhcpv4.GenericOptionCode(145)
+	// nonceSize is the size of the nonces and HMAC-MD5 digests
+	nonceSize = md5.Size
+	// forceRenewDelay is how long after starting the server asks the bound
+	// clients to renew, so it is answering them by then
+	forceRenewDelay = 5 * time.Second
+)
+
+// The fields of the authentication option, RFC 3118 section 2, as used by
+// RFC 6704 section 3
+const (
+	authProtocolNonce  byte = 3
+	authAlgorithmHMAC  byte = 1
+	authRDMMonotonic   byte = 0
+	authInfoNonce      byte = 1
+	authInfoHMACDigest byte = 2
+)
+
+var (
+	// errForceRenewRunning is returned when clients are asked to renew while
+	// the previous ones are still being asked
+	errForceRenewRunning = errors.New("clients are being asked to renew already")
+	// errForceRenewStandby is returned when a replica on standby is asked to
+	// have clients renew, which the leader does
+	errForceRenewStandby = errors.New("another replica is the leader")
+)
+
+// forceRenewTarget is a bound client sent a DHCPFORCERENEW
+type forceRenewTarget struct {
+	client string
+	ip     net.IP
+	hwaddr net.HardwareAddr
+	nonce  []byte
+}
+
+// forceRenewer sends DHCPFORCERENEW to bound clients so they renew their
+// lease right away and pick up configuration changes, RFC 3203. Clients that
+// were given a nonce get messages authenticated with it, RFC 6704, the others
+// messages without authentication. Messages are sent at a fixed rate, one
+// round over the leases at a time.
+type forceRenewer struct {
+	// serverID is the server identifier the clients renew with
+	serverID net.IP
+	// rate is how many messages are sent per second
+	rate int
+	// nonce enables handing out nonces to the clients supporting them
+	nonce bool
+	// port is the port the clients listen on
+	port int
+	// running is set while a round is sent
+	running atomic.Bool
+	// replay is the last replay detection value sent, increasing
+	replay atomic.Uint64
+}
+
+// serverConn is the connection DHCPFORCERENEW are sent on, see SetServerConn
+var serverConn atomic.Pointer[net.UDPConn]
+
+// SetServerConn has DHCPFORCERENEW sent on conn, a connection the server
+// listens on, so they come from the server port like the other replies of
+// the server. Clients drop DHCPFORCERENEW from other ports.
+func SetServerConn(conn *net.UDPConn) {
+	serverConn.Store(conn)
+}
+
+// newForceRenewer returns a force renewer identifying the server with
+// serverID, sending rate messages per second
+func newForceRenewer(serverID net.IP, rate int, nonce bool) *forceRenewer {
+	return &forceRenewer{
+		serverID: serverID,
+		rate:     rate,
+		nonce:    nonce,
+		port:     dhcpv4.ClientPort,
+	}
+}
+
+// parseForceRenewNonce parses the forcerenew-nonce argument
+func parseForceRenewNonce(value string) (bool, error) {
+	nonce, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid forcerenew nonce: %v", value)
+	}
+	return nonce, nil
+}
+
+// decodeNonce decodes a stored nonce in hexadecimal, the empty string for
+// clients that were not given one
+func decodeNonce(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	nonce, err := hex.DecodeString(value)
+	if err != nil || len(nonce) != nonceSize {
+		return nil, fmt.Errorf("invalid forcerenew nonce: %q", value)
+	}
+	return nonce, nil
+}
+
+// nextReplay returns a replay detection value higher than all the ones sent
+// before, RFC 3118 monotonically increasing counter
+func (f *forceRenewer) nextReplay() uint64 {
+	for {
+		last := f.replay.Load()
+		next := max(last+1, uint64(time.Now().UnixNano()))
+		if f.replay.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// authOption returns an RFC 6704 authentication option carrying info
+func (f *forceRenewer) authOption(infoType byte, info []byte) dhcpv4.Option {
+	value := []byte{authProtocolNonce, authAlgorithmHMAC, authRDMMonotonic}
+	value = binary.BigEndian.AppendUint64(value, f.nextReplay())
+	value = append(value, infoType)
+	value = append(value, info...)
+	return dhcpv4.OptGeneric(dhcpv4.OptionAuthentication, value)
+}
+
+// giveNonce hands a new nonce to a client being acknowledged that supports
+// HMAC-MD5 nonces, adding it to the reply. It returns the nonce, or nil if
+// the client does not support them.
+func (f *forceRenewer) giveNonce(req, resp *dhcpv4.DHCPv4) []byte {
+	if f == nil || !f.nonce || resp.MessageType() != dhcpv4.MessageTypeAck {
+		return nil
+	}
+	if !slices.Contains(req.Options.Get(optionForceRenewNonceCapable), authAlgorithmHMAC) {
+		return nil
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Errorf("Could not generate a forcerenew nonce: %v", err)
+		return nil
+	}
+	resp.UpdateOption(f.authOption(authInfoNonce, nonce))
+	return nonce
+}
+
+// message returns the DHCPFORCERENEW sent to a client
+func (f *forceRenewer) message(target forceRenewTarget) (*dhcpv4.DHCPv4, error) {
+	msg, err := dhcpv4.New(
+		dhcpv4.WithMessageType(MessageTypeForceRenew),
+		dhcpv4.WithServerIP(f.serverID),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(f.serverID)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	msg.OpCode = dhcpv4.OpcodeBootReply
+	msg.ClientHWAddr = target.hwaddr
+	msg.ClientIPAddr = target.ip
+	if target.nonce == nil {
+		return msg, nil
+	}
+	// The digest is computed over the message with the digest zeroed
+	auth := f.authOption(authInfoHMACDigest, make([]byte, nonceSize))
+	msg.UpdateOption(auth)
+	mac := hmac.New(md5.New, target.nonce)
+	mac.Write(msg.ToBytes())
+	value := auth.Value.ToBytes()
+	copy(value[len(value)-nonceSize:], mac.Sum(nil))
+	msg.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionAuthentication, value))
+	return msg, nil
+}
+
+// send sends a DHCPFORCERENEW to a client
+func (f *forceRenewer) send(target forceRenewTarget) error {
+	conn := serverConn.Load()
+	if conn == nil {
+		return errors.New("the server is not listening")
+	}
+	msg, err := f.message(target)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(msg.ToBytes(), &net.UDPAddr{IP: target.ip, Port: f.port})
+	return err
+}
+
+// run sends a DHCPFORCERENEW to each target at the configured rate. It
+// returns errForceRenewRunning if a round is being sent already, otherwise it
+// sends in the background.
+func (f *forceRenewer) run(targets []forceRenewTarget) error {
+	if !f.running.CompareAndSwap(false, true) {
+		return errForceRenewRunning
+	}
+	go func() {
+		defer f.running.Store(false)
+		tick := time.NewTicker(time.Second / time.Duration(f.rate))
+		defer tick.Stop()
+		sent := 0
+		for i, target := range targets {
+			if i > 0 {
+				<-tick.C
+			}
+			if err := f.send(target); err != nil {
+				log.Warningf("Could not send DHCPFORCERENEW to client %s at %s: %v", target.client, target.ip, err)
+				continue
+			}
+			sent++
+		}
+		log.Printf("Asked %d of %d bound clients to renew their lease", sent, len(targets))
+	}()
+	return nil
+}
+
+// forceRenew asks the bound clients to renew their lease, all of them or
+// those selected by IP or MAC address if given. It returns how many clients
+// are asked, in the background. Replicas on standby leave it to the leader.
+func (p *PluginState) forceRenew(ip net.IP, mac string) (int, error) {
+	if p.forceRenewer == nil {
+		return 0, errors.New("forcerenew is not enabled")
+	}
+	p.Lock()
+	if p.standby {
+		p.Unlock()
+		return 0, errForceRenewStandby
+	}
+	now := time.Now()
+	var targets []forceRenewTarget
+	for client, record := range p.Recordsv4 {
+		if !record.active(now) || (ip != nil && !record.IP.Equal(ip)) || (mac != "" && client != mac && record.HWAddr != mac) {
+			continue
+		}
+		if _, stale := p.stale[client]; stale {
+			// The client is not to keep its lease
+			continue
+		}
+		hwaddr, err := net.ParseMAC(record.HWAddr)
+		if err != nil {
+			hwaddr, _ = net.ParseMAC(client)
+		}
+		targets = append(targets, forceRenewTarget{
+			client: client,
+			ip:     record.IP,
+			hwaddr: hwaddr,
+			nonce:  slices.Clone(record.nonce),
+		})
+	}
+	p.Unlock()
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	if err := p.forceRenewer.run(targets); err != nil {
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+// forceRenewLater calls forceRenewChanged after forceRenewDelay. The server
+// does when it starts or takes over as leader, since it may be running with
+// another configuration than the one the clients were given, e.g. once the
+// controller restarted it for a change of the Server.
+func (p *PluginState) forceRenewLater() {
+	if p.forceRenewer == nil || p.forceRenewConfig == "" {
+		return
+	}
+	time.AfterFunc(forceRenewDelay, p.forceRenewChanged)
+}
+
+// forceRenewChanged asks all the bound clients to renew if the configuration
+// forceRenewConfig is not the one they were last asked to renew for, which
+// the lease store keeps so restarts and other replicas do not ask them again.
+func (p *PluginState) forceRenewChanged() {
+	renewed, err := p.leasedb.ForceRenewedConfig()
+	if err != nil {
+		log.Warningf("Could not tell whether the bound clients renewed for this configuration: %v", err)
+		return
+	}
+	if renewed == p.forceRenewConfig {
+		return
+	}
+	n, err := p.forceRenew(nil, "")
+	if err != nil {
+		log.Warningf("Could not ask the bound clients to renew: %v", err)
+		return
+	}
+	log.Printf("Asking %d bound clients to renew their lease for configuration %s", n, p.forceRenewConfig)
+	if err := p.leasedb.RecordForceRenew(p.forceRenewConfig); err != nil {
+		log.Warningf("Could not record that the bound clients renewed for configuration %s: %v", p.forceRenewConfig, err)
+	}
+}
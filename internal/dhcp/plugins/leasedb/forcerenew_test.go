@@ -0,0 +1,292 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nonceLease leases an address to a client through the handler, the client
+// supporting forcerenew nonces, and returns the reply
+func nonceLease(t *testing.T, pl *PluginState, mac net.HardwareAddr) *dhcpv4.DHCPv4 {
+	t.Helper()
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(optionForceRenewNonceCapable, []byte{authAlgorithmHMAC})),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	require.NoError(t, err)
+	reply, stop := pl.Handler4(req, resp)
+	require.NotNil(t, reply)
+	require.False(t, stop)
+	return reply
+}
+
+// listenForceRenew has the force renewer of pl send from a local server
+// connection to a local port and returns the connection receiving the
+// messages. Records must be moved to 127.0.0.1 for their messages to arrive.
+func listenForceRenew(t *testing.T, pl *PluginState) net.PacketConn {
+	t.Helper()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	SetServerConn(server)
+	t.Cleanup(func() {
+		SetServerConn(nil)
+		server.Close()
+	})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	pl.forceRenewer.port = conn.LocalAddr().(*net.UDPAddr).Port
+	return conn
+}
+
+// receiveForceRenew reads the next message sent by the force renewer, which
+// must come from the server connection
+func receiveForceRenew(t *testing.T, conn net.PacketConn) *dhcpv4.DHCPv4 {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, serverConn.Load().LocalAddr().String(), from.String())
+	msg, err := dhcpv4.FromBytes(buf[:n])
+	require.NoError(t, err)
+	return msg
+}
+
+func TestForceRenew(t *testing.T) {
+	sid := net.IPv4(10, 0, 0, 254).To4()
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.forceRenewer = newForceRenewer(sid, 1000, true)
+	conn := listenForceRenew(t, pl)
+
+	withNonce := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	withoutNonce := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	reply := nonceLease(t, pl, withNonce)
+	lease(t, pl, withoutNonce)
+
+	// The client supporting nonces is given one in the DHCPACK
+	auth := reply.Options.Get(dhcpv4.OptionAuthentication)
+	require.Len(t, auth, 3+8+1+nonceSize)
+	assert.Equal(t, []byte{authProtocolNonce, authAlgorithmHMAC, authRDMMonotonic}, auth[:3])
+	assert.Equal(t, authInfoNonce, auth[11])
+	nonce := auth[12:]
+	assert.Equal(t, nonce, pl.Recordsv4[withNonce.String()].nonce)
+	assert.Nil(t, pl.Recordsv4[withoutNonce.String()].nonce)
+
+	// The nonce is stored with the lease, and replaced when the lease is
+	// extended, whether or not the lease is written again
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Equal(t, nonce, stored[withNonce.String()].nonce)
+	reply = nonceLease(t, pl, withNonce)
+	nonce = reply.Options.Get(dhcpv4.OptionAuthentication)[12:]
+	stored, err = pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Equal(t, nonce, stored[withNonce.String()].nonce)
+
+	for _, record := range pl.Recordsv4 {
+		record.IP = net.IPv4(127, 0, 0, 1).To4()
+	}
+
+	t.Run("by MAC address", func(t *testing.T) {
+		n, err := pl.forceRenew(nil, withoutNonce.String())
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		msg := receiveForceRenew(t, conn)
+		assert.Equal(t, MessageTypeForceRenew, msg.MessageType())
+		assert.Equal(t, dhcpv4.OpcodeBootReply, msg.OpCode)
+		assert.Equal(t, sid.String(), msg.ServerIdentifier().String())
+		assert.Equal(t, withoutNonce, msg.ClientHWAddr)
+		assert.Equal(t, "127.0.0.1", msg.ClientIPAddr.String())
+		assert.False(t, msg.Options.Has(dhcpv4.OptionAuthentication))
+	})
+
+	t.Run("authenticated with the nonce", func(t *testing.T) {
+		require.Eventually(t, func() bool { return !pl.forceRenewer.running.Load() }, 5*time.Second, 10*time.Millisecond)
+		n, err := pl.forceRenew(nil, withNonce.String())
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		msg := receiveForceRenew(t, conn)
+		assert.Equal(t, withNonce, msg.ClientHWAddr)
+		auth := msg.Options.Get(dhcpv4.OptionAuthentication)
+		require.Len(t, auth, 3+8+1+nonceSize)
+		assert.Equal(t, authInfoHMACDigest, auth[11])
+		digest := append([]byte(nil), auth[12:]...)
+		copy(auth[12:], make([]byte, nonceSize))
+		msg.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionAuthentication, auth))
+		mac := hmac.New(md5.New, nonce)
+		mac.Write(msg.ToBytes())
+		assert.Equal(t, mac.Sum(nil), digest)
+	})
+
+	t.Run("one round at a time", func(t *testing.T) {
+		require.Eventually(t, func() bool { return !pl.forceRenewer.running.Load() }, 5*time.Second, 10*time.Millisecond)
+		pl.forceRenewer.rate = 1
+		n, err := pl.forceRenew(nil, "")
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		_, err = pl.forceRenew(nil, "")
+		assert.ErrorIs(t, err, errForceRenewRunning)
+		receiveForceRenew(t, conn)
+		receiveForceRenew(t, conn)
+	})
+
+	t.Run("without a server connection", func(t *testing.T) {
+		require.Eventually(t, func() bool { return !pl.forceRenewer.running.Load() }, 5*time.Second, 10*time.Millisecond)
+		server := serverConn.Load()
+		SetServerConn(nil)
+		defer SetServerConn(server)
+		assert.Error(t, pl.forceRenewer.send(forceRenewTarget{ip: net.IPv4(127, 0, 0, 1).To4()}))
+	})
+
+	t.Run("on standby", func(t *testing.T) {
+		pl.standby = true
+		defer func() { pl.standby = false }()
+		_, err := pl.forceRenew(nil, "")
+		assert.ErrorIs(t, err, errForceRenewStandby)
+	})
+}
+
+func TestForceRenewChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.db")
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	// start runs the server with a configuration on the lease file of the
+	// previous runs, the client's lease being moved to 127.0.0.1
+	start := func(t *testing.T, config string) (*PluginState, net.PacketConn) {
+		t.Helper()
+		pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+		require.NoError(t, pl.leasedb.Close())
+		pl.leasedb = nil
+		require.NoError(t, pl.registerBackingDB(path))
+		t.Cleanup(func() { pl.leasedb.Close() })
+		require.NoError(t, pl.load())
+		pl.forceRenewer = newForceRenewer(net.IPv4(10, 0, 0, 254).To4(), 1000, false)
+		pl.forceRenewConfig = config
+		if _, ok := pl.Recordsv4[mac.String()]; !ok {
+			lease(t, pl, mac)
+		}
+		pl.Recordsv4[mac.String()].IP = net.IPv4(127, 0, 0, 1).To4()
+		return pl, listenForceRenew(t, pl)
+	}
+	// assertNothingSent checks no DHCPFORCERENEW arrives
+	assertNothingSent := func(t *testing.T, conn net.PacketConn) {
+		t.Helper()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		_, _, err := conn.ReadFrom(make([]byte, 1500))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	}
+	renewed := func(t *testing.T, pl *PluginState) string {
+		t.Helper()
+		config, err := pl.leasedb.ForceRenewedConfig()
+		require.NoError(t, err)
+		return config
+	}
+
+	pl, conn := start(t, "a")
+	pl.forceRenewChanged()
+	assert.Equal(t, mac, receiveForceRenew(t, conn).ClientHWAddr)
+	assertNothingSent(t, conn)
+	assert.Equal(t, "a", renewed(t, pl))
+	require.NoError(t, pl.leasedb.Close())
+
+	// Restarting with the same configuration asks nobody
+	pl, conn = start(t, "a")
+	pl.forceRenewChanged()
+	assertNothingSent(t, conn)
+	require.NoError(t, pl.leasedb.Close())
+
+	// A changed configuration asks the clients once
+	pl, conn = start(t, "b")
+	pl.forceRenewChanged()
+	assert.Equal(t, mac, receiveForceRenew(t, conn).ClientHWAddr)
+	pl.forceRenewChanged()
+	assertNothingSent(t, conn)
+	assert.Equal(t, "b", renewed(t, pl))
+
+	// A replica on standby asks nobody and leaves it to the leader
+	pl.forceRenewConfig = "c"
+	pl.standby = true
+	pl.forceRenewChanged()
+	assertNothingSent(t, conn)
+	assert.Equal(t, "b", renewed(t, pl))
+}
+
+func TestAdminForceRenew(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	server := httptest.NewServer(pl.adminHandler())
+	defer server.Close()
+	// Without a force renewer there is nothing to trigger
+	resp, err := http.Post(server.URL+"/forcerenew", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	pl.forceRenewer = newForceRenewer(net.IPv4(10, 0, 0, 254).To4(), 1000, false)
+	conn := listenForceRenew(t, pl)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	lease(t, pl, mac)
+	pl.Recordsv4[mac.String()].IP = net.IPv4(127, 0, 0, 1).To4()
+	server = httptest.NewServer(pl.adminHandler())
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantClients int
+	}{
+		{name: "all", query: "", wantStatus: http.StatusAccepted, wantClients: 1},
+		{name: "by MAC", query: "?mac=AA-BB-CC-DD-EE-01", wantStatus: http.StatusAccepted, wantClients: 1},
+		{name: "by IP", query: "?ip=127.0.0.1", wantStatus: http.StatusAccepted, wantClients: 1},
+		{name: "unknown IP", query: "?ip=10.0.0.9", wantStatus: http.StatusAccepted, wantClients: 0},
+		{name: "invalid MAC", query: "?mac=router", wantStatus: http.StatusBadRequest},
+		{name: "invalid IP", query: "?ip=router", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Eventually(t, func() bool { return !pl.forceRenewer.running.Load() }, 5*time.Second, 10*time.Millisecond)
+			resp, err := http.Post(server.URL+"/forcerenew"+tt.query, "", nil)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus != http.StatusAccepted {
+				return
+			}
+			var body map[string]int
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, tt.wantClients, body["clients"])
+			if tt.wantClients > 0 {
+				assert.Equal(t, mac, receiveForceRenew(t, conn).ClientHWAddr)
+			}
+		})
+	}
+
+	resp, err = http.Get(server.URL + "/forcerenew")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	pl.standby = true
+	resp, err = http.Post(server.URL+"/forcerenew", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
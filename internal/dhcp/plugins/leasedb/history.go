@@ -0,0 +1,268 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LeaseEvent is something that happened to a lease
+type LeaseEvent string
+
+const (
+	EventAllocate LeaseEvent = "allocate"
+	EventRenew    LeaseEvent = "renew"
+	EventRelease  LeaseEvent = "release"
+	EventExpire   LeaseEvent = "expire"
+	EventDecline  LeaseEvent = "decline"
+)
+
+var errNoHistory = errors.New("lease history is not kept")
+
+// HistoryEntry is an event in the history of the leases. The lease it
+// describes was held from Time until Expires: the end of the lease for
+// allocations and renewals, when the lease ended for the other events.
+type HistoryEntry struct {
+	Time     time.Time  `json:"time"`
+	Event    LeaseEvent `json:"event"`
+	Client   string     `json:"client"`
+	IP       net.IP     `json:"ip"`
+	HWAddr   string     `json:"hwaddr,omitempty"`
+	Hostname string     `json:"hostname,omitempty"`
+	VMI      string     `json:"vmi,omitempty"`
+	Expires  time.Time  `json:"expires"`
+}
+
+// HistoryQuery selects entries of the lease history. Zero fields select all
+// entries.
+type HistoryQuery struct {
+	// MAC is the hardware address of the client, also for clients known by
+	// their client identifier
+	MAC string
+	IP  net.IP
+	// Since and Until select the entries describing a lease held at some
+	// point in between
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries returned, the latest first
+	Limit int
+}
+
+// matches reports whether the query selects an entry, disregarding Limit
+func (q HistoryQuery) matches(entry HistoryEntry) bool {
+	switch {
+	case q.MAC != "" && entry.HWAddr != q.MAC:
+		return false
+	case q.IP != nil && !entry.IP.Equal(q.IP):
+		return false
+	case !q.Since.IsZero() && entry.Expires.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && entry.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// where returns the SQL condition selecting the entries of the history4 table
+// matching the query, and its arguments. placeholder returns the placeholder
+// of the nth argument, counting from 1.
+func (q HistoryQuery) where(placeholder func(n int) string) (string, []any) {
+	var (
+		conditions []string
+		args       []any
+	)
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+" "+placeholder(len(args)))
+	}
+	if q.MAC != "" {
+		add("hwaddr =", q.MAC)
+	}
+	if q.IP != nil {
+		add("ip =", q.IP.String())
+	}
+	if !q.Since.IsZero() {
+		add("expiry >=", q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		add("at <=", q.Until.UnixNano())
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// historyColumns are the columns of history4 making up an entry, in the
+// order of scanHistoryEntry and historyValues. Entries are timestamped in
+// nanoseconds, so the events of a client keep their order.
+const historyColumns = "at, event, mac, idtype, ip, hwaddr, hostname, vmi, expiry"
+
+// scanHistoryEntry reads the entry in a row of historyColumns
+func scanHistoryEntry(row interface{ Scan(dest ...any) error }) (HistoryEntry, error) {
+	var (
+		entry                 HistoryEntry
+		at, expiry            int64
+		event, id, idType, ip string
+	)
+	if err := row.Scan(&at, &event, &id, &idType, &ip, &entry.HWAddr, &entry.Hostname, &entry.VMI, &expiry); err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to scan row: %w", err)
+	}
+	client, err := joinClientKey(id, idType)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	entry.IP = net.ParseIP(ip)
+	if entry.IP.To4() == nil {
+		return HistoryEntry{}, fmt.Errorf("expected an IPv4 address, got: %v", ip)
+	}
+	entry.Time = time.Unix(0, at)
+	entry.Event = LeaseEvent(event)
+	entry.Client = client
+	entry.Expires = time.Unix(expiry, 0)
+	return entry, nil
+}
+
+// historyValues returns the values of historyColumns for an entry
+func historyValues(entry HistoryEntry) []any {
+	id, idType := splitClientKey(entry.Client)
+	return []any{
+		entry.Time.UnixNano(), string(entry.Event), id, idType, entry.IP.String(),
+		entry.HWAddr, entry.Hostname, entry.VMI, entry.Expires.Unix(),
+	}
+}
+
+// sortHistory orders entries the latest first and applies the limit of a query
+func sortHistory(entries []HistoryEntry, q HistoryQuery) []HistoryEntry {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries
+}
+
+// journal appends an event of the lease of a client to the history, if the
+// plugin keeps one, and publishes it to the event sinks. The lease ends with
+// the event unless it is an allocation or a renewal. Failures are logged, they
+// do not affect the lease.
+func (p *PluginState) journal(event LeaseEvent, client string, record *Record, now time.Time) {
+	if p.history == nil && p.events == nil {
+		return
+	}
+	entry := HistoryEntry{
+		Time:     now,
+		Event:    event,
+		Client:   client,
+		IP:       record.IP,
+		HWAddr:   record.HWAddr,
+		Hostname: record.Hostname,
+		VMI:      record.VMI,
+		Expires:  time.Unix(int64(record.expires), 0),
+	}
+	if event == EventRelease || event == EventDecline {
+		entry.Expires = now
+	}
+	p.events.publish(entry)
+	if p.history == nil {
+		return
+	}
+	if err := p.write(storeOp{kind: opAppendHistory, client: client, entry: entry}); err != nil {
+		log.Errorf("Could not record %s of IP %s for client %s in the lease history: %v", event, record.IP, client, err)
+	}
+}
+
+// History returns the entries of the lease history selected by a query
+func (p *PluginState) History(q HistoryQuery) ([]HistoryEntry, error) {
+	if p.history == nil {
+		return nil, errNoHistory
+	}
+	p.flushWrites()
+	return p.history.History(q)
+}
+
+// pruneHistory drops the entries of the history describing leases that ended
+// more than HistoryRetention before now
+func (p *PluginState) pruneHistory(now time.Time) {
+	if p.history == nil {
+		return
+	}
+	if err := p.history.PruneHistory(now.Add(-p.HistoryRetention)); err != nil {
+		log.Errorf("Could not prune the lease history: %v", err)
+	}
+}
+
+// serveHistory answers GET requests for the lease history, selected by the
+// mac, ip, since and until (RFC 3339) and limit query parameters, with the
+// entries as a JSON array
+func (p *PluginState) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := p.History(q)
+	if err != nil {
+		log.Errorf("Could not query the lease history: %v", err)
+		http.Error(w, "could not query the lease history", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Warningf("Could not send the lease history: %v", err)
+	}
+}
+
+// parseHistoryQuery returns the history query of the parameters of a request
+func parseHistoryQuery(r *http.Request) (HistoryQuery, error) {
+	var (
+		q      HistoryQuery
+		err    error
+		params = r.URL.Query()
+	)
+	if mac := params.Get("mac"); mac != "" {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return q, fmt.Errorf("invalid mac: %v", mac)
+		}
+		q.MAC = hwaddr.String()
+	}
+	if ip := params.Get("ip"); ip != "" {
+		q.IP = net.ParseIP(ip)
+		if q.IP.To4() == nil {
+			return q, fmt.Errorf("invalid ip: %v", ip)
+		}
+	}
+	if since := params.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return q, fmt.Errorf("invalid since: %v", since)
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return q, fmt.Errorf("invalid until: %v", until)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %v", limit)
+		}
+	}
+	return q, nil
+}
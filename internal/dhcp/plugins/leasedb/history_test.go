@@ -0,0 +1,205 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseHistories(t *testing.T) {
+	for name, open := range testLeaseStores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			history, ok := store.(LeaseHistory)
+			if !ok {
+				t.Skipf("%s lease store keeps no history", name)
+			}
+			testLeaseHistory(t, history)
+		})
+	}
+}
+
+// testLeaseHistory checks the behavior every LeaseHistory must have
+func testLeaseHistory(t *testing.T, history LeaseHistory) {
+	start := time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC)
+	ip1, ip2 := net.IPv4(10, 0, 0, 57).To4(), net.IPv4(10, 0, 0, 58).To4()
+	entries := []HistoryEntry{
+		{Time: start, Event: EventAllocate, Client: "02:00:00:00:00:01", IP: ip1, HWAddr: "02:00:00:00:00:01", Hostname: "web-1", Expires: start.Add(time.Hour)},
+		{Time: start.Add(30 * time.Minute), Event: EventRenew, Client: "02:00:00:00:00:01", IP: ip1, HWAddr: "02:00:00:00:00:01", Hostname: "web-1", Expires: start.Add(90 * time.Minute)},
+		// Events of the same second keep their order
+		{Time: start.Add(time.Hour + time.Millisecond), Event: EventRelease, Client: "02:00:00:00:00:01", IP: ip1, HWAddr: "02:00:00:00:00:01", Hostname: "web-1", Expires: start.Add(time.Hour)},
+		{Time: start.Add(time.Hour + 2*time.Millisecond), Event: EventAllocate, Client: "id:01:02:00:00:00:00:02", IP: ip1, HWAddr: "02:00:00:00:00:02", VMI: "vm-2", Expires: start.Add(2 * time.Hour)},
+		{Time: start.Add(3 * time.Hour), Event: EventExpire, Client: "id:01:02:00:00:00:00:02", IP: ip1, HWAddr: "02:00:00:00:00:02", VMI: "vm-2", Expires: start.Add(2 * time.Hour)},
+		{Time: start.Add(4 * time.Hour), Event: EventDecline, Client: "02:00:00:00:00:01", IP: ip2, HWAddr: "02:00:00:00:00:01", Expires: start.Add(4 * time.Hour)},
+	}
+	for _, entry := range entries {
+		require.NoError(t, history.AppendHistory(entry))
+	}
+	// normalize makes entries comparable independently of how stores
+	// represent times
+	normalize := func(entries []HistoryEntry) []HistoryEntry {
+		for i := range entries {
+			entries[i].Time = entries[i].Time.UTC()
+			entries[i].Expires = entries[i].Expires.UTC()
+			entries[i].IP = entries[i].IP.To4()
+		}
+		return entries
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []int
+	}{
+		{name: "all", query: HistoryQuery{}, want: []int{5, 4, 3, 2, 1, 0}},
+		{name: "by MAC", query: HistoryQuery{MAC: "02:00:00:00:00:02"}, want: []int{4, 3}},
+		{name: "by IP", query: HistoryQuery{IP: net.IPv4(10, 0, 0, 58)}, want: []int{5}},
+		{
+			name:  "who had the address at a time",
+			query: HistoryQuery{IP: ip1, Since: start.Add(100 * time.Minute), Until: start.Add(100 * time.Minute)},
+			want:  []int{3},
+		},
+		{
+			name:  "window",
+			query: HistoryQuery{Since: start.Add(90 * time.Minute), Until: start.Add(3 * time.Hour)},
+			want:  []int{4, 3, 1},
+		},
+		{name: "limit", query: HistoryQuery{IP: ip1, Limit: 2}, want: []int{4, 3}},
+		{name: "nothing", query: HistoryQuery{MAC: "02:00:00:00:00:03"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := history.History(tt.query)
+			require.NoError(t, err)
+			var want []HistoryEntry
+			for _, i := range tt.want {
+				want = append(want, entries[i])
+			}
+			assert.Equal(t, normalize(want), normalize(got))
+		})
+	}
+
+	// Pruning drops the entries of leases that ended before
+	require.NoError(t, history.PruneHistory(start.Add(2*time.Hour)))
+	got, err := history.History(HistoryQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, normalize([]HistoryEntry{entries[5], entries[4], entries[3]}), normalize(got))
+}
+
+func TestHandler4History(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.history = pl.leasedb.(LeaseHistory)
+	pl.HistoryRetention = 24 * time.Hour
+	first := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	second := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+
+	events := func(q HistoryQuery) []LeaseEvent {
+		t.Helper()
+		entries, err := pl.History(q)
+		require.NoError(t, err)
+		var events []LeaseEvent
+		for _, entry := range entries {
+			events = append(events, entry.Event)
+		}
+		return events
+	}
+
+	ip := lease(t, pl, first)
+	lease(t, pl, first)
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(first),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(ip),
+	)
+	require.NoError(t, err)
+	pl.Handler4(req, nil)
+
+	declined := lease(t, pl, second)
+	req, err = dhcpv4.New(
+		dhcpv4.WithHwAddr(second),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(declined)),
+	)
+	require.NoError(t, err)
+	pl.Handler4(req, nil)
+
+	expired := lease(t, pl, second)
+	pl.sweep(time.Now().Add(2 * time.Hour))
+
+	assert.Equal(t, []LeaseEvent{EventRelease, EventRenew, EventAllocate}, events(HistoryQuery{MAC: first.String()}))
+	assert.Equal(t, []LeaseEvent{EventExpire, EventAllocate, EventDecline, EventAllocate}, events(HistoryQuery{MAC: second.String()}))
+	entries, err := pl.History(HistoryQuery{IP: expired, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, EventExpire, entries[0].Event)
+	assert.Equal(t, second.String(), entries[0].Client)
+
+	// The sweeper prunes the history once the retention is over
+	pl.sweep(time.Now().Add(48 * time.Hour))
+	assert.Empty(t, events(HistoryQuery{}))
+}
+
+func TestAdminHistory(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.history = pl.leasedb.(LeaseHistory)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+	lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02})
+	server := httptest.NewServer(pl.adminHandler())
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantLen    int
+	}{
+		{name: "all", query: "", wantStatus: http.StatusOK, wantLen: 2},
+		{name: "by MAC", query: "?mac=AA-BB-CC-DD-EE-01", wantStatus: http.StatusOK, wantLen: 1},
+		{name: "by IP", query: "?ip=" + ip.String(), wantStatus: http.StatusOK, wantLen: 1},
+		{name: "before the leases", query: "?until=2020-01-01T00:00:00Z", wantStatus: http.StatusOK, wantLen: 0},
+		{name: "limit", query: "?since=2020-01-01T00:00:00Z&limit=1", wantStatus: http.StatusOK, wantLen: 1},
+		{name: "invalid MAC", query: "?mac=router", wantStatus: http.StatusBadRequest},
+		{name: "invalid time", query: "?since=yesterday", wantStatus: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/history" + tt.query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var entries []HistoryEntry
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+			assert.Len(t, entries, tt.wantLen)
+		})
+	}
+
+	resp, err := http.Post(server.URL+"/history", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// Without a history there is nothing to query
+	pl.history = nil
+	server = httptest.NewServer(pl.adminHandler())
+	defer server.Close()
+	resp, err = http.Get(server.URL + "/history")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Leases are held by a client identity, following RFC 2131 section 4.2 and
+// RFC 6842: the client identifier option when the client sends one, its
+// hardware address otherwise. Recordsv4 and the lease stores key leases by the
+// hardware address, or by the client identifier prefixed with clientIDPrefix.
+const clientIDPrefix = "id:"
+
+// Identity types stored with the leases
+const (
+	identityHWAddr   = "hwaddr"
+	identityClientID = "client-id"
+)
+
+// clientKey returns the key of the lease of the client sending req
+func clientKey(req *dhcpv4.DHCPv4) string {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		return clientIDPrefix + net.HardwareAddr(id).String()
+	}
+	return req.ClientHWAddr.String()
+}
+
+// splitClientKey returns the identity of a lease key and its type, as stored
+func splitClientKey(key string) (id, idType string) {
+	if id, ok := strings.CutPrefix(key, clientIDPrefix); ok {
+		return id, identityClientID
+	}
+	return key, identityHWAddr
+}
+
+// joinClientKey returns the lease key of a stored identity
+func joinClientKey(id, idType string) (string, error) {
+	switch idType {
+	case identityHWAddr, "":
+		hwaddr, err := net.ParseMAC(id)
+		if err != nil {
+			return "", fmt.Errorf("malformed hardware address: %s", id)
+		}
+		return hwaddr.String(), nil
+	case identityClientID:
+		raw, err := hex.DecodeString(strings.ReplaceAll(id, ":", ""))
+		if err != nil || len(raw) == 0 {
+			return "", fmt.Errorf("malformed client identifier: %s", id)
+		}
+		return clientIDPrefix + net.HardwareAddr(raw).String(), nil
+	}
+	return "", fmt.Errorf("unknown client identity type: %s", idType)
+}
+
+// echoClientID copies the client identifier option of req to a reply, RFC 6842
+// requires servers to return it
+func echoClientID(req, reply *dhcpv4.DHCPv4) {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); id != nil {
+		reply.UpdateOption(dhcpv4.OptClientIdentifier(id))
+	}
+}
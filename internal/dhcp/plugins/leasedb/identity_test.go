@@ -0,0 +1,139 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientKey(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	tests := []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		want      string
+		wantID    string
+		wantType  string
+	}{
+		{
+			name:     "hardware address",
+			want:     "aa:bb:cc:dd:ee:01",
+			wantID:   "aa:bb:cc:dd:ee:01",
+			wantType: identityHWAddr,
+		},
+		{
+			name:      "client identifier",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{0xff, 0x00, 0x00, 0x00, 0x01, 0x00, 0x04}))},
+			want:      "id:ff:00:00:00:01:00:04",
+			wantID:    "ff:00:00:00:01:00:04",
+			wantType:  identityClientID,
+		},
+		{
+			name:      "empty client identifier",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientIdentifier(nil))},
+			want:      "aa:bb:cc:dd:ee:01",
+			wantID:    "aa:bb:cc:dd:ee:01",
+			wantType:  identityHWAddr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := dhcpv4.NewDiscovery(mac, tt.modifiers...)
+			require.NoError(t, err)
+			key := clientKey(req)
+			assert.Equal(t, tt.want, key)
+			id, idType := splitClientKey(key)
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantType, idType)
+			joined, err := joinClientKey(id, idType)
+			require.NoError(t, err)
+			assert.Equal(t, key, joined)
+		})
+	}
+}
+
+func TestJoinClientKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		idType  string
+		want    string
+		wantErr bool
+	}{
+		{name: "hardware address", id: "AA-BB-CC-DD-EE-01", idType: identityHWAddr, want: "aa:bb:cc:dd:ee:01"},
+		{name: "no identity type", id: "aa:bb:cc:dd:ee:01", want: "aa:bb:cc:dd:ee:01"},
+		{name: "client identifier", id: "01:AA:BB:CC:DD:EE:01", idType: identityClientID, want: "id:01:aa:bb:cc:dd:ee:01"},
+		{name: "malformed hardware address", id: "printer", idType: identityHWAddr, wantErr: true},
+		{name: "malformed client identifier", id: "0x01", idType: identityClientID, wantErr: true},
+		{name: "empty client identifier", id: "", idType: identityClientID, wantErr: true},
+		{name: "unknown identity type", id: "aa:bb:cc:dd:ee:01", idType: "duid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := joinClientKey(tt.id, tt.idType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHandler4ClientID(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	clientID := dhcpv4.OptClientIdentifier([]byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01})
+	serverID := net.IPv4(10, 0, 0, 254)
+
+	exchange := func(mac net.HardwareAddr, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		t.Helper()
+		req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithOption(clientID),
+		}, modifiers...)...)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req,
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+		)
+		require.NoError(t, err)
+		result, _ := pl.Handler4(req, resp)
+		require.NotNil(t, result)
+		return result
+	}
+
+	// The lease follows the client identifier when the hardware address changes
+	ack := exchange(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01})
+	assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+	assert.Equal(t, clientID.Value.ToBytes(), ack.Options.Get(dhcpv4.OptionClientIdentifier))
+	assert.Contains(t, pl.Recordsv4, "id:01:02:00:00:00:00:01")
+	assert.NotContains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:01")
+	ack = exchange(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ack.YourIPAddr)))
+	assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+	assert.Equal(t, "10.0.0.1", ack.YourIPAddr.String())
+	assert.Len(t, pl.Recordsv4, 1)
+
+	// A client without a client identifier is another client
+	other := lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01})
+	assert.Equal(t, "10.0.0.2", other.String())
+
+	// The client identifier is echoed in NAKs too
+	nak := exchange(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other)))
+	assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assert.Equal(t, clientID.Value.ToBytes(), nak.Options.Get(dhcpv4.OptionClientIdentifier))
+
+	// The lease is found again after a restart
+	require.NoError(t, pl.load())
+	assert.Equal(t, "10.0.0.1", pl.Recordsv4["id:01:02:00:00:00:00:01"].IP.String())
+}
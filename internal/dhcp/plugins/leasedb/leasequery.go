@@ -0,0 +1,163 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// The message types of DHCP leasequery, RFC 4388 section 6.1, which the
+// dhcpv4 package does not define
+const (
+	MessageTypeLeaseQuery      dhcpv4.MessageType = 10
+	MessageTypeLeaseUnassigned dhcpv4.MessageType = 11
+	MessageTypeLeaseUnknown    dhcpv4.MessageType = 12
+	MessageTypeLeaseActive     dhcpv4.MessageType = 13
+)
+
+// leasequery answers a DHCPLEASEQUERY from a relay or another tool asking who
+// holds an address, following RFC 4388. A query is by IP address in ciaddr,
+// by client identifier in option 61 or by MAC address in chaddr, in that
+// order. A client with an active lease is described in a DHCPLEASEACTIVE, an
+// address of the pools or reservations that is not leased gets a
+// DHCPLEASEUNASSIGNED, anything else a DHCPLEASEUNKNOWN. Queries without a
+// giaddr to reply to are dropped. The caller must hold the plugin lock.
+func (p *PluginState) leasequery(req, resp *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	if req.GatewayIPAddr.IsUnspecified() {
+		log.Printf("Dropping lease query without giaddr from %s", req.ClientHWAddr)
+		return nil
+	}
+	now := time.Now()
+	var clients []string
+	switch {
+	case !req.ClientIPAddr.IsUnspecified():
+		client := p.leaseholder(req.ClientIPAddr)
+		if client == "" || !p.Recordsv4[client].active(now) {
+			if p.inRange(req.ClientIPAddr) || p.reservedFor(req.ClientIPAddr) != "" {
+				reply := leasequeryReply(req, resp.ServerIdentifier(), MessageTypeLeaseUnassigned)
+				if reply != nil {
+					reply.ClientIPAddr = req.ClientIPAddr
+				}
+				return reply
+			}
+			return leasequeryReply(req, resp.ServerIdentifier(), MessageTypeLeaseUnknown)
+		}
+		clients = []string{client}
+	case len(req.Options.Get(dhcpv4.OptionClientIdentifier)) > 0:
+		if record, ok := p.Recordsv4[clientKey(req)]; ok && record.active(now) {
+			clients = []string{clientKey(req)}
+		}
+	case len(req.ClientHWAddr) > 0 && !isZero(req.ClientHWAddr):
+		mac := req.ClientHWAddr.String()
+		for client, record := range p.Recordsv4 {
+			if (client == mac || record.HWAddr == mac) && record.active(now) {
+				clients = append(clients, client)
+			}
+		}
+	default:
+		log.Printf("Dropping lease query without an IP address, client identifier or MAC address")
+		return nil
+	}
+	if len(clients) == 0 {
+		return leasequeryReply(req, resp.ServerIdentifier(), MessageTypeLeaseUnknown)
+	}
+	// A client may hold several leases by MAC address, the one seen last is
+	// described and all their addresses are listed
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := p.Recordsv4[clients[i]], p.Recordsv4[clients[j]]
+		if a.lastSeen != b.lastSeen {
+			return a.lastSeen > b.lastSeen
+		}
+		return clients[i] < clients[j]
+	})
+	reply := leasequeryReply(req, resp.ServerIdentifier(), MessageTypeLeaseActive)
+	if reply == nil {
+		return nil
+	}
+	p.describeLease(req, reply, clients[0], p.Recordsv4[clients[0]], now)
+	if len(clients) > 1 {
+		ips := make(dhcpv4.IPs, 0, len(clients))
+		for _, client := range clients {
+			ips = append(ips, p.Recordsv4[client].IP)
+		}
+		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionAssociatedIP, Value: ips})
+	}
+	return reply
+}
+
+// describeLease fills in a DHCPLEASEACTIVE with the lease of a client: its
+// address, hardware address and client identifier, the time remaining until
+// the lease, T1 and T2 expire, when the client was last seen and its host
+// name if asked for
+func (p *PluginState) describeLease(req, reply *dhcpv4.DHCPv4, client string, record *Record, now time.Time) {
+	reply.ClientIPAddr = record.IP
+	if hwaddr, err := net.ParseMAC(record.HWAddr); err == nil {
+		reply.ClientHWAddr = hwaddr
+	} else if hwaddr, err := net.ParseMAC(client); err == nil {
+		reply.ClientHWAddr = hwaddr
+	}
+	if id, ok := strings.CutPrefix(client, clientIDPrefix); ok {
+		if raw, err := hex.DecodeString(strings.ReplaceAll(id, ":", "")); err == nil {
+			reply.UpdateOption(dhcpv4.OptClientIdentifier(raw))
+		}
+	} else {
+		reply.Options.Del(dhcpv4.OptionClientIdentifier)
+	}
+	expires := time.Unix(int64(record.expires), 0)
+	reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(expires.Sub(now).Round(time.Second)))
+	if record.lastSeen > 0 {
+		// The lease was last extended when the client was last seen
+		seen := time.Unix(int64(record.lastSeen), 0)
+		leaseTime := expires.Sub(seen)
+		remaining := func(ratio float64) dhcpv4.Duration {
+			return dhcpv4.Duration(max(seen.Add(time.Duration(float64(leaseTime)*ratio)).Sub(now), 0).Round(time.Second))
+		}
+		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRenewTimeValue, Value: remaining(p.RenewalRatio)})
+		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue, Value: remaining(p.RebindingRatio)})
+		reply.UpdateOption(dhcpv4.Option{
+			Code:  dhcpv4.OptionClientLastTransactionTime,
+			Value: dhcpv4.Duration(max(now.Sub(seen), 0).Round(time.Second)),
+		})
+	}
+	if record.Hostname != "" && req.IsOptionRequested(dhcpv4.OptionHostName) {
+		reply.UpdateOption(dhcpv4.OptHostName(record.Hostname))
+	}
+}
+
+// leasequeryReply returns a reply of type msgType to a leasequery, identified
+// by the server identifier sid if known
+func leasequeryReply(req *dhcpv4.DHCPv4, sid net.IP, msgType dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	reply, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(msgType))
+	if err != nil {
+		log.Errorf("Could not build %s: %v", msgType, err)
+		return nil
+	}
+	if sid != nil {
+		reply.UpdateOption(dhcpv4.OptServerIdentifier(sid))
+	}
+	return reply
+}
+
+// active reports whether a lease has not expired
+func (r *Record) active(now time.Time) bool {
+	return int64(r.expires) > now.Unix()
+}
+
+// isZero reports whether a hardware address is all zeroes, as sent by
+// queries not asking about a hardware address
+func isZero(hwaddr net.HardwareAddr) bool {
+	for _, b := range hwaddr {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
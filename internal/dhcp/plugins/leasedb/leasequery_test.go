@@ -0,0 +1,179 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4LeaseQuery(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.reservations = map[string]reservation{"aa:bb:cc:dd:ee:09": {IP: net.IPv4(10, 0, 1, 1).To4()}}
+	relay := net.IPv4(10, 0, 0, 254)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+	pl.Recordsv4[mac.String()].Hostname = "web-1"
+
+	// Two clients known by their client identifier on the same interface
+	shared := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	var idIPs []net.IP
+	for _, id := range [][]byte{{0x01, 0x02}, {0x01, 0x03}} {
+		req, err := dhcpv4.New(dhcpv4.WithHwAddr(shared), dhcpv4.WithOption(dhcpv4.OptClientIdentifier(id)))
+		require.NoError(t, err)
+		resp, err := dhcpv4.New()
+		require.NoError(t, err)
+		reply, _ := pl.Handler4(req, resp)
+		require.NotNil(t, reply)
+		idIPs = append(idIPs, reply.YourIPAddr)
+	}
+	pl.Recordsv4[clientIDPrefix+"01:03"].lastSeen--
+
+	expired := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	expiredIP := lease(t, pl, expired)
+	pl.Recordsv4[expired.String()].expires = int(time.Now().Unix())
+
+	tests := []struct {
+		name       string
+		modifiers  []dhcpv4.Modifier
+		noGateway  bool
+		wantNil    bool
+		wantType   dhcpv4.MessageType
+		wantIP     net.IP
+		wantHWAddr net.HardwareAddr
+		wantID     []byte
+		wantHost   string
+		wantAssoc  int
+	}{
+		{
+			name:       "active lease by IP",
+			modifiers:  []dhcpv4.Modifier{dhcpv4.WithClientIP(ip), dhcpv4.WithRequestedOptions(dhcpv4.OptionHostName)},
+			wantType:   MessageTypeLeaseActive,
+			wantIP:     ip,
+			wantHWAddr: mac,
+			wantHost:   "web-1",
+		},
+		{
+			name:      "free address of the pools",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 9))},
+			wantType:  MessageTypeLeaseUnassigned,
+			wantIP:    net.IPv4(10, 0, 0, 9),
+		},
+		{
+			name:      "reserved address",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(10, 0, 1, 1))},
+			wantType:  MessageTypeLeaseUnassigned,
+			wantIP:    net.IPv4(10, 0, 1, 1),
+		},
+		{
+			name:      "expired lease",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithClientIP(expiredIP)},
+			wantType:  MessageTypeLeaseUnassigned,
+			wantIP:    expiredIP,
+		},
+		{
+			name:      "address of another network",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 168, 0, 1))},
+			wantType:  MessageTypeLeaseUnknown,
+		},
+		{
+			name:       "active lease by MAC address",
+			modifiers:  []dhcpv4.Modifier{dhcpv4.WithHwAddr(mac), dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask)},
+			wantType:   MessageTypeLeaseActive,
+			wantIP:     ip,
+			wantHWAddr: mac,
+		},
+		{
+			name:      "expired lease by MAC address",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithHwAddr(expired)},
+			wantType:  MessageTypeLeaseUnknown,
+		},
+		{
+			name:       "active lease by client identifier",
+			modifiers:  []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{0x01, 0x03}))},
+			wantType:   MessageTypeLeaseActive,
+			wantIP:     idIPs[1],
+			wantHWAddr: shared,
+			wantID:     []byte{0x01, 0x03},
+		},
+		{
+			name:      "unknown client identifier",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{0x01, 0x04}))},
+			wantType:  MessageTypeLeaseUnknown,
+		},
+		{
+			name:       "MAC address with several leases",
+			modifiers:  []dhcpv4.Modifier{dhcpv4.WithHwAddr(shared)},
+			wantType:   MessageTypeLeaseActive,
+			wantIP:     idIPs[0],
+			wantHWAddr: shared,
+			wantID:     []byte{0x01, 0x02},
+			wantAssoc:  2,
+		},
+		{
+			name:      "no giaddr",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithClientIP(ip)},
+			noGateway: true,
+			wantNil:   true,
+		},
+		{
+			name:    "nothing asked",
+			wantNil: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modifiers := append([]dhcpv4.Modifier{dhcpv4.WithMessageType(MessageTypeLeaseQuery)}, tt.modifiers...)
+			if !tt.noGateway {
+				modifiers = append(modifiers, dhcpv4.WithGatewayIP(relay))
+			}
+			req, err := dhcpv4.New(modifiers...)
+			require.NoError(t, err)
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithServerIP(net.IPv4(10, 0, 0, 253)),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 253))))
+			require.NoError(t, err)
+
+			reply, stop := pl.Handler4(req, resp)
+			assert.True(t, stop)
+			if tt.wantNil {
+				assert.Nil(t, reply)
+				return
+			}
+			require.NotNil(t, reply)
+			assert.Equal(t, tt.wantType, reply.MessageType())
+			assert.Equal(t, req.TransactionID, reply.TransactionID)
+			assert.True(t, reply.GatewayIPAddr.Equal(relay))
+			assert.True(t, reply.ServerIdentifier().Equal(net.IPv4(10, 0, 0, 253)))
+			if tt.wantIP != nil {
+				assert.Equal(t, tt.wantIP.String(), reply.ClientIPAddr.String())
+			}
+			if tt.wantType != MessageTypeLeaseActive {
+				assert.False(t, reply.Options.Has(dhcpv4.OptionIPAddressLeaseTime))
+				return
+			}
+			assert.Equal(t, tt.wantHWAddr, reply.ClientHWAddr)
+			assert.Equal(t, tt.wantID, reply.Options.Get(dhcpv4.OptionClientIdentifier))
+			assert.Equal(t, tt.wantHost, reply.HostName())
+			leaseTime := reply.IPAddressLeaseTime(0)
+			assert.Greater(t, leaseTime, time.Duration(0))
+			assert.LessOrEqual(t, leaseTime, pl.LeaseTime)
+			assert.LessOrEqual(t, reply.IPAddressRenewalTime(0), leaseTime)
+			assert.LessOrEqual(t, reply.IPAddressRebindingTime(0), leaseTime)
+			assert.True(t, reply.Options.Has(dhcpv4.OptionClientLastTransactionTime))
+			if tt.wantAssoc > 0 {
+				var assoc dhcpv4.IPs
+				require.NoError(t, assoc.FromBytes(reply.Options.Get(dhcpv4.OptionAssociatedIP)))
+				assert.Len(t, assoc, tt.wantAssoc)
+			} else {
+				assert.False(t, reply.Options.Has(dhcpv4.OptionAssociatedIP))
+			}
+		})
+	}
+}
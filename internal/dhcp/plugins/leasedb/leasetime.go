@@ -0,0 +1,52 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// defaultRenewalRatio is when clients start renewing their lease (T1) as a
+	// fraction of the lease time unless configured otherwise with the t1
+	// argument, RFC 2131 section 4.4.5
+	defaultRenewalRatio = 0.5
+	// defaultRebindingRatio is when clients start rebinding their lease (T2) as
+	// a fraction of the lease time unless configured otherwise with the t2
+	// argument
+	defaultRebindingRatio = 0.875
+)
+
+// leaseTime returns how long the client sending req is given its address. The
+// lease time of the client's reservation applies as is, the lease time the
+// client asks for is granted within MinLeaseTime and MaxLeaseTime, LeaseTime
+// applies otherwise.
+func (p *PluginState) leaseTime(req *dhcpv4.DHCPv4) time.Duration {
+	if reserved, ok := p.reservations[req.ClientHWAddr.String()]; ok && reserved.LeaseTime > 0 {
+		return reserved.LeaseTime
+	}
+	requested := req.IPAddressLeaseTime(0)
+	if requested <= 0 {
+		return p.LeaseTime
+	}
+	return min(max(requested, p.MinLeaseTime), p.MaxLeaseTime)
+}
+
+// setLeaseTime sets the lease time of a reply, along with the renewal (T1)
+// and rebinding (T2) times derived from it
+func (p *PluginState) setLeaseTime(resp *dhcpv4.DHCPv4, d time.Duration) {
+	d = d.Round(time.Second)
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(d))
+	resp.UpdateOption(dhcpv4.Option{
+		Code:  dhcpv4.OptionRenewTimeValue,
+		Value: dhcpv4.Duration(time.Duration(float64(d) * p.RenewalRatio).Round(time.Second)),
+	})
+	resp.UpdateOption(dhcpv4.Option{
+		Code:  dhcpv4.OptionRebindingTimeValue,
+		Value: dhcpv4.Duration(time.Duration(float64(d) * p.RebindingRatio).Round(time.Second)),
+	})
+}
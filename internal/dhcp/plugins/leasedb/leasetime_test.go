@@ -0,0 +1,104 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseTime(t *testing.T) {
+	reserved := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	other := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	tests := []struct {
+		name      string
+		mac       net.HardwareAddr
+		requested time.Duration
+		want      time.Duration
+	}{
+		{name: "default", mac: other, want: time.Hour},
+		{name: "requested within bounds", mac: other, requested: 4 * time.Hour, want: 4 * time.Hour},
+		{name: "requested below minimum", mac: other, requested: time.Minute, want: 10 * time.Minute},
+		{name: "requested above maximum", mac: other, requested: 30 * 24 * time.Hour, want: 24 * time.Hour},
+		{name: "reservation", mac: reserved, want: 90 * 24 * time.Hour},
+		{name: "reservation ignores request", mac: reserved, requested: time.Hour, want: 90 * 24 * time.Hour},
+	}
+
+	pl := &PluginState{
+		LeaseTime:    time.Hour,
+		MinLeaseTime: 10 * time.Minute,
+		MaxLeaseTime: 24 * time.Hour,
+		reservations: map[string]reservation{
+			reserved.String(): {IP: net.IPv4(10, 0, 0, 5).To4(), LeaseTime: 90 * 24 * time.Hour},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modifiers := []dhcpv4.Modifier{dhcpv4.WithHwAddr(tt.mac)}
+			if tt.requested > 0 {
+				modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(tt.requested)))
+			}
+			req, err := dhcpv4.New(modifiers...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, pl.leaseTime(req))
+		})
+	}
+}
+
+func TestHandler4LeaseTimes(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.MinLeaseTime = 10 * time.Minute
+	pl.MaxLeaseTime = 24 * time.Hour
+	pl.RenewalRatio = 0.4
+	pl.RebindingRatio = 0.8
+	serverID := net.IPv4(10, 0, 0, 254)
+
+	duration := func(reply *dhcpv4.DHCPv4, code dhcpv4.OptionCode) time.Duration {
+		t.Helper()
+		var d dhcpv4.Duration
+		require.NoError(t, d.FromBytes(reply.Options.Get(code)))
+		return time.Duration(d)
+	}
+
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01},
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(10*time.Hour)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+	)
+	require.NoError(t, err)
+	offer, _ := pl.Handler4(req, resp)
+	require.NotNil(t, offer)
+	assert.Equal(t, 10*time.Hour, duration(offer, dhcpv4.OptionIPAddressLeaseTime))
+	assert.Equal(t, 4*time.Hour, duration(offer, dhcpv4.OptionRenewTimeValue))
+	assert.Equal(t, 8*time.Hour, duration(offer, dhcpv4.OptionRebindingTimeValue))
+
+	// The lease is stored with the lease time the client asked for
+	req, err = dhcpv4.NewRequestFromOffer(offer,
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(10*time.Hour)),
+	)
+	require.NoError(t, err)
+	resp, err = dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+	)
+	require.NoError(t, err)
+	ack, _ := pl.Handler4(req, resp)
+	require.NotNil(t, ack)
+	assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+	assert.Equal(t, 10*time.Hour, duration(ack, dhcpv4.OptionIPAddressLeaseTime))
+	assert.Equal(t, 4*time.Hour, duration(ack, dhcpv4.OptionRenewTimeValue))
+	assert.Equal(t, 8*time.Hour, duration(ack, dhcpv4.OptionRebindingTimeValue))
+	record := pl.Recordsv4["aa:bb:cc:dd:ee:01"]
+	require.NotNil(t, record)
+	assert.WithinDuration(t, time.Now().Add(10*time.Hour), time.Unix(int64(record.expires), 0), 2*time.Second)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// migration is a change to the schema of a lease database
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// statements returns a migration executing SQL statements in order
+func statements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrate runs the migrations a database has not seen yet in order, and
+// records how many ran as the version of its schema in the schema_version
+// table. Databases created before there were versions are at version 0, so
+// the first migrations must cope with the tables existing already. The caller
+// commits tx.
+func migrate(tx *sql.Tx, migrations []migration) error {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return fmt.Errorf("table creation failed: %w", err)
+	}
+	var version int
+	err := tx.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+			return fmt.Errorf("failed to initialize schema version: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := migrations[i].apply(tx); err != nil {
+			return fmt.Errorf("migration to schema version %d (%s) failed: %w", i+1, migrations[i].description, err)
+		}
+		log.Printf("Migrated lease database to schema version %d: %s", i+1, migrations[i].description)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE schema_version SET version = %d", len(migrations))); err != nil {
+		return fmt.Errorf("failed to update schema version: %w", err)
+	}
+	return nil
+}
+
+// chaiAddColumns returns a migration adding columns to a chai table, given
+// as "<name> <type> [constraints]". Chai has no ADD COLUMN IF NOT EXISTS, the
+// columns a table has already are skipped, as databases created before there
+// were versions may have some of them.
+func chaiAddColumns(table string, columns ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var schema string
+		if err := tx.QueryRow("SELECT sql FROM __chai_catalog WHERE name = ?", table).Scan(&schema); err != nil {
+			return fmt.Errorf("failed to read schema of table %s: %w", table, err)
+		}
+		for _, column := range columns {
+			name, _, _ := strings.Cut(column, " ")
+			if strings.Contains(schema, "("+name+" ") || strings.Contains(schema, ", "+name+" ") {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
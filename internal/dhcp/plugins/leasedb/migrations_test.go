@@ -0,0 +1,93 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var version int
+	require.NoError(t, db.QueryRow("SELECT version FROM schema_version").Scan(&version))
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := loadDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, len(chaiMigrations), schemaVersion(t, db))
+
+	var ran []string
+	migrations := append(chaiMigrations[:len(chaiMigrations):len(chaiMigrations)],
+		migration{"add a table", func(tx *sql.Tx) error {
+			ran = append(ran, "add a table")
+			_, err := tx.Exec("CREATE TABLE test4 (ip TEXT PRIMARY KEY)")
+			return err
+		}},
+		migration{"break", func(tx *sql.Tx) error {
+			ran = append(ran, "break")
+			return errors.New("broken")
+		}},
+	)
+
+	// Only the new migrations run, the version is unchanged when one fails
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	err = migrate(tx, migrations)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("migration to schema version %d (break) failed: broken", len(chaiMigrations)+2))
+	require.NoError(t, tx.Rollback())
+	assert.Equal(t, []string{"add a table", "break"}, ran)
+	assert.Equal(t, len(chaiMigrations), schemaVersion(t, db))
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, migrate(tx, migrations[:len(migrations)-1]))
+	require.NoError(t, tx.Commit())
+	assert.Equal(t, len(chaiMigrations)+1, schemaVersion(t, db))
+
+	// A server does not touch a database migrated by a newer one
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	err = migrate(tx, chaiMigrations)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("database schema version %d is newer than the supported version %d", len(chaiMigrations)+1, len(chaiMigrations)))
+}
+
+func TestLoadDBMigratesUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.db")
+	db, err := sql.Open("chai", path)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry INTEGER, PRIMARY KEY (mac, ip))")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE quarantine4 (ip TEXT PRIMARY KEY, expiry INTEGER)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO leases4(mac, ip, expiry) VALUES ('02:00:00:00:00:01', '10.0.0.1', 100)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = loadDB(path)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, len(chaiMigrations), schemaVersion(t, db))
+	records, err := loadRecords(db)
+	require.NoError(t, err)
+	require.Contains(t, records, "02:00:00:00:00:01")
+	record := records["02:00:00:00:00:01"]
+	assert.Equal(t, "10.0.0.1", record.IP.String())
+	assert.Equal(t, 100, record.expires)
+	assert.Equal(t, "02:00:00:00:00:01", record.HWAddr)
+	assert.Equal(t, LeaseBound, record.State)
+}
@@ -5,11 +5,13 @@
 package leasedb
 
 import (
-	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,12 +19,26 @@ import (
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
-	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
 var log = logger.GetLogger("plugins/range")
 
+const (
+	// defaultSweepInterval is how often expired leases are reclaimed unless
+	// configured otherwise with the sweep argument
+	defaultSweepInterval = time.Minute
+	// defaultDeclineTime is how long a declined address is kept out of the
+	// pool unless configured otherwise with the decline argument
+	defaultDeclineTime = 24 * time.Hour
+	// defaultOfferTime is how long an offered address is held for the client
+	// unless configured otherwise with the offer argument
+	defaultOfferTime = 30 * time.Second
+	// clientShards is the number of locks serializing the requests of the
+	// clients renewing their lease concurrently
+	clientShards = 64
+)
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
 	Name:   "range",
@@ -33,59 +49,1022 @@ var Plugin = plugins.Plugin{
 type Record struct {
 	IP      net.IP
 	expires int
+	// Hostname is the host name the client sent
+	Hostname string
+	// HWAddr is the hardware address of the client, also for clients known
+	// by their client identifier
+	HWAddr string
+	// VMI is the VirtualMachineInstance the client runs in, as named by the
+	// kubevirt plugin in the host name of the reply
+	VMI   string
+	State LeaseState
+	// firstSeen is when the client was leased the address, lastSeen when
+	// the lease was last extended
+	firstSeen int
+	lastSeen  int
+	// nonce authenticates the DHCPFORCERENEW sent to the client, RFC 6704.
+	// Clients are given a new one every DHCPACK, it is stored with the lease
+	// so the server can still send them one after a restart.
+	nonce []byte
 }
 
+// LeaseState is the state of a stored lease
+type LeaseState string
+
+const (
+	LeaseOffered  LeaseState = "offered"
+	LeaseBound    LeaseState = "bound"
+	LeaseReleased LeaseState = "released"
+	LeaseDeclined LeaseState = "declined"
+)
+
 // PluginState is the data held by an instance of the range plugin
 type PluginState struct {
-	// Rough lock for the whole plugin, we'll get better performance once we use leasestorage
-	sync.Mutex
+	// The plugin lock guards the state shared by the clients: the maps, the
+	// allocator and standby. Clients renewing their lease only read it, they
+	// hold it for reading and the lock of their shard in clientLocks, which
+	// guards the fields of their lease.
+	sync.RWMutex
+	clientLocks [clientShards]sync.Mutex
 	// Recordsv4 holds a MAC -> IP address and lease time mapping
 	Recordsv4 map[string]*Record
+	// Offersv4 holds the addresses offered to clients that have not requested them yet
+	Offersv4 map[string]*Record
+	// Quarantinev4 holds the addresses declined by clients and when they may be handed out again
+	Quarantinev4 map[string]int
+	// LeaseTime is the lease time of clients that do not ask for one
 	LeaseTime time.Duration
-	leasedb   *sql.DB
+	// MinLeaseTime and MaxLeaseTime bound the lease time clients may ask for
+	MinLeaseTime time.Duration
+	MaxLeaseTime time.Duration
+	// RenewalRatio and RebindingRatio are the fractions of the lease time
+	// after which clients renew (T1) and rebind (T2) their lease
+	RenewalRatio   float64
+	RebindingRatio float64
+	// OfferTime is how long an offered address is held for the client
+	OfferTime time.Duration
+	// DeclineTime is how long a declined address is quarantined
+	DeclineTime time.Duration
+	// GracePeriod is how long an expired lease is kept before it is reclaimed
+	GracePeriod time.Duration
+	// Affinity is how long an expired lease stays with its client after the
+	// grace period, unless the address is needed for another client
+	Affinity time.Duration
+	// SweepInterval is how often expired leases are looked for, zero disables the sweeper
+	SweepInterval time.Duration
+	// CommitWindow is how long lease changes may wait to be written to the
+	// lease store, zero writes them through
+	CommitWindow time.Duration
+	// HistoryRetention is how long the history of a lease is kept after it
+	// ended, zero disables the history
+	HistoryRetention time.Duration
+	// StalePolicy is what becomes of the stored leases that do not fit the
+	// range anymore on startup
+	StalePolicy StalePolicy
+	// EventRetries is how many times the delivery of an event to a webhook
+	// is retried
+	EventRetries int
+	// BulkConns is how many bulk leasequery connections are served at once
+	BulkConns int
+	// ForceRenewRate is how many DHCPFORCERENEW are sent per second
+	ForceRenewRate int
+	// Strategy is how the address of a new client is picked
+	Strategy AllocationStrategy
+	leasedb  LeaseStore
+	// writes queues the changes to leasedb when writing behind
+	writes *writeBehind
+	// history is the lease store keeping the history of the leases, if kept
+	history LeaseHistory
+	// events publishes the events of the leases to the webhooks and exec
+	// hooks, if any
+	events    *eventBus
+	webhooks  []string
+	execHooks []string
 	allocator allocators.Allocator
+	// pools are the ranges addresses are handed out from, in order of preference
+	pools []ipRange
+	// exclusions are the addresses of the pools that are never handed out
+	exclusions []ipRange
+	// reservations holds the addresses reserved for clients by MAC address,
+	// they are handed out to nobody else
+	reservations map[string]reservation
+	// standby is set while another server leads the replicas of a replicated
+	// lease store, requests are left to the leader
+	standby bool
+	// adminAddr is the address the admin endpoint is served on, if any
+	adminAddr string
+	// bulkAddr is the address bulk leasequeries are served on, if any, to
+	// the requestors of bulkAllowed
+	bulkAddr    string
+	bulkAllowed []*net.IPNet
+	// rapidCommitPools are the pools whose addresses are leased right away
+	// to the clients asking for rapid commit, rapidCommitAll allows it for
+	// all addresses
+	rapidCommitPools []ipRange
+	rapidCommitAll   bool
+	// forceRenewer asks the bound clients to renew, if enabled with the
+	// server identifier forceRenewID, and once for every configuration
+	// forceRenewConfig the server starts or leads with
+	forceRenewer     *forceRenewer
+	forceRenewID     net.IP
+	forceRenewNonce  bool
+	forceRenewConfig string
+	// floatingIPs are the addresses held while this replica leads the lease
+	// store replicas, floatingHeld is set while it holds them. setFloatingIP
+	// adds or removes one, setInterfaceAddress unless replaced by tests.
+	floatingIPs   []floatingIP
+	floatingHeld  bool
+	setFloatingIP func(f floatingIP, hold bool) error
+	// stopped is closed when the plugin is shut down, stopping the sweeper
+	stopped chan struct{}
+	// stale holds the leases of Recordsv4 kept by the stale policy although
+	// they do not fit the range anymore, by client
+	stale map[string]staleLease
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() == dhcpv4.MessageTypeInform {
+		return p.inform(req, resp)
+	}
+	if reply, stop, ok := p.renew(req, resp); ok {
+		return reply, stop
+	}
 	p.Lock()
 	defer p.Unlock()
-	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
-	if !ok {
-		// Allocating new address since there isn't one allocated
-		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
-		ip, err := p.allocator.Allocate(net.IPNet{})
+	if p.standby {
+		// Another replica is the leader and answers
+		return nil, true
+	}
+	if req.MessageType() == MessageTypeLeaseQuery {
+		return p.leasequery(req, resp), true
+	}
+	echoClientID(req, resp)
+	if reply, stop, ok := p.serveStale(req, resp); ok {
+		return reply, stop
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		p.release(req)
+		return nil, true
+	case dhcpv4.MessageTypeDecline:
+		p.decline(req)
+		return nil, true
+	case dhcpv4.MessageTypeDiscover:
+		return p.discover(req, resp)
+	case dhcpv4.MessageTypeRequest:
+		// The server identifier in resp is ours, set by the server_id plugin
+		if sid := req.ServerIdentifier(); sid != nil && resp.ServerIdentifier() != nil && !sid.Equal(resp.ServerIdentifier()) {
+			log.Printf("Client %s selected server %s, withdrawing our offer", clientKey(req), sid)
+			p.withdrawOffer(clientKey(req))
+			return nil, true
+		}
+		if reason := p.checkRequest(req); reason != "" {
+			log.Printf("Refusing request from client %s: %s", clientKey(req), reason)
+			return nak(req, resp, reason), true
+		}
+	}
+	return p.commit(req, resp)
+}
+
+// renew answers the clients asking for the lease they hold again, which most
+// requests do. Those only read the state shared by the clients, so the plugin
+// lock is held for reading and clients are answered concurrently, the requests
+// of a client one after the other. It reports whether it answered, the other
+// requests need the plugin lock.
+func (p *PluginState) renew(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool, bool) {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeNone:
+	default:
+		return nil, false, false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	if p.standby {
+		// Another replica is the leader and answers
+		return nil, true, true
+	}
+	client := clientKey(req)
+	if _, ok := p.Recordsv4[client]; !ok {
+		return nil, false, false
+	}
+	if _, stale := p.stale[client]; stale {
+		return nil, false, false
+	}
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		// Requests selecting another server or refused withdraw offers
+		if sid := req.ServerIdentifier(); sid != nil && resp.ServerIdentifier() != nil && !sid.Equal(resp.ServerIdentifier()) {
+			return nil, false, false
+		}
+		if p.checkRequest(req) != "" {
+			return nil, false, false
+		}
+	}
+	lock := p.clientLock(client)
+	lock.Lock()
+	defer lock.Unlock()
+	echoClientID(req, resp)
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		reply, stop := p.discover(req, resp)
+		return reply, stop, true
+	}
+	reply, stop := p.commit(req, resp)
+	return reply, stop, true
+}
+
+// inform answers a DHCPINFORM from a client that configured its address
+// itself and asks for the other parameters only, RFC 2131 section 4.3.5. No
+// address is allocated and no lease is touched, the reply goes on to the next
+// plugins for their options without lease times.
+func (p *PluginState) inform(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	p.RLock()
+	standby := p.standby
+	p.RUnlock()
+	if standby {
+		// Another replica is the leader and answers
+		return nil, true
+	}
+	resp.ClientIPAddr = req.ClientIPAddr
+	resp.YourIPAddr = net.IPv4zero
+	resp.Options.Del(dhcpv4.OptionIPAddressLeaseTime)
+	resp.Options.Del(dhcpv4.OptionRenewTimeValue)
+	resp.Options.Del(dhcpv4.OptionRebindingTimeValue)
+	log.Debugf("Answering DHCPINFORM from client %s at %s", clientKey(req), req.ClientIPAddr)
+	return resp, false
+}
+
+// clientLock returns the lock of the shard of a client
+func (p *PluginState) clientLock(client string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	return &p.clientLocks[h.Sum32()%clientShards]
+}
+
+// offer handles a DHCPDISCOVER. Clients without a lease get an address that is
+// only held in memory for OfferTime, the lease is committed to storage once
+// the client requests it. The caller must hold the plugin lock, or hold it for
+// reading and the lock of the client if it has a lease.
+func (p *PluginState) offer(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	client := clientKey(req)
+	var ip net.IP
+	if record, ok := p.Recordsv4[client]; ok {
+		ip = record.IP
+	} else if offer, ok := p.Offersv4[client]; ok {
+		offer.expires = int(time.Now().Add(p.OfferTime).Unix())
+		ip = offer.IP
+	} else {
+		allocated, err := p.allocate(client, req.ClientHWAddr.String(), requestedIP(req))
 		if err != nil {
-			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
+			log.Errorf("Could not allocate IP for client %s: %v", client, err)
 			return nil, true
 		}
+		p.Offersv4[client] = &Record{
+			IP:      allocated,
+			expires: int(time.Now().Add(p.OfferTime).Unix()),
+		}
+		ip = allocated
+	}
+	resp.YourIPAddr = ip
+	p.setLeaseTime(resp, p.leaseTime(req))
+	log.Printf("offering IP address %s to client %s", ip, client)
+	return resp, false
+}
+
+// commit leases an address to the client, or extends its lease, and writes
+// the lease to storage. An address offered to the client is used if it is the
+// one being requested. The caller must hold the plugin lock, or hold it for
+// reading and the lock of the client if it has a lease.
+func (p *PluginState) commit(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	client := clientKey(req)
+	leaseTime := p.leaseTime(req)
+	record, ok := p.Recordsv4[client]
+	if !ok {
+		// Allocating new address since there isn't one allocated, preferring
+		// the one the client asks for
+		log.Printf("Client %s is new, leasing new IPv4 address", client)
+		wanted := requestedIP(req)
+		var ip net.IP
+		if offer, ok := p.Offersv4[client]; ok && (wanted == nil || offer.IP.Equal(wanted)) {
+			ip = offer.IP
+			delete(p.Offersv4, client)
+		} else {
+			p.withdrawOffer(client)
+			allocated, err := p.allocate(client, req.ClientHWAddr.String(), wanted)
+			if err != nil {
+				log.Errorf("Could not allocate IP for client %s: %v", client, err)
+				return nil, true
+			}
+			if req.MessageType() == dhcpv4.MessageTypeRequest && wanted != nil && !allocated.Equal(wanted) {
+				// checkRequest made sure the address was free, so this should not happen
+				if err := p.allocator.Free(net.IPNet{IP: allocated}); err != nil {
+					log.Warningf("Could not free IP %s: %v", allocated, err)
+				}
+				reason := fmt.Sprintf("requested address %s is not available", wanted)
+				log.Errorf("Refusing request from client %s: %s", client, reason)
+				return nak(req, resp, reason), true
+			}
+			ip = allocated
+		}
+		now := time.Now()
 		rec := Record{
-			IP:      ip.IP.To4(),
-			expires: int(time.Now().Add(p.LeaseTime).Unix()),
+			IP:        ip,
+			expires:   int(now.Add(leaseTime).Unix()),
+			firstSeen: int(now.Unix()),
 		}
-		err = p.saveIPAddress(req.ClientHWAddr, &rec)
+		describe(&rec, req, resp, now)
+		rec.nonce = p.forceRenewer.giveNonce(req, resp)
+		holder, err := p.claimIPAddress(client, &rec)
 		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
+			log.Errorf("SaveIPAddress for client %s failed: %v", client, err)
 		}
-		p.Recordsv4[req.ClientHWAddr.String()] = &rec
+		if holder != nil {
+			reason := p.adopt(holder)
+			log.Printf("Refusing request from client %s: %s", client, reason)
+			return nak(req, resp, reason), true
+		}
+		p.Recordsv4[client] = &rec
 		record = &rec
+		p.journal(EventAllocate, client, record, now)
 	} else {
+		nonce := p.forceRenewer.giveNonce(req, resp)
+		if nonce != nil {
+			record.nonce = nonce
+		}
 		// Ensure we extend the existing lease at least past when the one we're giving expires
 		expiry := time.Unix(int64(record.expires), 0)
-		if expiry.Before(time.Now().Add(p.LeaseTime)) {
-			record.expires = int(time.Now().Add(p.LeaseTime).Round(time.Second).Unix())
-			err := p.saveIPAddress(req.ClientHWAddr, record)
+		if now := time.Now(); expiry.Before(now.Add(leaseTime)) {
+			record.expires = int(now.Add(leaseTime).Round(time.Second).Unix())
+			describe(record, req, resp, now)
+			err := p.saveIPAddress(client, record)
 			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
+				log.Errorf("Could not persist lease for client %s: %v", client, err)
+			}
+			p.journal(EventRenew, client, record, now)
+		} else if nonce != nil {
+			// The lease is not extended, the new nonce is stored all the same
+			if err := p.saveIPAddress(client, record); err != nil {
+				log.Errorf("Could not persist lease for client %s: %v", client, err)
 			}
 		}
 	}
 	resp.YourIPAddr = record.IP
-	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
-	log.Printf("found IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
+	p.setLeaseTime(resp, leaseTime)
+	log.Printf("found IP address %s for client %s", record.IP, client)
 	return resp, false
 }
 
+// describe fills in what is known about the client of a lease being bound or
+// extended from its request and the reply prepared by the earlier plugins
+func describe(record *Record, req, resp *dhcpv4.DHCPv4, now time.Time) {
+	record.Hostname = req.HostName()
+	record.HWAddr = req.ClientHWAddr.String()
+	record.VMI = resp.HostName()
+	record.State = LeaseBound
+	record.lastSeen = int(now.Unix())
+}
+
+// adopt records the lease or quarantine that another server sharing the lease
+// store holds on an address we allocated. The address stays allocated until
+// the lease or quarantine is reclaimed by the sweeper. It returns why the
+// address cannot be leased. The caller must hold the plugin lock.
+func (p *PluginState) adopt(holder *Lease) string {
+	if holder.MAC == "" {
+		p.Quarantinev4[holder.IP.String()] = holder.expires
+		return fmt.Sprintf("requested address %s is not available", holder.IP)
+	}
+	if current, ok := p.Recordsv4[holder.MAC]; ok && !current.IP.Equal(holder.IP) {
+		// Another server moved the client to another address
+		delete(p.Recordsv4, holder.MAC)
+		p.freeLease(holder.MAC, current.IP)
+	}
+	delete(p.stale, holder.MAC)
+	record := holder.Record
+	p.Recordsv4[holder.MAC] = &record
+	return fmt.Sprintf("requested address %s is leased to another client", holder.IP)
+}
+
+// allocate allocates an address for a client with hardware address mac,
+// preferring hint. Clients with a reservation always get the reserved address.
+// Otherwise they get the address derived from their identity with the sticky
+// strategy, or the first free one. When the pool is exhausted the expired
+// offers are withdrawn, then the expired leases are reclaimed oldest first,
+// before trying again. The caller must hold the plugin lock.
+func (p *PluginState) allocate(client, mac string, hint net.IP) (net.IP, error) {
+	if reserved, ok := p.reservations[mac]; ok {
+		// The address is kept allocated for the client by the allocator
+		return reserved.IP, nil
+	}
+	if p.Strategy == AllocateSticky {
+		if hint != nil && p.inRange(hint) && p.reallocate(hint) == nil {
+			return hint, nil
+		}
+		if ip := p.allocateSticky(client); ip != nil {
+			return ip, nil
+		}
+	}
+	ip, err := p.allocator.Allocate(net.IPNet{IP: hint})
+	if errors.Is(err, allocators.ErrNoAddrAvail) && p.expireOffers(time.Now()) > 0 {
+		ip, err = p.allocator.Allocate(net.IPNet{IP: hint})
+	}
+	for errors.Is(err, allocators.ErrNoAddrAvail) && p.reclaimOldest(time.Now()) {
+		ip, err = p.allocator.Allocate(net.IPNet{IP: hint})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ip.IP.To4(), nil
+}
+
+// withdrawOffer returns the address offered to a client to the pool. The
+// caller must hold the plugin lock.
+func (p *PluginState) withdrawOffer(client string) {
+	offer, ok := p.Offersv4[client]
+	if !ok {
+		return
+	}
+	if err := p.allocator.Free(net.IPNet{IP: offer.IP}); err != nil {
+		log.Warningf("Could not free IP %s offered to client %s: %v", offer.IP, client, err)
+	}
+	delete(p.Offersv4, client)
+}
+
+// expireOffers withdraws the offers that were not requested in time and
+// returns how many were withdrawn. The caller must hold the plugin lock.
+func (p *PluginState) expireOffers(now time.Time) int {
+	expired := 0
+	for client, offer := range p.Offersv4 {
+		if int64(offer.expires) > now.Unix() {
+			continue
+		}
+		p.withdrawOffer(client)
+		expired++
+	}
+	return expired
+}
+
+// reclaimOldest reclaims the lease that expired first, once its grace period
+// is over, to hand out its address to another client. It reports whether a
+// lease was reclaimed. The caller must hold the plugin lock.
+func (p *PluginState) reclaimOldest(now time.Time) bool {
+	var (
+		oldest string
+		record *Record
+	)
+	for client, candidate := range p.Recordsv4 {
+		if int64(candidate.expires) > now.Add(-p.GracePeriod).Unix() {
+			continue
+		}
+		if stale, ok := p.stale[client]; ok && !stale.allocated {
+			// Reclaiming it would not free an address
+			continue
+		}
+		if record == nil || candidate.expires < record.expires || candidate.expires == record.expires && client < oldest {
+			oldest, record = client, candidate
+		}
+	}
+	if record == nil {
+		return false
+	}
+	if err := p.deleteIPAddress(oldest, record); err != nil {
+		log.Errorf("Could not remove expired lease for client %s: %v", oldest, err)
+		return false
+	}
+	delete(p.Recordsv4, oldest)
+	p.freeLease(oldest, record.IP)
+	p.journal(EventExpire, oldest, record, now)
+	log.Printf("Pool exhausted, reclaimed expired IP address %s from client %s", record.IP, oldest)
+	return true
+}
+
+// requestedIP returns the address a client asks for: the requested IP address
+// option when SELECTING or in INIT-REBOOT, ciaddr when RENEWING or REBINDING.
+// It returns nil if the client does not ask for a specific address.
+func requestedIP(req *dhcpv4.DHCPv4) net.IP {
+	if ip := req.RequestedIPAddress(); isSpecified(ip) {
+		return ip.To4()
+	}
+	if isSpecified(req.ClientIPAddr) {
+		return req.ClientIPAddr.To4()
+	}
+	return nil
+}
+
+// isSpecified reports whether ip holds an actual address
+func isSpecified(ip net.IP) bool {
+	return ip != nil && !ip.IsUnspecified()
+}
+
+// inRange reports whether ip belongs to a pool of this plugin and is not
+// excluded from it
+func (p *PluginState) inRange(ip net.IP) bool {
+	return leasable(ip, p.pools, p.exclusions)
+}
+
+// leaseholder returns the client an IP address is leased to, or an empty
+// string if it is not leased. The caller must hold the plugin lock.
+func (p *PluginState) leaseholder(ip net.IP) string {
+	for client, record := range p.Recordsv4 {
+		if record.IP.Equal(ip) {
+			return client
+		}
+	}
+	return ""
+}
+
+// checkRequest verifies that the address a client asks for in a DHCPREQUEST
+// can be given to it, following RFC 2131 section 4.3.2. It returns why the
+// request must be refused, or an empty string if it may be acknowledged. The
+// caller must hold the plugin lock.
+func (p *PluginState) checkRequest(req *dhcpv4.DHCPv4) string {
+	ip := requestedIP(req)
+	if ip == nil {
+		return ""
+	}
+	if reserved, ok := p.reservations[req.ClientHWAddr.String()]; ok {
+		if !reserved.IP.Equal(ip) {
+			return fmt.Sprintf("requested address %s is not reserved for this client", ip)
+		}
+		return ""
+	}
+	if !p.inRange(ip) {
+		return fmt.Sprintf("requested address %s is not on this network", ip)
+	}
+	if record, ok := p.Recordsv4[clientKey(req)]; ok {
+		if !record.IP.Equal(ip) {
+			return fmt.Sprintf("requested address %s is not leased to this client", ip)
+		}
+		return ""
+	}
+	if offer, ok := p.Offersv4[clientKey(req)]; ok && offer.IP.Equal(ip) {
+		return ""
+	}
+	if p.leaseholder(ip) != "" {
+		return fmt.Sprintf("requested address %s is leased to another client", ip)
+	}
+	if p.reservedFor(ip) != "" {
+		return fmt.Sprintf("requested address %s is reserved for another client", ip)
+	}
+	for _, offer := range p.Offersv4 {
+		if offer.IP.Equal(ip) {
+			return fmt.Sprintf("requested address %s is offered to another client", ip)
+		}
+	}
+	if _, ok := p.Quarantinev4[ip.String()]; ok {
+		return fmt.Sprintf("requested address %s is not available", ip)
+	}
+	return ""
+}
+
+// nak builds a DHCPNAK in reply to req. Only the server identifier set by
+// previous plugins is kept from resp, RFC 2131 does not allow other options.
+func nak(req, resp *dhcpv4.DHCPv4, reason string) *dhcpv4.DHCPv4 {
+	reply, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptMessage(reason)),
+	)
+	if err != nil {
+		log.Errorf("Could not build NAK: %v", err)
+		return nil
+	}
+	if sid := resp.ServerIdentifier(); sid != nil {
+		reply.UpdateOption(dhcpv4.OptServerIdentifier(sid))
+	}
+	echoClientID(req, reply)
+	return reply
+}
+
+// release handles a DHCPRELEASE by returning the client's address to the pool.
+// The caller must hold the plugin lock.
+func (p *PluginState) release(req *dhcpv4.DHCPv4) {
+	client := clientKey(req)
+	record, ok := p.Recordsv4[client]
+	if !ok {
+		log.Printf("Ignoring release from client %s without a lease", client)
+		return
+	}
+	if isSpecified(req.ClientIPAddr) && !req.ClientIPAddr.Equal(record.IP) {
+		log.Warningf("Ignoring release of %s from client %s, it holds %s", req.ClientIPAddr, client, record.IP)
+		return
+	}
+	if err := p.deleteIPAddress(client, record); err != nil {
+		log.Errorf("Could not remove released lease for client %s: %v", client, err)
+		return
+	}
+	delete(p.Recordsv4, client)
+	p.freeLease(client, record.IP)
+	p.journal(EventRelease, client, record, time.Now())
+	log.Printf("Client %s released IP address %s", client, record.IP)
+}
+
+// decline handles a DHCPDECLINE by quarantining the declined address for
+// DeclineTime. The address stays allocated until the quarantine ends, so it is
+// not handed out to another client in the meantime. The caller must hold the
+// plugin lock.
+func (p *PluginState) decline(req *dhcpv4.DHCPv4) {
+	client := clientKey(req)
+	ip := req.RequestedIPAddress()
+	record, ok := p.Recordsv4[client]
+	if !ok || ip == nil || !ip.Equal(record.IP) {
+		log.Warningf("Ignoring decline of %v from client %s, it is not leased to this client", ip, client)
+		return
+	}
+	if stale, ok := p.stale[client]; ok && !stale.allocated {
+		// The address is not ours to hand out, there is nothing to quarantine
+		if err := p.deleteIPAddress(client, record); err != nil {
+			log.Errorf("Could not remove declined lease for client %s: %v", client, err)
+		}
+		delete(p.Recordsv4, client)
+		delete(p.stale, client)
+		p.journal(EventDecline, client, record, time.Now())
+		log.Warningf("Client %s declined IP address %s of a stale lease", client, record.IP)
+		return
+	}
+	expires := int(time.Now().Add(p.DeclineTime).Unix())
+	if err := p.saveQuarantine(record.IP, expires); err != nil {
+		log.Errorf("Could not quarantine IP %s declined by client %s: %v", record.IP, client, err)
+		return
+	}
+	if err := p.deleteIPAddress(client, record); err != nil {
+		log.Errorf("Could not remove declined lease for client %s: %v", client, err)
+	}
+	delete(p.Recordsv4, client)
+	delete(p.stale, client)
+	p.Quarantinev4[record.IP.String()] = expires
+	p.journal(EventDecline, client, record, time.Now())
+	log.Warningf("Client %s declined IP address %s, quarantining it for %s", client, record.IP, p.DeclineTime)
+}
+
+// sweep reclaims the leases that expired more than GracePeriod and Affinity
+// before now, the offers that were not requested in time and the declined
+// addresses whose quarantine is over. The addresses are returned to the
+// allocator and removed from storage, and the history older than
+// HistoryRetention is pruned. It returns the number of reclaimed addresses.
+// Servers standing by for the leader of a replicated lease store leave it to
+// the leader.
+func (p *PluginState) sweep(now time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	if p.standby {
+		return 0
+	}
+	reclaimed := p.expireOffers(now)
+	p.flushWrites()
+	err := p.leasedb.Expired(now.Add(-p.GracePeriod-p.Affinity), func(client string, record *Record) error {
+		current, ok := p.Recordsv4[client]
+		if ok && current.IP.Equal(record.IP) && current.expires != record.expires {
+			// The lease was extended since it was stored
+			return nil
+		}
+		if err := p.deleteIPAddress(client, record); err != nil {
+			log.Errorf("Could not remove expired lease for client %s: %v", client, err)
+			return nil
+		}
+		if ok && current.IP.Equal(record.IP) {
+			delete(p.Recordsv4, client)
+			p.freeLease(client, record.IP)
+		} else if p.leaseholder(record.IP) == "" {
+			// An outdated lease must not free an address that is in use again
+			if err := p.allocator.Free(net.IPNet{IP: record.IP}); err != nil {
+				log.Warningf("Could not free expired IP %s for client %s: %v", record.IP, client, err)
+			}
+		}
+		p.journal(EventExpire, client, record, now)
+		log.Printf("Reclaimed expired IP address %s from client %s", record.IP, client)
+		reclaimed++
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Could not look up expired leases: %v", err)
+	}
+	for ip, expires := range p.Quarantinev4 {
+		if int64(expires) > now.Unix() {
+			continue
+		}
+		addr := net.ParseIP(ip)
+		if err := p.deleteQuarantine(addr); err != nil {
+			log.Errorf("Could not lift quarantine of IP %s: %v", ip, err)
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: addr}); err != nil {
+			log.Warningf("Could not free quarantined IP %s: %v", ip, err)
+		}
+		delete(p.Quarantinev4, ip)
+		log.Printf("Quarantine of declined IP address %s is over", ip)
+		reclaimed++
+	}
+	p.pruneHistory(now)
+	return reclaimed
+}
+
+// runSweeper periodically reclaims expired leases until the plugin is shut
+// down
+func (p *PluginState) runSweeper() {
+	ticker := time.NewTicker(p.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n := p.sweep(now); n > 0 {
+				log.Printf("Reclaimed %d expired DHCPv4 addresses", n)
+			}
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// reallocate marks a specific address as allocated, failing if the allocator
+// cannot hand out exactly that address
+func (p *PluginState) reallocate(ip net.IP) error {
+	allocated, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return err
+	}
+	if !allocated.IP.Equal(ip) {
+		if err := p.allocator.Free(allocated); err != nil {
+			log.Warningf("Could not free IP %s: %v", allocated.IP, err)
+		}
+		return fmt.Errorf("allocator did not re-allocate requested ip %v: %v", ip.String(), allocated.String())
+	}
+	return nil
+}
+
+// parseOptions parses the optional key=value arguments following the
+// mandatory ones
+func (p *PluginState) parseOptions(args []string) error {
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid argument %q, want key=value", arg)
+		}
+		switch key {
+		case "sweep":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < 0 {
+				return fmt.Errorf("invalid sweep interval: %v", value)
+			}
+			p.SweepInterval = interval
+		case "grace":
+			grace, err := time.ParseDuration(value)
+			if err != nil || grace < 0 {
+				return fmt.Errorf("invalid grace period: %v", value)
+			}
+			p.GracePeriod = grace
+		case "affinity":
+			affinity, err := time.ParseDuration(value)
+			if err != nil || affinity < 0 {
+				return fmt.Errorf("invalid lease affinity: %v", value)
+			}
+			p.Affinity = affinity
+		case "decline":
+			decline, err := time.ParseDuration(value)
+			if err != nil || decline < 0 {
+				return fmt.Errorf("invalid decline quarantine time: %v", value)
+			}
+			p.DeclineTime = decline
+		case "offer":
+			offer, err := time.ParseDuration(value)
+			if err != nil || offer <= 0 {
+				return fmt.Errorf("invalid offer hold time: %v", value)
+			}
+			p.OfferTime = offer
+		case "min-lease":
+			minLease, err := time.ParseDuration(value)
+			if err != nil || minLease <= 0 {
+				return fmt.Errorf("invalid minimum lease duration: %v", value)
+			}
+			p.MinLeaseTime = minLease
+		case "max-lease":
+			maxLease, err := time.ParseDuration(value)
+			if err != nil || maxLease <= 0 || maxLease > dhcpv4.MaxLeaseTime {
+				return fmt.Errorf("invalid maximum lease duration: %v", value)
+			}
+			p.MaxLeaseTime = maxLease
+		case "t1":
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio <= 0 || ratio >= 1 {
+				return fmt.Errorf("invalid renewal time ratio: %v", value)
+			}
+			p.RenewalRatio = ratio
+		case "t2":
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio <= 0 || ratio >= 1 {
+				return fmt.Errorf("invalid rebinding time ratio: %v", value)
+			}
+			p.RebindingRatio = ratio
+		case "pool":
+			pool, err := parseIPRange(value)
+			if err != nil {
+				return fmt.Errorf("invalid pool: %w", err)
+			}
+			p.pools = append(p.pools, pool)
+		case "exclude":
+			excluded, err := parseIPRange(value)
+			if err != nil {
+				return fmt.Errorf("invalid exclusion: %w", err)
+			}
+			p.exclusions = append(p.exclusions, excluded)
+		case "commit":
+			window, err := time.ParseDuration(value)
+			if err != nil || window < 0 {
+				return fmt.Errorf("invalid commit window: %v", value)
+			}
+			p.CommitWindow = window
+		case "history":
+			retention, err := time.ParseDuration(value)
+			if err != nil || retention < 0 {
+				return fmt.Errorf("invalid history retention: %v", value)
+			}
+			p.HistoryRetention = retention
+		case "webhook":
+			p.webhooks = append(p.webhooks, value)
+		case "exec":
+			p.execHooks = append(p.execHooks, value)
+		case "event-retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil || retries < 0 {
+				return fmt.Errorf("invalid event retries: %v", value)
+			}
+			p.EventRetries = retries
+		case "admin":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return fmt.Errorf("invalid admin address: %v", value)
+			}
+			p.adminAddr = value
+		case "bulk":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return fmt.Errorf("invalid bulk leasequery address: %v", value)
+			}
+			p.bulkAddr = value
+		case "bulk-allow":
+			allowed, err := parseBulkAllow(value)
+			if err != nil {
+				return err
+			}
+			p.bulkAllowed = append(p.bulkAllowed, allowed)
+		case "bulk-conns":
+			conns, err := strconv.Atoi(value)
+			if err != nil || conns <= 0 {
+				return fmt.Errorf("invalid bulk leasequery connections: %v", value)
+			}
+			p.BulkConns = conns
+		case "rapid-commit":
+			if err := p.parseRapidCommit(value); err != nil {
+				return err
+			}
+		case "forcerenew":
+			sid := net.ParseIP(value).To4()
+			if sid == nil {
+				return fmt.Errorf("invalid forcerenew server identifier: %v", value)
+			}
+			p.forceRenewID = sid
+		case "forcerenew-rate":
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate <= 0 {
+				return fmt.Errorf("invalid forcerenew rate: %v", value)
+			}
+			p.ForceRenewRate = rate
+		case "forcerenew-nonce":
+			nonce, err := parseForceRenewNonce(value)
+			if err != nil {
+				return err
+			}
+			p.forceRenewNonce = nonce
+		case "forcerenew-config":
+			if value == "" {
+				return fmt.Errorf("invalid forcerenew configuration: %v", value)
+			}
+			p.forceRenewConfig = value
+		case "floating-ip":
+			floating, err := parseFloatingIP(value)
+			if err != nil {
+				return err
+			}
+			p.floatingIPs = append(p.floatingIPs, floating)
+		case "allocation":
+			strategy, err := parseAllocationStrategy(value)
+			if err != nil {
+				return err
+			}
+			p.Strategy = strategy
+		case "stale":
+			policy, err := parseStalePolicy(value)
+			if err != nil {
+				return err
+			}
+			p.StalePolicy = policy
+		case "reservations":
+			reservations, err := loadReservations(value)
+			if err != nil {
+				return fmt.Errorf("invalid reservations: %w", err)
+			}
+			p.reservations = reservations
+		default:
+			return fmt.Errorf("unknown argument: %s", key)
+		}
+	}
+	return nil
+}
+
+// load builds the in-memory state of the plugin from the lease store: the
+// leases, the quarantined addresses and the allocator. Pending offers are
+// dropped. The leases that do not fit the pools and reservations anymore are
+// dropped or kept following the stale policy, see reconcile. The caller must
+// hold the plugin lock, if the plugin is running.
+func (p *PluginState) load() error {
+	var err error
+	reserved := make([]net.IP, 0, len(p.reservations))
+	for _, r := range p.reservations {
+		reserved = append(reserved, r.IP)
+	}
+	p.allocator, err = newPoolAllocator(p.pools, p.exclusions, reserved)
+	if err != nil {
+		return fmt.Errorf("could not create an allocator: %w", err)
+	}
+	p.flushWrites()
+	records, err := p.leasedb.Load()
+	if err != nil {
+		return fmt.Errorf("could not load records from file: %v", err)
+	}
+	p.Offersv4 = make(map[string]*Record)
+	report := p.reconcile(records)
+	log.Printf("Reconciled %d stored DHCPv4 leases with the range: %s", len(records), report)
+
+	p.Quarantinev4, err = p.leasedb.LoadQuarantine()
+	if err != nil {
+		return fmt.Errorf("could not load quarantined addresses: %v", err)
+	}
+	for ip := range p.Quarantinev4 {
+		if err := p.reallocate(net.ParseIP(ip)); err != nil {
+			// The address is not ours to hand out anymore, so there is nothing to keep out of the pool
+			log.Warningf("Dropping quarantine of IP %s: %v", ip, err)
+			if err := p.deleteQuarantine(net.ParseIP(ip)); err != nil {
+				log.Errorf("Could not drop quarantine of IP %s: %v", ip, err)
+			}
+			delete(p.Quarantinev4, ip)
+		}
+	}
+	return nil
+}
+
+// setLeading is called when this server becomes or stops being the leader of
+// the replicas sharing a replicated lease store. A new leader reloads its
+// state, the store holds the leases the previous leader handed out.
+func (p *PluginState) setLeading(leading bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !leading {
+		log.Printf("Lost leadership of the lease store replicas, standing by")
+		p.standby = true
+		p.holdFloatingIPs(false)
+		return
+	}
+	if err := p.load(); err != nil {
+		log.Errorf("Could not take over as leader of the lease store replicas: %v", err)
+		p.standby = true
+		p.holdFloatingIPs(false)
+		return
+	}
+	log.Printf("Leading the lease store replicas with %d DHCPv4 leases", len(p.Recordsv4))
+	p.standby = false
+	p.holdFloatingIPs(true)
+	p.forceRenewLater()
+}
+
+// setUp are the plugins set up, which Shutdown stops
+var setUp struct {
+	sync.Mutex
+	plugins []*PluginState
+}
+
+// Shutdown writes out the lease changes the plugins set up still queue and
+// closes their lease stores, so no lease is lost when the server stops. The
+// plugins cannot be used afterwards, the server has to stop listening first.
+func Shutdown() {
+	setUp.Lock()
+	defer setUp.Unlock()
+	for _, p := range setUp.plugins {
+		p.shutdown()
+	}
+	setUp.plugins = nil
+}
+
+// shutdown writes out the queued lease changes and closes the lease store,
+// waiting for the requests being handled
+func (p *PluginState) shutdown() {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped != nil {
+		close(p.stopped)
+	}
+	p.flushWrites()
+	// The replica taking over adds the floating addresses again
+	p.holdFloatingIPs(false)
+	if err := p.leasedb.Close(); err != nil {
+		log.Errorf("Could not close the lease store: %v", err)
+	}
+}
+
 func setupRange(args ...string) (handler.Handler4, error) {
 	var (
 		err error
@@ -93,8 +1072,9 @@ func setupRange(args ...string) (handler.Handler4, error) {
 	)
 
 	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time) and optional key=value arguments, got: %d", len(args))
 	}
+	// The lease store is given as a URI, a plain file name is a chai database
 	filename := args[0]
 	if filename == "" {
 		return nil, errors.New("file name cannot be empty")
@@ -111,35 +1091,117 @@ func setupRange(args ...string) (handler.Handler4, error) {
 		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
 	}
 
-	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
-	if err != nil {
-		return nil, fmt.Errorf("could not create an allocator: %w", err)
-	}
+	// The range is the first pool, more may follow as arguments
+	p.pools = []ipRange{{start: ipToUint32(ipRangeStart), end: ipToUint32(ipRangeEnd)}}
 
 	p.LeaseTime, err = time.ParseDuration(args[3])
 	if err != nil {
 		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
 	}
 
+	p.SweepInterval = defaultSweepInterval
+	p.DeclineTime = defaultDeclineTime
+	p.OfferTime = defaultOfferTime
+	p.CommitWindow = defaultCommitWindow
+	p.StalePolicy = StaleDrop
+	p.Strategy = AllocateFirst
+	p.EventRetries = defaultEventRetries
+	p.BulkConns = defaultBulkConns
+	p.ForceRenewRate = defaultForceRenewRate
+	p.RenewalRatio = defaultRenewalRatio
+	p.RebindingRatio = defaultRebindingRatio
+	if err := p.parseOptions(args[4:]); err != nil {
+		return nil, err
+	}
+	// Unless bounds are given clients cannot ask for another lease time
+	if p.MinLeaseTime == 0 {
+		p.MinLeaseTime = p.LeaseTime
+	}
+	if p.MaxLeaseTime == 0 {
+		p.MaxLeaseTime = p.LeaseTime
+	}
+	if p.LeaseTime < p.MinLeaseTime || p.LeaseTime > p.MaxLeaseTime {
+		return nil, fmt.Errorf("lease duration %s is not between the minimum %s and maximum %s", p.LeaseTime, p.MinLeaseTime, p.MaxLeaseTime)
+	}
+	if p.RenewalRatio >= p.RebindingRatio {
+		return nil, fmt.Errorf("renewal time ratio %v has to be lower than the rebinding time ratio %v", p.RenewalRatio, p.RebindingRatio)
+	}
+	if err := p.checkRapidCommit(); err != nil {
+		return nil, err
+	}
+	if p.bulkAddr != "" && len(p.bulkAllowed) == 0 {
+		return nil, errors.New("bulk leasequeries are served to the requestors allowed with bulk-allow, none are")
+	}
+
+	var sinks []EventSink
+	for _, webhook := range p.webhooks {
+		sink, err := newWebhookSink(webhook, p.EventRetries)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	for _, path := range p.execHooks {
+		sink, err := newExecSink(path)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) > 0 {
+		p.events = newEventBus(sinks...)
+	}
+	if p.forceRenewID != nil {
+		p.forceRenewer = newForceRenewer(p.forceRenewID, p.ForceRenewRate, p.forceRenewNonce)
+	}
+
 	if err := p.registerBackingDB(filename); err != nil {
 		return nil, fmt.Errorf("could not setup lease storage: %w", err)
 	}
-	p.Recordsv4, err = loadRecords(p.leasedb)
-	if err != nil {
-		return nil, fmt.Errorf("could not load records from file: %v", err)
+	if p.CommitWindow > 0 {
+		p.writes = newWriteBehind(p.leasedb, p.CommitWindow)
+	}
+	// Loading drops the stored leases that do not fit the range anymore,
+	// which the history and events record
+	if p.HistoryRetention > 0 {
+		history, ok := p.leasedb.(LeaseHistory)
+		if !ok {
+			return nil, fmt.Errorf("lease store %s cannot keep a lease history", filename)
+		}
+		p.history = history
+	}
+	if err := p.load(); err != nil {
+		return nil, err
 	}
-
 	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), filename)
-
-	for _, v := range p.Recordsv4 {
-		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
-		if err != nil {
-			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+	if p.adminAddr != "" {
+		if err := p.listenAdmin(p.adminAddr); err != nil {
+			return nil, err
 		}
-		if ip.IP.String() != v.IP.String() {
-			return nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+	}
+	if p.bulkAddr != "" {
+		if err := p.listenBulk(p.bulkAddr); err != nil {
+			return nil, err
 		}
 	}
 
+	if replicated, ok := p.leasedb.(ReplicatedLeaseStore); ok {
+		// Only the leader of the replicas hands out leases
+		p.standby = true
+		replicated.NotifyLeadership(p.setLeading)
+	} else if len(p.floatingIPs) > 0 {
+		return nil, errors.New("floating IPs require a replicated lease store")
+	} else {
+		p.forceRenewLater()
+	}
+
+	p.stopped = make(chan struct{})
+	if p.SweepInterval > 0 {
+		go p.runSweeper()
+	}
+
+	setUp.Lock()
+	setUp.plugins = append(setUp.plugins, &p)
+	setUp.Unlock()
 	return p.Handler4, nil
 }
@@ -2,9 +2,11 @@ package leasedb
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -64,6 +66,257 @@ func TestSetupRange(t *testing.T) {
 			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h"},
 			wantErr: false,
 		},
+		{
+			name:    "valid setup with sweeper arguments",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "sweep=30s", "grace=5m"},
+			wantErr: false,
+		},
+		{
+			name:    "sweeper disabled",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "sweep=0s"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid sweep interval",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "sweep=often"},
+			wantErr: true,
+			errMsg:  "invalid sweep interval",
+		},
+		{
+			name:    "negative grace period",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "grace=-1m"},
+			wantErr: true,
+			errMsg:  "invalid grace period",
+		},
+		{
+			name:    "invalid decline quarantine time",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "decline=forever"},
+			wantErr: true,
+			errMsg:  "invalid decline quarantine time",
+		},
+		{
+			name:    "invalid offer hold time",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "offer=0s"},
+			wantErr: true,
+			errMsg:  "invalid offer hold time",
+		},
+		{
+			name:    "malformed optional argument",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "sweep"},
+			wantErr: true,
+			errMsg:  "want key=value",
+		},
+		{
+			name:    "unknown optional argument",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "foo=bar"},
+			wantErr: true,
+			errMsg:  "unknown argument",
+		},
+		{
+			name:    "additional pools and exclusions",
+			args:    []string{":memory:", "10.0.0.10", "10.0.0.20", "1h", "pool=10.0.0.100-10.0.0.120", "pool=10.0.0.5", "exclude=10.0.0.15", "exclude=10.0.0.110-10.0.0.112"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid pool",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "pool=10.0.0.30-10.0.0.20"},
+			wantErr: true,
+			errMsg:  "invalid pool",
+		},
+		{
+			name:    "overlapping pools",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "pool=10.0.0.10-10.0.0.20"},
+			wantErr: true,
+			errMsg:  "pools 10.0.0.1-10.0.0.10 and 10.0.0.10-10.0.0.20 overlap",
+		},
+		{
+			name:    "invalid exclusion",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "exclude=router"},
+			wantErr: true,
+			errMsg:  "invalid exclusion",
+		},
+		{
+			name:    "missing reservations file",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "reservations=/nonexistent/reservations.txt"},
+			wantErr: true,
+			errMsg:  "invalid reservations",
+		},
+		{
+			name:    "lease duration bounds and renewal times",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "min-lease=10m", "max-lease=720h", "t1=0.4", "t2=0.8"},
+			wantErr: false,
+		},
+		{
+			name:    "lease duration below minimum",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "min-lease=2h"},
+			wantErr: true,
+			errMsg:  "lease duration 1h0m0s is not between the minimum 2h0m0s and maximum 1h0m0s",
+		},
+		{
+			name:    "invalid maximum lease duration",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "max-lease=0s"},
+			wantErr: true,
+			errMsg:  "invalid maximum lease duration",
+		},
+		{
+			name:    "invalid renewal time ratio",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "t1=1.5"},
+			wantErr: true,
+			errMsg:  "invalid renewal time ratio",
+		},
+		{
+			name:    "renewal after rebinding",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "t1=0.9"},
+			wantErr: true,
+			errMsg:  "renewal time ratio 0.9 has to be lower than the rebinding time ratio 0.875",
+		},
+		{
+			name:    "lease history and admin endpoint",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "history=720h", "admin=127.0.0.1:0"},
+			wantErr: false,
+		},
+		{
+			name:    "bulk leasequery",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "bulk=127.0.0.1:0", "bulk-allow=127.0.0.1", "bulk-allow=10.1.0.0/16", "bulk-conns=8"},
+			wantErr: false,
+		},
+		{
+			name:    "bulk leasequery without requestors",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "bulk=127.0.0.1:0"},
+			wantErr: true,
+			errMsg:  "none are",
+		},
+		{
+			name:    "invalid bulk leasequery requestor",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "bulk-allow=relay"},
+			wantErr: true,
+			errMsg:  "invalid bulk leasequery requestor",
+		},
+		{
+			name:    "invalid bulk leasequery address",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "bulk=67"},
+			wantErr: true,
+			errMsg:  "invalid bulk leasequery address",
+		},
+		{
+			name:    "invalid bulk leasequery connections",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "bulk-conns=0"},
+			wantErr: true,
+			errMsg:  "invalid bulk leasequery connections",
+		},
+		{
+			name:    "rapid commit",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "rapid-commit=10.0.1.1-10.0.1.10", "pool=10.0.1.1-10.0.1.10", "rapid-commit=10.0.0.1-10.0.0.10"},
+			wantErr: false,
+		},
+		{
+			name:    "rapid commit everywhere",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "rapid-commit=all"},
+			wantErr: false,
+		},
+		{
+			name:    "rapid commit for part of a pool",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "rapid-commit=10.0.0.1-10.0.0.5"},
+			wantErr: true,
+			errMsg:  "10.0.0.1-10.0.0.5 is not a pool of the range",
+		},
+		{
+			name:    "invalid rapid commit pool",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "rapid-commit=yes"},
+			wantErr: true,
+			errMsg:  "invalid rapid commit pool",
+		},
+		{
+			name:    "forcerenew",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "forcerenew=10.0.0.254", "forcerenew-rate=50", "forcerenew-nonce=true"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid forcerenew server identifier",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "forcerenew=server"},
+			wantErr: true,
+			errMsg:  "invalid forcerenew server identifier",
+		},
+		{
+			name:    "invalid forcerenew rate",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "forcerenew-rate=0"},
+			wantErr: true,
+			errMsg:  "invalid forcerenew rate",
+		},
+		{
+			name:    "invalid forcerenew nonce",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "forcerenew-nonce=maybe"},
+			wantErr: true,
+			errMsg:  "invalid forcerenew nonce",
+		},
+		{
+			name:    "lease affinity",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "affinity=72h"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid lease affinity",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "affinity=-1h"},
+			wantErr: true,
+			errMsg:  "invalid lease affinity",
+		},
+		{
+			name:    "sticky allocation",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "allocation=sticky"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid allocation strategy",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "allocation=random"},
+			wantErr: true,
+			errMsg:  "invalid allocation strategy",
+		},
+		{
+			name:    "stale lease policy",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "stale=nak"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid stale lease policy",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "stale=forget"},
+			wantErr: true,
+			errMsg:  "invalid stale lease policy",
+		},
+		{
+			name:    "event webhooks",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "webhook=http://cmdb.example.com/leases", "webhook=https://dns.example.com/hook", "event-retries=2"},
+			wantErr: false,
+		},
+		{
+			name:    "invalid webhook URL",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "webhook=cmdb.example.com"},
+			wantErr: true,
+			errMsg:  "invalid webhook URL",
+		},
+		{
+			name:    "invalid event retries",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "event-retries=-1"},
+			wantErr: true,
+			errMsg:  "invalid event retries",
+		},
+		{
+			name:    "missing exec hook",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "exec=/nonexistent/hook"},
+			wantErr: true,
+			errMsg:  "invalid exec hook",
+		},
+		{
+			name:    "invalid history retention",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "history=forever"},
+			wantErr: true,
+			errMsg:  "invalid history retention",
+		},
+		{
+			name:    "invalid admin address",
+			args:    []string{":memory:", "10.0.0.1", "10.0.0.10", "1h", "admin=localhost"},
+			wantErr: true,
+			errMsg:  "invalid admin address",
+		},
 		{
 			name:    "IPv6 as start address",
 			args:    []string{":memory:", "2001:db8::1", "10.0.0.10", "1h"},
@@ -147,6 +400,29 @@ func TestHandler4ExistingLease(t *testing.T) {
 	assert.Equal(t, firstIP.String(), result2.YourIPAddr.String())
 }
 
+func TestShutdown(t *testing.T) {
+	// The lease is only queued within the commit window
+	path := filepath.Join(t.TempDir(), "leases.db")
+	handler, err := setupRange(path, "10.0.0.1", "10.0.0.10", "1h", "commit=1h")
+	require.NoError(t, err)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := handler(&dhcpv4.DHCPv4{ClientHWAddr: mac}, resp)
+	require.NotNil(t, result)
+	require.False(t, stop)
+
+	// Stopping writes it out and releases the database for the next server
+	Shutdown()
+	store, err := openLeaseStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+	records, err := store.Load()
+	require.NoError(t, err)
+	require.Contains(t, records, mac.String())
+	assert.Equal(t, result.YourIPAddr.String(), records[mac.String()].IP.String())
+}
+
 func TestHandler4LeaseRenewal(t *testing.T) {
 	// Setup plugin state with short lease time
 	_, err := setupRange(":memory:", "10.0.0.1", "10.0.0.10", "1s")
@@ -165,7 +441,7 @@ func TestHandler4LeaseRenewal(t *testing.T) {
 		expires: int(time.Now().Add(-1 * time.Hour).Unix()),
 	}
 	pluginState.Recordsv4[mac.String()] = expiredRecord
-	pluginState.saveIPAddress(mac, expiredRecord)
+	pluginState.saveIPAddress(mac.String(), expiredRecord)
 
 	// Request should renew the lease
 	req := &dhcpv4.DHCPv4{ClientHWAddr: mac}
@@ -247,20 +523,696 @@ func TestSetupRangeWithExistingLeases(t *testing.T) {
 	// Add some existing leases
 	mac1, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
 	rec1 := &Record{IP: net.IPv4(10, 0, 0, 2), expires: int(time.Now().Add(1 * time.Hour).Unix())}
-	err = pl.saveIPAddress(mac1, rec1)
+	err = pl.saveIPAddress(mac1.String(), rec1)
 	require.NoError(t, err)
 
 	mac2, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
 	rec2 := &Record{IP: net.IPv4(10, 0, 0, 3), expires: int(time.Now().Add(1 * time.Hour).Unix())}
-	err = pl.saveIPAddress(mac2, rec2)
+	err = pl.saveIPAddress(mac2.String(), rec2)
 	require.NoError(t, err)
 
 	// Now setup range - it should load existing leases
 	// Note: This test would need to use the same database file
 	// For simplicity, we're testing the concept
-	loadedRecords, err := loadRecords(pl.leasedb)
+	loadedRecords, err := pl.leasedb.Load()
 	require.NoError(t, err)
 	assert.Equal(t, 2, len(loadedRecords))
 	assert.NotNil(t, loadedRecords[mac1.String()])
 	assert.NotNil(t, loadedRecords[mac2.String()])
 }
+
+func TestSweep(t *testing.T) {
+	pl := &PluginState{LeaseTime: time.Hour, GracePeriod: 10 * time.Minute}
+	require.NoError(t, pl.registerBackingDB(":memory:"))
+	var err error
+	pl.allocator, err = bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	pl.Recordsv4 = make(map[string]*Record)
+
+	now := time.Now()
+	leases := []struct {
+		mac     string
+		ip      net.IP
+		expires time.Time
+	}{
+		{"aa:bb:cc:dd:ee:01", net.IPv4(10, 0, 0, 1), now.Add(-time.Hour)},
+		{"aa:bb:cc:dd:ee:02", net.IPv4(10, 0, 0, 2), now.Add(-time.Minute)},
+		{"aa:bb:cc:dd:ee:03", net.IPv4(10, 0, 0, 3), now.Add(time.Hour)},
+	}
+	for _, l := range leases {
+		hwaddr, err := net.ParseMAC(l.mac)
+		require.NoError(t, err)
+		_, err = pl.allocator.Allocate(net.IPNet{IP: l.ip})
+		require.NoError(t, err)
+		rec := &Record{IP: l.ip, expires: int(l.expires.Unix())}
+		require.NoError(t, pl.saveIPAddress(hwaddr.String(), rec))
+		pl.Recordsv4[hwaddr.String()] = rec
+	}
+
+	// Only the lease that expired before the grace period is reclaimed
+	assert.Equal(t, 1, pl.sweep(now))
+	assert.NotContains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:01")
+	assert.Contains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:02")
+	assert.Contains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:03")
+
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Equal(t, pl.Recordsv4, stored)
+
+	// The reclaimed address is available again
+	ip, err := pl.allocator.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip.IP.String())
+
+	// Once the grace period is over the second lease goes too
+	assert.Equal(t, 1, pl.sweep(now.Add(10*time.Minute)))
+	assert.NotContains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:02")
+	assert.Equal(t, 0, pl.sweep(now.Add(10*time.Minute)))
+}
+
+func TestHandler4AfterSweep(t *testing.T) {
+	pl := &PluginState{LeaseTime: time.Hour}
+	require.NoError(t, pl.registerBackingDB(":memory:"))
+	var err error
+	pl.allocator, err = bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 1))
+	require.NoError(t, err)
+	pl.Recordsv4 = make(map[string]*Record)
+
+	first := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}}
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(first, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+
+	// The pool is exhausted until the first lease is reclaimed
+	second := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}}
+	resp, err = dhcpv4.New()
+	require.NoError(t, err)
+	result, stop = pl.Handler4(second, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+
+	assert.Equal(t, 1, pl.sweep(time.Now().Add(2*time.Hour)))
+
+	resp, err = dhcpv4.New()
+	require.NoError(t, err)
+	result, stop = pl.Handler4(second, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	assert.Equal(t, "10.0.0.1", result.YourIPAddr.String())
+}
+
+func TestHandler4Affinity(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 2))
+	pl.Affinity = 24 * time.Hour
+	pl.history = pl.leasedb.(LeaseHistory)
+	first := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	second := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	third := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	ips := map[string]net.IP{
+		first.String():  lease(t, pl, first),
+		second.String(): lease(t, pl, second),
+	}
+	now := time.Now()
+	expire := func(mac net.HardwareAddr, ago time.Duration) {
+		t.Helper()
+		record := pl.Recordsv4[mac.String()]
+		record.expires = int(now.Add(-ago).Unix())
+		require.NoError(t, pl.saveIPAddress(mac.String(), record))
+	}
+	expire(first, 2*time.Hour)
+	expire(second, time.Hour)
+
+	// Expired leases stay with their clients, which get their address back
+	assert.Equal(t, 0, pl.sweep(now))
+	assert.Equal(t, ips[first.String()], lease(t, pl, first))
+	expire(first, 2*time.Hour)
+
+	// Once the pool is exhausted the lease that expired first is reclaimed
+	assert.Equal(t, ips[first.String()], lease(t, pl, third))
+	assert.NotContains(t, pl.Recordsv4, first.String())
+	assert.Contains(t, pl.Recordsv4, second.String())
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.NotContains(t, stored, first.String())
+	entries, err := pl.History(HistoryQuery{MAC: first.String(), Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, EventExpire, entries[0].Event)
+
+	// The client of the reclaimed lease gets the next expired address
+	assert.Equal(t, ips[second.String()], lease(t, pl, first))
+
+	// Leases that did not expire are never reclaimed
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(&dhcpv4.DHCPv4{ClientHWAddr: second}, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+
+	// The sweeper reclaims expired leases once the affinity is over
+	expire(third, 25*time.Hour)
+	assert.Equal(t, 1, pl.sweep(now))
+	assert.NotContains(t, pl.Recordsv4, third.String())
+}
+
+// newTestPluginState returns a plugin state backed by an in-memory database
+// with a pool from 10.0.0.1 to end
+func newTestPluginState(t *testing.T, end net.IP) *PluginState {
+	t.Helper()
+	pl := &PluginState{
+		LeaseTime:      time.Hour,
+		MinLeaseTime:   time.Hour,
+		MaxLeaseTime:   time.Hour,
+		RenewalRatio:   defaultRenewalRatio,
+		RebindingRatio: defaultRebindingRatio,
+		DeclineTime:    time.Hour,
+		OfferTime:      time.Minute,
+	}
+	require.NoError(t, pl.registerBackingDB(":memory:"))
+	var err error
+	pl.allocator, err = bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), end)
+	require.NoError(t, err)
+	pl.pools = []ipRange{{start: ipToUint32(net.IPv4(10, 0, 0, 1)), end: ipToUint32(end)}}
+	pl.Recordsv4 = make(map[string]*Record)
+	pl.Offersv4 = make(map[string]*Record)
+	pl.Quarantinev4 = make(map[string]int)
+	return pl
+}
+
+// lease runs a request without message type through the handler and returns
+// the leased address
+func lease(t *testing.T, pl *PluginState, mac net.HardwareAddr) net.IP {
+	t.Helper()
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(&dhcpv4.DHCPv4{ClientHWAddr: mac}, resp)
+	require.NotNil(t, result)
+	require.False(t, stop)
+	return result.YourIPAddr
+}
+
+func TestHandler4Release(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 1))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+
+	// A release for another address is ignored
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 99)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+	assert.Contains(t, pl.Recordsv4, mac.String())
+
+	req.ClientIPAddr = ip
+	result, stop = pl.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+	assert.NotContains(t, pl.Recordsv4, mac.String())
+
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// The address is immediately available to another client
+	other := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	assert.Equal(t, ip.String(), lease(t, pl, other).String())
+}
+
+func TestHandler4Decline(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 2))
+	pl.DeclineTime = 10 * time.Minute
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+	assert.NotContains(t, pl.Recordsv4, mac.String())
+	assert.Contains(t, pl.Quarantinev4, ip.String())
+
+	quarantine, err := pl.leasedb.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, pl.Quarantinev4, quarantine)
+
+	// The declining client gets another address, the declined one is not handed out
+	next := lease(t, pl, mac)
+	assert.NotEqual(t, ip.String(), next.String())
+	resp, err = dhcpv4.New()
+	require.NoError(t, err)
+	result, stop = pl.Handler4(&dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}}, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+
+	// Once the quarantine is over the address is back in the pool
+	assert.Equal(t, 1, pl.sweep(time.Now().Add(20*time.Minute)))
+	assert.Empty(t, pl.Quarantinev4)
+	quarantine, err = pl.leasedb.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Empty(t, quarantine)
+	assert.Equal(t, ip.String(), lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}).String())
+}
+
+func TestHandler4DeclineNotLeased(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 2))
+	owner := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, owner)
+
+	// Another client cannot decline an address it does not hold
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.New()
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+	assert.Contains(t, pl.Recordsv4, owner.String())
+	assert.Empty(t, pl.Quarantinev4)
+}
+
+func TestHandler4Inform(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	leased := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, leased)
+	expires := pl.Recordsv4[leased.String()].expires
+	inform := func(mac net.HardwareAddr, ciaddr net.IP) (*dhcpv4.DHCPv4, bool) {
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+			dhcpv4.WithClientIP(ciaddr),
+		)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req,
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Hour)),
+		)
+		require.NoError(t, err)
+		return pl.Handler4(req, resp)
+	}
+
+	// A statically addressed client gets the reply without an address or a
+	// lease, for the next plugins to add their options
+	static := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	result, stop := inform(static, net.IPv4(192, 168, 0, 5))
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeAck, result.MessageType())
+	assert.Equal(t, "192.168.0.5", result.ClientIPAddr.String())
+	assert.True(t, result.YourIPAddr.IsUnspecified())
+	assert.False(t, result.Options.Has(dhcpv4.OptionIPAddressLeaseTime))
+	assert.NotContains(t, pl.Recordsv4, static.String())
+	assert.Empty(t, pl.Offersv4)
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+
+	// A client with a lease keeps it as it is
+	result, _ = inform(leased, ip)
+	require.NotNil(t, result)
+	assert.Equal(t, expires, pl.Recordsv4[leased.String()].expires)
+
+	// Nothing was allocated
+	assert.Equal(t, "10.0.0.2", lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}).String())
+
+	// Replicas on standby leave it to the leader
+	pl.standby = true
+	result, stop = inform(static, net.IPv4(192, 168, 0, 5))
+	assert.Nil(t, result)
+	assert.True(t, stop)
+}
+
+func TestHandler4DiscoverRequestedIP(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+
+	discover := func(mac net.HardwareAddr, ip net.IP) net.IP {
+		req, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		result, stop := pl.Handler4(req, resp)
+		require.NotNil(t, result)
+		require.False(t, stop)
+		return result.YourIPAddr
+	}
+
+	// A free address in range is offered
+	assert.Equal(t, "10.0.0.7", discover(mac, net.IPv4(10, 0, 0, 7)).String())
+	// A taken address is not, another one is offered instead
+	other := discover(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}, net.IPv4(10, 0, 0, 7))
+	assert.NotEqual(t, "10.0.0.7", other.String())
+	// Neither is an address outside of the range
+	assert.True(t, pl.inRange(discover(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}, net.IPv4(192, 168, 0, 7))))
+}
+
+func TestHandler4Request(t *testing.T) {
+	self := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	other := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+
+	tests := []struct {
+		name string
+		// requested is sent in the requested IP address option, ciaddr as the client address
+		requested net.IP
+		ciaddr    net.IP
+		wantIP    net.IP
+		wantNak   bool
+	}{
+		{
+			name:      "init-reboot with own address",
+			requested: net.IPv4(10, 0, 0, 3),
+			wantIP:    net.IPv4(10, 0, 0, 3),
+		},
+		{
+			name:   "renewing with own address",
+			ciaddr: net.IPv4(10, 0, 0, 3),
+			wantIP: net.IPv4(10, 0, 0, 3),
+		},
+		{
+			name:      "init-reboot from another network",
+			requested: net.IPv4(192, 168, 1, 3),
+			wantNak:   true,
+		},
+		{
+			name:    "rebinding from another network",
+			ciaddr:  net.IPv4(192, 168, 1, 3),
+			wantNak: true,
+		},
+		{
+			name:      "address leased to another client",
+			requested: net.IPv4(10, 0, 0, 4),
+			wantNak:   true,
+		},
+		{
+			name:      "other address than the leased one",
+			requested: net.IPv4(10, 0, 0, 6),
+			wantNak:   true,
+		},
+		{
+			name:      "quarantined address",
+			requested: net.IPv4(10, 0, 0, 5),
+			wantNak:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+			for _, l := range []struct {
+				mac net.HardwareAddr
+				ip  net.IP
+			}{{self, net.IPv4(10, 0, 0, 3)}, {other, net.IPv4(10, 0, 0, 4)}} {
+				require.NoError(t, pl.reallocate(l.ip))
+				pl.Recordsv4[l.mac.String()] = &Record{IP: l.ip.To4(), expires: int(time.Now().Add(time.Hour).Unix())}
+			}
+			require.NoError(t, pl.reallocate(net.IPv4(10, 0, 0, 5)))
+			pl.Quarantinev4["10.0.0.5"] = int(time.Now().Add(time.Hour).Unix())
+
+			modifiers := []dhcpv4.Modifier{
+				dhcpv4.WithHwAddr(self),
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			}
+			if tt.requested != nil {
+				modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(tt.requested)))
+			}
+			if tt.ciaddr != nil {
+				modifiers = append(modifiers, dhcpv4.WithClientIP(tt.ciaddr))
+			}
+			req, err := dhcpv4.New(modifiers...)
+			require.NoError(t, err)
+			resp, err := dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 254))),
+				dhcpv4.WithOption(dhcpv4.OptDNS(net.IPv4(8, 8, 8, 8))),
+			)
+			require.NoError(t, err)
+
+			result, stop := pl.Handler4(req, resp)
+			require.NotNil(t, result)
+			if tt.wantNak {
+				assert.True(t, stop)
+				assert.Equal(t, dhcpv4.MessageTypeNak, result.MessageType())
+				assert.True(t, result.YourIPAddr.IsUnspecified())
+				assert.Nil(t, result.Options.Get(dhcpv4.OptionIPAddressLeaseTime))
+				assert.Nil(t, result.Options.Get(dhcpv4.OptionDomainNameServer))
+				assert.NotEmpty(t, result.Message())
+				assert.Equal(t, "10.0.0.254", result.ServerIdentifier().String())
+				// Nothing changed for the client
+				assert.Equal(t, "10.0.0.3", pl.Recordsv4[self.String()].IP.String())
+			} else {
+				assert.False(t, stop)
+				assert.Equal(t, dhcpv4.MessageTypeAck, result.MessageType())
+				assert.Equal(t, tt.wantIP.String(), result.YourIPAddr.String())
+			}
+		})
+	}
+}
+
+func TestHandler4RequestWithoutLease(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+
+	// A client renewing an address we have no lease for, e.g. after losing
+	// the lease database, keeps it if it is free
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 8)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	assert.Equal(t, "10.0.0.8", result.YourIPAddr.String())
+	assert.Equal(t, "10.0.0.8", pl.Recordsv4[mac.String()].IP.String())
+}
+
+// discover sends a DHCPDISCOVER through the handler, with the reply carrying
+// serverID as the server identifier
+func discover(t *testing.T, pl *PluginState, mac net.HardwareAddr, serverID net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	req, err := dhcpv4.NewDiscovery(mac)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+	)
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	require.NotNil(t, result)
+	require.False(t, stop)
+	return result
+}
+
+// request sends the DHCPREQUEST following an offer through the handler, with
+// the client selecting selectedID and the reply carrying serverID as the
+// server identifier
+func request(t *testing.T, pl *PluginState, offer *dhcpv4.DHCPv4, selectedID, serverID net.IP) (*dhcpv4.DHCPv4, bool) {
+	t.Helper()
+	req, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(selectedID)))
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+	)
+	require.NoError(t, err)
+	return pl.Handler4(req, resp)
+}
+
+func TestHandler4OfferCommit(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	serverID := net.IPv4(10, 0, 0, 254)
+
+	offer := discover(t, pl, mac, serverID)
+	assert.Contains(t, pl.Offersv4, mac.String())
+	assert.NotContains(t, pl.Recordsv4, mac.String())
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored, "an offer must not be written to storage")
+
+	// Discovering again offers the same address
+	assert.Equal(t, offer.YourIPAddr.String(), discover(t, pl, mac, serverID).YourIPAddr.String())
+
+	ack, stop := request(t, pl, offer, serverID, serverID)
+	require.NotNil(t, ack)
+	assert.False(t, stop)
+	assert.Equal(t, offer.YourIPAddr.String(), ack.YourIPAddr.String())
+	assert.NotContains(t, pl.Offersv4, mac.String())
+	assert.Contains(t, pl.Recordsv4, mac.String())
+	stored, err = pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Equal(t, offer.YourIPAddr.String(), stored[mac.String()].IP.String())
+}
+
+func TestHandler4OfferOtherServerSelected(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 1))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	serverID := net.IPv4(10, 0, 0, 254)
+
+	offer := discover(t, pl, mac, serverID)
+	result, stop := request(t, pl, offer, net.IPv4(10, 0, 0, 253), serverID)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+	assert.Empty(t, pl.Offersv4)
+	assert.Empty(t, pl.Recordsv4)
+
+	// The offered address went back to the pool
+	other := discover(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}, serverID)
+	assert.Equal(t, offer.YourIPAddr.String(), other.YourIPAddr.String())
+}
+
+func TestHandler4OfferExpiry(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 1))
+	serverID := net.IPv4(10, 0, 0, 254)
+	offer := discover(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}, serverID)
+
+	// The only address is held for the first client
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02})
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+
+	// Another client gets it once the offer is stale, even before the sweeper runs
+	pl.Offersv4[offer.ClientHWAddr.String()].expires = int(time.Now().Add(-time.Second).Unix())
+	other := discover(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}, serverID)
+	assert.Equal(t, offer.YourIPAddr.String(), other.YourIPAddr.String())
+
+	// A request for the withdrawn offer is refused
+	result, stop = request(t, pl, offer, serverID, serverID)
+	require.NotNil(t, result)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, result.MessageType())
+
+	// The sweeper withdraws stale offers too
+	assert.Equal(t, 1, pl.sweep(time.Now().Add(2*time.Minute)))
+	assert.Empty(t, pl.Offersv4)
+}
+
+// sharedStore adds claims to the memory store, standing in for a store that
+// several servers share
+type sharedStore struct {
+	*memoryStore
+}
+
+func (s sharedStore) Claim(mac string, record *Record) (*Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+	if expires, ok := s.quarantine[record.IP.String()]; ok {
+		return &Lease{Record: Record{IP: record.IP, expires: expires}}, nil
+	}
+	for holder, stored := range s.records {
+		if holder != mac && stored.IP.Equal(record.IP) && int64(stored.expires) >= time.Now().Unix() {
+			return &Lease{MAC: holder, Record: stored}, nil
+		}
+	}
+	s.records[mac] = *record
+	return nil, nil
+}
+
+func TestHandler4SharedStore(t *testing.T) {
+	store := sharedStore{newMemoryStore()}
+	servers := make([]*PluginState, 2)
+	for i := range servers {
+		servers[i] = newTestPluginState(t, net.IPv4(10, 0, 0, 3))
+		servers[i].leasedb = store
+	}
+	serverID := net.IPv4(10, 0, 0, 254)
+	mac1 := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	mac2 := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+
+	ack, _ := request(t, servers[0], discover(t, servers[0], mac1, serverID), serverID, serverID)
+	require.NotNil(t, ack)
+	assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+	assert.Equal(t, "10.0.0.1", ack.YourIPAddr.String())
+
+	// The second server does not know the address is leased yet
+	offer := discover(t, servers[1], mac2, serverID)
+	assert.Equal(t, "10.0.0.1", offer.YourIPAddr.String())
+	nak, stop := request(t, servers[1], offer, serverID, serverID)
+	require.NotNil(t, nak)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assert.Contains(t, servers[1].Recordsv4, mac1.String(), "the lease of the other server is adopted")
+
+	// Starting over, the client gets another address
+	ack, _ = request(t, servers[1], discover(t, servers[1], mac2, serverID), serverID, serverID)
+	require.NotNil(t, ack)
+	assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+	assert.Equal(t, "10.0.0.2", ack.YourIPAddr.String())
+
+	// Quarantines of the other server are adopted as well
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 3), int(time.Now().Add(time.Hour).Unix())))
+	mac3 := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	nak, _ = request(t, servers[1], discover(t, servers[1], mac3, serverID), serverID, serverID)
+	require.NotNil(t, nak)
+	assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assert.Contains(t, servers[1].Quarantinev4, "10.0.0.3")
+}
+
+func TestHandler4LeaseDetails(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	request := func() {
+		t.Helper()
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithOption(dhcpv4.OptHostName("laptop")),
+		)
+		require.NoError(t, err)
+		// The kubevirt plugin names the VMI in the reply
+		resp, err := dhcpv4.New(dhcpv4.WithOption(dhcpv4.OptHostName("vmi-1")))
+		require.NoError(t, err)
+		result, _ := pl.Handler4(req, resp)
+		require.NotNil(t, result)
+	}
+
+	request()
+	record := pl.Recordsv4[mac.String()]
+	require.NotNil(t, record)
+	assert.Equal(t, "laptop", record.Hostname)
+	assert.Equal(t, mac.String(), record.HWAddr)
+	assert.Equal(t, "vmi-1", record.VMI)
+	assert.Equal(t, LeaseBound, record.State)
+	assert.NotZero(t, record.firstSeen)
+	assert.Equal(t, record.firstSeen, record.lastSeen)
+
+	// A renewal keeps when the client was first seen
+	record.firstSeen -= 100
+	record.lastSeen -= 100
+	firstSeen := record.firstSeen
+	request()
+	record = pl.Recordsv4[mac.String()]
+	assert.Equal(t, firstSeen, record.firstSeen)
+	assert.Greater(t, record.lastSeen, firstSeen)
+
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	require.Contains(t, stored, mac.String())
+	stored[mac.String()].IP = stored[mac.String()].IP.To4()
+	assert.Equal(t, *record, *stored[mac.String()])
+}
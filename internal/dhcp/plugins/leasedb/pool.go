@@ -0,0 +1,195 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	start, end uint32
+}
+
+// parseIPRange parses a range of addresses like 10.0.0.10-10.0.0.20, or a
+// single address
+func parseIPRange(s string) (ipRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start := net.ParseIP(first).To4()
+	if start == nil {
+		return ipRange{}, fmt.Errorf("invalid IPv4 address: %v", first)
+	}
+	if !isRange {
+		return ipRange{start: ipToUint32(start), end: ipToUint32(start)}, nil
+	}
+	end := net.ParseIP(last).To4()
+	if end == nil {
+		return ipRange{}, fmt.Errorf("invalid IPv4 address: %v", last)
+	}
+	r := ipRange{start: ipToUint32(start), end: ipToUint32(end)}
+	if r.start > r.end {
+		return ipRange{}, fmt.Errorf("start of IP range %s is higher than its end", s)
+	}
+	return r, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// contains reports whether ip is in the range
+func (r ipRange) contains(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := ipToUint32(ip)
+	return n >= r.start && n <= r.end
+}
+
+// overlaps reports whether the ranges have addresses in common
+func (r ipRange) overlaps(other ipRange) bool {
+	return r.start <= other.end && other.start <= r.end
+}
+
+func (r ipRange) String() string {
+	if r.start == r.end {
+		return uint32ToIP(r.start).String()
+	}
+	return uint32ToIP(r.start).String() + "-" + uint32ToIP(r.end).String()
+}
+
+// leasable reports whether ip belongs to one of the pools and is not excluded
+func leasable(ip net.IP, pools, exclusions []ipRange) bool {
+	for _, excluded := range exclusions {
+		if excluded.contains(ip) {
+			return false
+		}
+	}
+	for _, pool := range pools {
+		if pool.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolAllocator hands out the addresses of several pools, the first pool with
+// a free address in the order they are configured. Excluded and reserved
+// addresses are never handed out.
+type poolAllocator struct {
+	pools      []ipRange
+	exclusions []ipRange
+	allocators []*bitmap.IPv4Allocator
+	// reserved holds the addresses reserved for clients, they stay allocated
+	reserved map[uint32]bool
+}
+
+// newPoolAllocator creates an allocator for disjoint pools
+func newPoolAllocator(pools, exclusions []ipRange, reserved []net.IP) (*poolAllocator, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("no pool to allocate from")
+	}
+	a := &poolAllocator{pools: pools, exclusions: exclusions, reserved: make(map[uint32]bool, len(reserved))}
+	for i, pool := range pools {
+		for _, other := range pools[:i] {
+			if pool.overlaps(other) {
+				return nil, fmt.Errorf("pools %s and %s overlap", other, pool)
+			}
+		}
+		alloc, err := bitmap.NewIPv4Allocator(uint32ToIP(pool.start), uint32ToIP(pool.end))
+		if err != nil {
+			return nil, err
+		}
+		// Excluded addresses are taken for good
+		for _, excluded := range exclusions {
+			if !pool.overlaps(excluded) {
+				continue
+			}
+			for n := max(pool.start, excluded.start); n <= min(pool.end, excluded.end); n++ {
+				if _, err := alloc.Allocate(net.IPNet{IP: uint32ToIP(n)}); err != nil {
+					return nil, fmt.Errorf("could not exclude %s: %w", uint32ToIP(n), err)
+				}
+				if n == ^uint32(0) {
+					break
+				}
+			}
+		}
+		a.allocators = append(a.allocators, alloc)
+	}
+	for _, ip := range reserved {
+		a.reserved[ipToUint32(ip)] = true
+		i := a.pool(ip)
+		if i < 0 || !leasable(ip, pools, exclusions) {
+			// Addresses outside of the pools are not handed out anyway
+			continue
+		}
+		if _, err := a.allocators[i].Allocate(net.IPNet{IP: ip}); err != nil {
+			return nil, fmt.Errorf("could not reserve %s: %w", ip, err)
+		}
+	}
+	return a, nil
+}
+
+// pool returns the index of the pool ip belongs to, or -1
+func (a *poolAllocator) pool(ip net.IP) int {
+	for i, pool := range a.pools {
+		if pool.contains(ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Allocate hands out hint if it is free, otherwise the first free address of
+// the pools in order
+func (a *poolAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	if i := a.pool(hint.IP); i >= 0 && leasable(hint.IP, a.pools, a.exclusions) {
+		n, err := a.allocators[i].Allocate(hint)
+		if err == nil {
+			if n.IP.Equal(hint.IP) {
+				return n, nil
+			}
+			if err := a.allocators[i].Free(n); err != nil {
+				return net.IPNet{}, err
+			}
+		}
+	}
+	for _, alloc := range a.allocators {
+		n, err := alloc.Allocate(net.IPNet{})
+		if errors.Is(err, allocators.ErrNoAddrAvail) {
+			continue
+		}
+		return n, err
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// Free returns an address to its pool. Reserved addresses stay allocated.
+func (a *poolAllocator) Free(n net.IPNet) error {
+	if n.IP.To4() != nil && a.reserved[ipToUint32(n.IP)] {
+		return nil
+	}
+	i := a.pool(n.IP)
+	if i < 0 {
+		return fmt.Errorf("IP %s is not in any pool", n.IP)
+	}
+	if !leasable(n.IP, a.pools, a.exclusions) {
+		return fmt.Errorf("IP %s is excluded", n.IP)
+	}
+	return a.allocators[i].Free(n)
+}
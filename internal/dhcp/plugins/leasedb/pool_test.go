@@ -0,0 +1,136 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantErr string
+	}{
+		{name: "range", s: "10.0.0.10-10.0.0.20", want: "10.0.0.10-10.0.0.20"},
+		{name: "single address", s: "10.0.0.1", want: "10.0.0.1"},
+		{name: "range of one address", s: "10.0.0.1-10.0.0.1", want: "10.0.0.1"},
+		{name: "reversed", s: "10.0.0.20-10.0.0.10", wantErr: "is higher than its end"},
+		{name: "invalid start", s: "router-10.0.0.10", wantErr: "invalid IPv4 address: router"},
+		{name: "invalid end", s: "10.0.0.1-", wantErr: "invalid IPv4 address"},
+		{name: "IPv6", s: "2001:db8::1", wantErr: "invalid IPv4 address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseIPRange(tt.s)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, r.String())
+		})
+	}
+}
+
+// mustParseIPRanges parses ranges for tests
+func mustParseIPRanges(t *testing.T, ss ...string) []ipRange {
+	t.Helper()
+	ranges := make([]ipRange, 0, len(ss))
+	for _, s := range ss {
+		r, err := parseIPRange(s)
+		require.NoError(t, err)
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func TestPoolAllocator(t *testing.T) {
+	a, err := newPoolAllocator(
+		mustParseIPRanges(t, "10.0.0.100-10.0.0.102", "10.0.0.10-10.0.0.11"),
+		mustParseIPRanges(t, "10.0.0.101", "10.0.0.11-10.0.0.20", "192.168.0.1"),
+		nil,
+	)
+	require.NoError(t, err)
+
+	// An excluded or foreign hint is ignored
+	n, err := a.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 101)})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.100", n.IP.String())
+	// A free hint in a later pool is honored
+	n, err = a.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 10)})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.10", n.IP.String())
+	// The pools are used in order once the hint is taken
+	n, err = a.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 10)})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.102", n.IP.String())
+	_, err = a.Allocate(net.IPNet{})
+	assert.ErrorIs(t, err, allocators.ErrNoAddrAvail)
+
+	require.NoError(t, a.Free(net.IPNet{IP: net.IPv4(10, 0, 0, 10)}))
+	n, err = a.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.10", n.IP.String())
+
+	assert.Error(t, a.Free(net.IPNet{IP: net.IPv4(10, 0, 0, 101)}), "excluded addresses are never freed")
+	assert.Error(t, a.Free(net.IPNet{IP: net.IPv4(10, 0, 0, 50)}))
+
+	_, err = newPoolAllocator(mustParseIPRanges(t, "10.0.0.1-10.0.0.10", "10.0.0.5-10.0.0.20"), nil, nil)
+	assert.ErrorContains(t, err, "overlap")
+}
+
+func TestLoadRevalidatesLeases(t *testing.T) {
+	pl := &PluginState{}
+	require.NoError(t, pl.registerBackingDB("memory://"))
+	expires := int(time.Now().Add(time.Hour).Unix())
+	leases := map[string]net.IP{
+		"aa:bb:cc:dd:ee:01": net.IPv4(10, 0, 0, 2),
+		"aa:bb:cc:dd:ee:02": net.IPv4(10, 0, 0, 3),
+		"aa:bb:cc:dd:ee:03": net.IPv4(10, 0, 0, 50),
+		"aa:bb:cc:dd:ee:04": net.IPv4(10, 0, 1, 7),
+	}
+	for mac, ip := range leases {
+		require.NoError(t, pl.leasedb.Upsert(mac, &Record{IP: ip, expires: expires}))
+	}
+
+	// The pool was split around the router at 10.0.0.3, 10.0.0.50 is not
+	// handed out anymore
+	pl.pools = mustParseIPRanges(t, "10.0.0.1-10.0.0.10", "10.0.1.1-10.0.1.10")
+	pl.exclusions = mustParseIPRanges(t, "10.0.0.3")
+	require.NoError(t, pl.load())
+	assert.Len(t, pl.Recordsv4, 2)
+	assert.Contains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:01")
+	assert.Contains(t, pl.Recordsv4, "aa:bb:cc:dd:ee:04")
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2, "dropped leases are removed from storage")
+
+	// The client of a dropped lease is refused when renewing
+	mac, err := net.ParseMAC("aa:bb:cc:dd:ee:02")
+	require.NoError(t, err)
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 3)),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	require.NotNil(t, result)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, result.MessageType())
+}
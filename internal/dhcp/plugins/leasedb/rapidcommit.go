@@ -0,0 +1,72 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// rapidCommitAll is the rapid-commit argument allowing rapid commit for all
+// the addresses handed out, reserved ones included
+const rapidCommitAll = "all"
+
+// parseRapidCommit adds the pools allowing rapid commit named by a
+// rapid-commit argument
+func (p *PluginState) parseRapidCommit(value string) error {
+	if value == rapidCommitAll {
+		p.rapidCommitAll = true
+		return nil
+	}
+	pool, err := parseIPRange(value)
+	if err != nil {
+		return fmt.Errorf("invalid rapid commit pool: %w", err)
+	}
+	p.rapidCommitPools = append(p.rapidCommitPools, pool)
+	return nil
+}
+
+// checkRapidCommit verifies that the pools allowing rapid commit are pools of
+// the range, once they are all known
+func (p *PluginState) checkRapidCommit() error {
+	for _, pool := range p.rapidCommitPools {
+		if !slices.Contains(p.pools, pool) {
+			return fmt.Errorf("invalid rapid commit pool: %s is not a pool of the range", pool)
+		}
+	}
+	return nil
+}
+
+// allowsRapidCommit reports whether an address may be leased with rapid
+// commit
+func (p *PluginState) allowsRapidCommit(ip net.IP) bool {
+	if p.rapidCommitAll {
+		return true
+	}
+	for _, pool := range p.rapidCommitPools {
+		if pool.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// discover answers a DHCPDISCOVER with an offer. A client asking for rapid
+// commit with option 80 is leased the address right away instead and answered
+// with a DHCPACK carrying option 80, RFC 4039, if its pool allows it. The
+// caller must hold the locks commit needs.
+func (p *PluginState) discover(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	reply, stop := p.offer(req, resp)
+	if reply == nil || !req.Options.Has(dhcpv4.OptionRapidCommit) || !p.allowsRapidCommit(reply.YourIPAddr) {
+		return reply, stop
+	}
+	log.Printf("Committing IP address %s for client %s right away, it asked for rapid commit", reply.YourIPAddr, clientKey(req))
+	reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRapidCommit, nil))
+	return p.commit(req, reply)
+}
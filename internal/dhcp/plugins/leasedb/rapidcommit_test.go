@@ -0,0 +1,88 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rapidDiscover runs a DHCPDISCOVER through the handler, asking for rapid
+// commit if rapid is set, and returns the reply
+func rapidDiscover(t *testing.T, pl *PluginState, mac net.HardwareAddr, rapid bool) *dhcpv4.DHCPv4 {
+	t.Helper()
+	modifiers := []dhcpv4.Modifier{dhcpv4.WithHwAddr(mac), dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}
+	if rapid {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRapidCommit, nil)))
+	}
+	req, err := dhcpv4.New(modifiers...)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	require.NoError(t, err)
+	reply, stop := pl.Handler4(req, resp)
+	require.NotNil(t, reply)
+	require.False(t, stop)
+	// The option is sent on the wire without a value
+	reply, err = dhcpv4.FromBytes(reply.ToBytes())
+	require.NoError(t, err)
+	return reply
+}
+
+func TestHandler4RapidCommit(t *testing.T) {
+	pool := ipRange{start: ipToUint32(net.IPv4(10, 0, 0, 1)), end: ipToUint32(net.IPv4(10, 0, 0, 10))}
+	other := ipRange{start: ipToUint32(net.IPv4(10, 0, 1, 1)), end: ipToUint32(net.IPv4(10, 0, 1, 10))}
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	tests := []struct {
+		name      string
+		pools     []ipRange
+		all       bool
+		rapid     bool
+		wantLease bool
+	}{
+		{name: "not allowed", rapid: true},
+		{name: "allowed in the pool", pools: []ipRange{pool}, rapid: true, wantLease: true},
+		{name: "allowed in another pool", pools: []ipRange{other}, rapid: true},
+		{name: "allowed everywhere", all: true, rapid: true, wantLease: true},
+		{name: "not asked for", pools: []ipRange{pool}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+			pl.rapidCommitPools = tt.pools
+			pl.rapidCommitAll = tt.all
+
+			reply := rapidDiscover(t, pl, mac, tt.rapid)
+			assert.Equal(t, "10.0.0.1", reply.YourIPAddr.String())
+			if !tt.wantLease {
+				assert.Equal(t, dhcpv4.MessageTypeOffer, reply.MessageType())
+				assert.False(t, reply.Options.Has(dhcpv4.OptionRapidCommit))
+				assert.Contains(t, pl.Offersv4, mac.String())
+				assert.NotContains(t, pl.Recordsv4, mac.String())
+				return
+			}
+			assert.Equal(t, dhcpv4.MessageTypeAck, reply.MessageType())
+			assert.True(t, reply.Options.Has(dhcpv4.OptionRapidCommit))
+			assert.Equal(t, pl.LeaseTime, reply.IPAddressLeaseTime(0))
+			assert.NotContains(t, pl.Offersv4, mac.String())
+			require.Contains(t, pl.Recordsv4, mac.String())
+			stored, err := pl.leasedb.Load()
+			require.NoError(t, err)
+			assert.Contains(t, stored, mac.String())
+
+			// A client coming back with its lease gets it extended right
+			// away too
+			pl.Recordsv4[mac.String()].expires--
+			expires := pl.Recordsv4[mac.String()].expires
+			reply = rapidDiscover(t, pl, mac, true)
+			assert.Equal(t, dhcpv4.MessageTypeAck, reply.MessageType())
+			assert.Equal(t, "10.0.0.1", reply.YourIPAddr.String())
+			assert.Greater(t, pl.Recordsv4[mac.String()].expires, expires)
+		})
+	}
+}
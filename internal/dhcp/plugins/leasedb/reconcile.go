@@ -0,0 +1,236 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// StalePolicy is what becomes of the stored leases that do not fit the range
+// anymore when the plugin starts, because its pools or reservations changed
+// since they were handed out
+type StalePolicy string
+
+const (
+	// StaleDrop drops the leases on startup, the clients are refused when
+	// they ask for their address again and get another one
+	StaleDrop StalePolicy = "drop"
+	// StaleKeep serves the leases as they are until they expire, without
+	// renewing them
+	StaleKeep StalePolicy = "keep"
+	// StaleNAK keeps the leases until the clients ask for their address
+	// again, which is refused
+	StaleNAK StalePolicy = "nak"
+)
+
+// parseStalePolicy returns the stale policy named s
+func parseStalePolicy(s string) (StalePolicy, error) {
+	switch policy := StalePolicy(s); policy {
+	case StaleDrop, StaleKeep, StaleNAK:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid stale lease policy: %v", s)
+}
+
+// leaseFit is how a stored lease fits the pools and reservations of the plugin
+type leaseFit string
+
+const (
+	fitInRange     leaseFit = "in range"
+	fitOutOfRange  leaseFit = "out of range"
+	fitConflicting leaseFit = "conflicting"
+)
+
+// staleLease is a lease that does not fit the range anymore, kept following
+// the stale policy
+type staleLease struct {
+	// reason is why the lease does not fit
+	reason string
+	// allocated is set if the address was allocated for the lease, which
+	// it is unless it is not ours to hand out or another client holds it
+	allocated bool
+}
+
+// reconcileReport counts the stored leases by how they fit the range
+type reconcileReport map[leaseFit]int
+
+func (r reconcileReport) String() string {
+	return fmt.Sprintf("%d in range, %d out of range, %d conflicting",
+		r[fitInRange], r[fitOutOfRange], r[fitConflicting])
+}
+
+// reconcile sets the leases of the plugin from the stored records, checking
+// them against the pools and reservations, and allocates their addresses.
+// Leases of addresses not in the pools anymore are out of range. Leases of
+// addresses reserved for another client, of clients with another reservation,
+// or of addresses that were leased to several clients are conflicting; the
+// client seen last keeps the address. The leases that do not fit are dropped
+// or kept following the stale policy, dropped leases expire in the lease
+// history. The caller must hold the plugin lock, if the plugin is running.
+func (p *PluginState) reconcile(records map[string]*Record) reconcileReport {
+	report := make(reconcileReport)
+	p.Recordsv4 = make(map[string]*Record, len(records))
+	p.stale = make(map[string]staleLease)
+
+	clients := make([]string, 0, len(records))
+	for client := range records {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := records[clients[i]], records[clients[j]]
+		if a.lastSeen != b.lastSeen {
+			return a.lastSeen > b.lastSeen
+		}
+		if a.expires != b.expires {
+			return a.expires > b.expires
+		}
+		return clients[i] < clients[j]
+	})
+
+	// The leases that fit get their address first, the stale leases may only
+	// keep the addresses nobody else holds
+	holders := make(map[string]string, len(records))
+	var stale []string
+	for _, client := range clients {
+		record := records[client]
+		fit, reason := p.fit(client, record, holders)
+		report[fit]++
+		if fit == fitInRange {
+			p.Recordsv4[client] = record
+			holders[record.IP.String()] = client
+			continue
+		}
+		log.Warningf("Lease of IP %s for client %s is %s, %s: %s", record.IP, client, fit, p.staleAction(), reason)
+		p.stale[client] = staleLease{reason: reason}
+		stale = append(stale, client)
+	}
+	now := time.Now()
+	for _, client := range stale {
+		record := records[client]
+		if p.StalePolicy != StaleKeep && p.StalePolicy != StaleNAK {
+			if err := p.deleteIPAddress(client, record); err != nil {
+				log.Errorf("Could not drop lease of IP %s for client %s: %v", record.IP, client, err)
+			}
+			p.journal(EventExpire, client, record, now)
+			delete(p.stale, client)
+			continue
+		}
+		p.Recordsv4[client] = record
+		if _, held := holders[record.IP.String()]; held || !p.inRange(record.IP) || p.reservedFor(record.IP) != "" {
+			continue
+		}
+		if err := p.reallocate(record.IP); err != nil {
+			log.Warningf("Could not keep IP %s allocated for client %s: %v", record.IP, client, err)
+			continue
+		}
+		holders[record.IP.String()] = client
+		p.stale[client] = staleLease{reason: p.stale[client].reason, allocated: true}
+	}
+	return report
+}
+
+// fit reports how the lease of a client fits the range and why it does not,
+// allocating its address if it does. holders are the clients of the addresses
+// allocated so far.
+func (p *PluginState) fit(client string, record *Record, holders map[string]string) (leaseFit, string) {
+	mac := record.HWAddr
+	if mac == "" {
+		// Leases stored without their hardware address are keyed by it
+		mac = client
+	}
+	reserved, hasReservation := p.reservations[mac]
+	switch owner := p.reservedFor(record.IP); {
+	case hasReservation && reserved.IP.Equal(record.IP):
+		// The allocator keeps reserved addresses allocated
+		return fitInRange, ""
+	case hasReservation:
+		return fitConflicting, fmt.Sprintf("the client has IP %s reserved", reserved.IP)
+	case owner != "" && owner != mac:
+		return fitConflicting, fmt.Sprintf("address %s is reserved for MAC %s", record.IP, owner)
+	case !p.inRange(record.IP):
+		return fitOutOfRange, fmt.Sprintf("address %s is not in the pools anymore", record.IP)
+	}
+	if holder, ok := holders[record.IP.String()]; ok {
+		return fitConflicting, fmt.Sprintf("address %s is leased to client %s", record.IP, holder)
+	}
+	if err := p.reallocate(record.IP); err != nil {
+		return fitConflicting, fmt.Sprintf("address %s cannot be allocated: %v", record.IP, err)
+	}
+	return fitInRange, ""
+}
+
+// staleAction describes what the stale policy does with a stale lease
+func (p *PluginState) staleAction() string {
+	switch p.StalePolicy {
+	case StaleKeep:
+		return "keeping it until it expires"
+	case StaleNAK:
+		return "refusing it when the client asks for it"
+	}
+	return "dropping it"
+}
+
+// serveStale answers a client whose lease does not fit the range anymore,
+// following the stale policy. A kept lease is served as it is until it
+// expires. Otherwise the lease is dropped and the client is refused if it asks
+// for the address again, the other requests are then handled like those of a
+// new client. It reports whether it answered. The caller must hold the plugin
+// lock.
+func (p *PluginState) serveStale(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool, bool) {
+	client := clientKey(req)
+	stale, ok := p.stale[client]
+	if !ok {
+		return nil, false, false
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeNone:
+	default:
+		return nil, false, false
+	}
+	if sid := req.ServerIdentifier(); sid != nil && resp.ServerIdentifier() != nil && !sid.Equal(resp.ServerIdentifier()) {
+		// The client selected another server
+		return nil, false, false
+	}
+	record := p.Recordsv4[client]
+	wanted := requestedIP(req)
+	remaining := time.Until(time.Unix(int64(record.expires), 0))
+	if p.StalePolicy == StaleKeep && remaining >= time.Second && (wanted == nil || wanted.Equal(record.IP)) {
+		resp.YourIPAddr = record.IP
+		p.setLeaseTime(resp, remaining)
+		log.Printf("found IP address %s for client %s, kept until it expires in %s", record.IP, client, remaining.Round(time.Second))
+		return resp, false, true
+	}
+	if err := p.deleteIPAddress(client, record); err != nil {
+		log.Errorf("Could not drop lease of IP %s for client %s: %v", record.IP, client, err)
+	}
+	delete(p.Recordsv4, client)
+	p.freeLease(client, record.IP)
+	p.journal(EventExpire, client, record, time.Now())
+	log.Printf("Dropped lease of IP %s for client %s, %s", record.IP, client, stale.reason)
+	if req.MessageType() == dhcpv4.MessageTypeRequest && record.IP.Equal(wanted) {
+		return nak(req, resp, stale.reason), true, true
+	}
+	return nil, false, false
+}
+
+// freeLease returns the address of a lease that ended to the allocator, unless
+// another client holds it. Stale leases only free their address if it was
+// allocated for them. The caller must hold the plugin lock and have removed
+// the lease from Recordsv4.
+func (p *PluginState) freeLease(client string, ip net.IP) {
+	stale, isStale := p.stale[client]
+	delete(p.stale, client)
+	if isStale && !stale.allocated || p.leaseholder(ip) != "" {
+		return
+	}
+	if err := p.allocator.Free(net.IPNet{IP: ip}); err != nil {
+		log.Warningf("Could not free IP %s of client %s: %v", ip, client, err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStalePluginState returns a plugin state with a pool from 10.0.0.1 to
+// 10.0.0.10, 10.0.0.1 being reserved for aa:bb:cc:dd:ee:05, whose store holds
+// a lease that fits and leases not fitting in all the ways a lease may not
+func newStalePluginState(t *testing.T, policy StalePolicy) *PluginState {
+	t.Helper()
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.StalePolicy = policy
+	pl.reservations = map[string]reservation{"aa:bb:cc:dd:ee:05": {IP: net.IPv4(10, 0, 0, 1).To4()}}
+	var err error
+	pl.allocator, err = newPoolAllocator(pl.pools, nil, []net.IP{net.IPv4(10, 0, 0, 1).To4()})
+	require.NoError(t, err)
+	now := time.Now()
+	leases := []struct {
+		client string
+		ip     net.IP
+		seen   time.Time
+	}{
+		{"aa:bb:cc:dd:ee:01", net.IPv4(10, 0, 0, 2), now},
+		// The range shrank
+		{"aa:bb:cc:dd:ee:02", net.IPv4(10, 0, 0, 50), now},
+		// The address was reserved since
+		{"aa:bb:cc:dd:ee:03", net.IPv4(10, 0, 0, 1), now},
+		// The address was leased twice, the client seen last keeps it
+		{"aa:bb:cc:dd:ee:04", net.IPv4(10, 0, 0, 2), now.Add(-time.Hour)},
+	}
+	for _, l := range leases {
+		require.NoError(t, pl.leasedb.Upsert(l.client, &Record{
+			IP:       l.ip,
+			expires:  int(now.Add(30 * time.Minute).Unix()),
+			lastSeen: int(l.seen.Unix()),
+		}))
+	}
+	return pl
+}
+
+func TestLoadStaleLeases(t *testing.T) {
+	tests := []struct {
+		policy      StalePolicy
+		wantLeases  []string
+		wantStale   []string
+		wantExpired []string
+	}{
+		{
+			policy:      StaleDrop,
+			wantLeases:  []string{"aa:bb:cc:dd:ee:01"},
+			wantExpired: []string{"aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03", "aa:bb:cc:dd:ee:04"},
+		},
+		{
+			policy:     StaleKeep,
+			wantLeases: []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03", "aa:bb:cc:dd:ee:04"},
+			wantStale:  []string{"aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03", "aa:bb:cc:dd:ee:04"},
+		},
+		{
+			policy:     StaleNAK,
+			wantLeases: []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03", "aa:bb:cc:dd:ee:04"},
+			wantStale:  []string{"aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03", "aa:bb:cc:dd:ee:04"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			pl := newStalePluginState(t, tt.policy)
+			pl.history = pl.leasedb.(LeaseHistory)
+			records, err := pl.leasedb.Load()
+			require.NoError(t, err)
+
+			assert.Equal(t, reconcileReport{fitInRange: 1, fitOutOfRange: 1, fitConflicting: 2}, pl.reconcile(records))
+			assert.ElementsMatch(t, tt.wantLeases, keys(pl.Recordsv4))
+			assert.ElementsMatch(t, tt.wantStale, keys(pl.stale))
+			stored, err := pl.leasedb.Load()
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tt.wantLeases, keys(stored), "dropped leases are removed from storage")
+			entries, err := pl.History(HistoryQuery{})
+			require.NoError(t, err)
+			var expired []string
+			for _, entry := range entries {
+				assert.Equal(t, EventExpire, entry.Event)
+				expired = append(expired, entry.Client)
+			}
+			assert.ElementsMatch(t, tt.wantExpired, expired, "dropped leases expire in the history")
+
+			// The addresses of the leases stay out of the pool, the first
+			// free one is handed out
+			assert.Equal(t, "10.0.0.3", lease(t, pl, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x06}).String())
+		})
+	}
+}
+
+func TestLoadReservedClientID(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x05}
+	clientID := []byte{0x01, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x05}
+	for _, policy := range []StalePolicy{StaleDrop, StaleNAK} {
+		t.Run(string(policy), func(t *testing.T) {
+			pl := newStalePluginState(t, policy)
+			pl.history = pl.leasedb.(LeaseHistory)
+			// The reserved client sends a client identifier, its lease is
+			// keyed by it
+			client := clientIDPrefix + net.HardwareAddr(clientID).String()
+			require.NoError(t, pl.leasedb.Upsert(client, &Record{
+				IP:      net.IPv4(10, 0, 0, 1),
+				HWAddr:  mac.String(),
+				expires: int(time.Now().Add(30 * time.Minute).Unix()),
+			}))
+			records, err := pl.leasedb.Load()
+			require.NoError(t, err)
+
+			// Its lease of the reserved address fits, the other lease of
+			// the address does not
+			pl.reconcile(records)
+			assert.Contains(t, pl.Recordsv4, client)
+			assert.NotContains(t, pl.stale, client)
+			entries, err := pl.History(HistoryQuery{MAC: mac.String()})
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+
+			req, err := dhcpv4.New(
+				dhcpv4.WithHwAddr(mac),
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+				dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)),
+				dhcpv4.WithOption(dhcpv4.OptClientIdentifier(clientID)),
+			)
+			require.NoError(t, err)
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+			require.NoError(t, err)
+			reply, _ := pl.Handler4(req, resp)
+			require.NotNil(t, reply)
+			assert.Equal(t, dhcpv4.MessageTypeAck, reply.MessageType())
+			assert.Equal(t, "10.0.0.1", reply.YourIPAddr.String())
+		})
+	}
+}
+
+func TestHandler4StaleLeases(t *testing.T) {
+	outside := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	reserved := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	request := func(t *testing.T, pl *PluginState, mac net.HardwareAddr, ip net.IP) *dhcpv4.DHCPv4 {
+		t.Helper()
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithClientIP(ip),
+		)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+		require.NoError(t, err)
+		reply, _ := pl.Handler4(req, resp)
+		require.NotNil(t, reply)
+		return reply
+	}
+	setup := func(t *testing.T, policy StalePolicy) *PluginState {
+		t.Helper()
+		pl := newStalePluginState(t, policy)
+		records, err := pl.leasedb.Load()
+		require.NoError(t, err)
+		pl.reconcile(records)
+		return pl
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		pl := setup(t, StaleKeep)
+		expires := pl.Recordsv4[outside.String()].expires
+
+		// The lease is served until it expires, without renewing it
+		reply := request(t, pl, outside, net.IPv4(10, 0, 0, 50))
+		assert.Equal(t, dhcpv4.MessageTypeAck, reply.MessageType())
+		assert.Equal(t, "10.0.0.50", reply.YourIPAddr.String())
+		assert.LessOrEqual(t, reply.IPAddressLeaseTime(0), 30*time.Minute)
+		assert.Equal(t, expires, pl.Recordsv4[outside.String()].expires)
+
+		// Once expired the client is refused and gets another address
+		pl.Recordsv4[outside.String()].expires = int(time.Now().Unix())
+		reply = request(t, pl, outside, net.IPv4(10, 0, 0, 50))
+		assert.Equal(t, dhcpv4.MessageTypeNak, reply.MessageType())
+		assert.Contains(t, reply.Message(), "not in the pools anymore")
+		assert.Equal(t, "10.0.0.3", lease(t, pl, outside).String())
+		assert.NotContains(t, pl.stale, outside.String())
+	})
+
+	t.Run("nak", func(t *testing.T) {
+		pl := setup(t, StaleNAK)
+
+		// Asking for the address again is refused
+		reply := request(t, pl, outside, net.IPv4(10, 0, 0, 50))
+		assert.Equal(t, dhcpv4.MessageTypeNak, reply.MessageType())
+		assert.NotContains(t, pl.Recordsv4, outside.String())
+		stored, err := pl.leasedb.Load()
+		require.NoError(t, err)
+		assert.NotContains(t, stored, outside.String())
+
+		// Discovering gets another address, the reserved one stays with its
+		// owner
+		assert.Equal(t, "10.0.0.3", lease(t, pl, reserved).String())
+		assert.NotContains(t, pl.stale, reserved.String())
+	})
+
+	t.Run("release", func(t *testing.T) {
+		pl := setup(t, StaleKeep)
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(reserved),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+			dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)),
+		)
+		require.NoError(t, err)
+		pl.Handler4(req, nil)
+		assert.NotContains(t, pl.Recordsv4, reserved.String())
+		assert.NotContains(t, pl.stale, reserved.String())
+	})
+}
+
+// keys returns the keys of a map
+func keys[V any](m map[string]V) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
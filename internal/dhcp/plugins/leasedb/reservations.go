@@ -0,0 +1,88 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// reservation is an address reserved for a client
+type reservation struct {
+	IP net.IP
+	// LeaseTime overrides the lease time of the client if set
+	LeaseTime time.Duration
+}
+
+// loadReservations reads the addresses reserved for clients from a file with
+// one "<MAC> <IP>" pair per line, in the format of the coredhcp file plugin,
+// optionally followed by the lease duration of the client. Empty lines and
+// lines starting with # are ignored.
+func loadReservations(path string) (map[string]reservation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reservations := make(map[string]reservation)
+	owners := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want <MAC> <IP> [<lease duration>], got %q", path, line, text)
+		}
+		hwaddr, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ip := net.ParseIP(fields[1]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IPv4 address: %v", path, line, fields[1])
+		}
+		var leaseTime time.Duration
+		if len(fields) == 3 {
+			leaseTime, err = time.ParseDuration(fields[2])
+			if err != nil || leaseTime <= 0 || leaseTime > dhcpv4.MaxLeaseTime {
+				return nil, fmt.Errorf("%s:%d: invalid lease duration: %v", path, line, fields[2])
+			}
+		}
+		mac := hwaddr.String()
+		if _, ok := reservations[mac]; ok {
+			return nil, fmt.Errorf("%s:%d: MAC %s is reserved an address twice", path, line, mac)
+		}
+		if owner, ok := owners[ip.String()]; ok {
+			return nil, fmt.Errorf("%s:%d: IP %s is already reserved for MAC %s", path, line, ip, owner)
+		}
+		reservations[mac] = reservation{IP: ip, LeaseTime: leaseTime}
+		owners[ip.String()] = mac
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// reservedFor returns the MAC address ip is reserved for, or an empty string
+// if it is not reserved
+func (p *PluginState) reservedFor(ip net.IP) string {
+	for mac, reserved := range p.reservations {
+		if reserved.IP.Equal(ip) {
+			return mac
+		}
+	}
+	return ""
+}
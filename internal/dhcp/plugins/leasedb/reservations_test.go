@@ -0,0 +1,161 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadReservations(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "reservations with comments",
+			content: "# printers\nAA:BB:CC:DD:EE:01 10.0.0.5\n\n  aa-bb-cc-dd-ee-02   10.0.0.200  \n",
+			want: map[string]string{
+				"aa:bb:cc:dd:ee:01": "10.0.0.5",
+				"aa:bb:cc:dd:ee:02": "10.0.0.200",
+			},
+		},
+		{
+			name:    "reservation with lease duration",
+			content: "aa:bb:cc:dd:ee:01 10.0.0.5 720h\n",
+			want: map[string]string{
+				"aa:bb:cc:dd:ee:01": "10.0.0.5 720h0m0s",
+			},
+		},
+		{
+			name:    "invalid lease duration",
+			content: "aa:bb:cc:dd:ee:01 10.0.0.5 forever\n",
+			wantErr: ":1: invalid lease duration",
+		},
+		{
+			name:    "trailing fields",
+			content: "aa:bb:cc:dd:ee:01 10.0.0.5 1h printer\n",
+			wantErr: ":1: want <MAC> <IP> [<lease duration>]",
+		},
+		{
+			name:    "missing address",
+			content: "aa:bb:cc:dd:ee:01\n",
+			wantErr: ":1: want <MAC> <IP>",
+		},
+		{
+			name:    "invalid MAC",
+			content: "printer 10.0.0.5\n",
+			wantErr: "invalid MAC address",
+		},
+		{
+			name:    "invalid address",
+			content: "aa:bb:cc:dd:ee:01 2001:db8::1\n",
+			wantErr: "invalid IPv4 address",
+		},
+		{
+			name:    "MAC reserved twice",
+			content: "aa:bb:cc:dd:ee:01 10.0.0.5\naa:bb:cc:dd:ee:01 10.0.0.6\n",
+			wantErr: ":2: MAC aa:bb:cc:dd:ee:01 is reserved an address twice",
+		},
+		{
+			name:    "address reserved twice",
+			content: "aa:bb:cc:dd:ee:01 10.0.0.5\naa:bb:cc:dd:ee:02 10.0.0.5\n",
+			wantErr: ":2: IP 10.0.0.5 is already reserved for MAC aa:bb:cc:dd:ee:01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "reservations.txt")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+			reservations, err := loadReservations(path)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			got := make(map[string]string, len(reservations))
+			for mac, r := range reservations {
+				got[mac] = r.IP.String()
+				if r.LeaseTime > 0 {
+					got[mac] += " " + r.LeaseTime.String()
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := loadReservations(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
+
+func TestHandler4Reservations(t *testing.T) {
+	owner := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	outside := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	other := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	squatter := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x04}
+	serverID := net.IPv4(10, 0, 0, 254)
+
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 3))
+	pl.reservations = map[string]reservation{
+		owner.String():   {IP: net.IPv4(10, 0, 0, 1).To4()},
+		outside.String(): {IP: net.IPv4(10, 0, 1, 1).To4()},
+	}
+	// A lease handed out before the reservation was made is dropped
+	require.NoError(t, pl.saveIPAddress(squatter.String(), &Record{IP: net.IPv4(10, 0, 0, 1), expires: int(time.Now().Add(time.Hour).Unix())}))
+	require.NoError(t, pl.load())
+	assert.NotContains(t, pl.Recordsv4, squatter.String())
+
+	// Other clients never get the reserved address, even when asking for it
+	assert.Equal(t, "10.0.0.2", lease(t, pl, other).String())
+	assert.Equal(t, "10.0.0.3", lease(t, pl, squatter).String())
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x05}),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 1))),
+	)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	require.NoError(t, err)
+	nak, stop := pl.Handler4(req, resp)
+	require.NotNil(t, nak)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assert.Contains(t, nak.Message(), "reserved for another client")
+
+	// The owners get their address although the pool is exhausted, also when
+	// it is outside of the pool
+	for mac, want := range map[string]string{owner.String(): "10.0.0.1", outside.String(): "10.0.1.1"} {
+		hwaddr, err := net.ParseMAC(mac)
+		require.NoError(t, err)
+		offer := discover(t, pl, hwaddr, serverID)
+		assert.Equal(t, want, offer.YourIPAddr.String())
+		ack, _ := request(t, pl, offer, serverID, serverID)
+		require.NotNil(t, ack)
+		assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+		assert.Equal(t, want, ack.YourIPAddr.String())
+	}
+
+	// Releasing a reserved address keeps it for its owner
+	release, err := dhcpv4.New(dhcpv4.WithHwAddr(owner), dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+	require.NoError(t, err)
+	pl.Handler4(release, resp)
+	assert.NotContains(t, pl.Recordsv4, owner.String())
+	req, err = dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x06})
+	require.NoError(t, err)
+	result, stop := pl.Handler4(req, resp)
+	assert.Nil(t, result, "the pool is still exhausted")
+	assert.True(t, stop)
+}
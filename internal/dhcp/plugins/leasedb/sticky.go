@@ -0,0 +1,79 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// stickyProbes is how many addresses derived from the identity of a client
+// are tried before it is given the first free address
+const stickyProbes = 16
+
+// AllocationStrategy is how the plugin picks the address of a new client
+type AllocationStrategy string
+
+const (
+	// AllocateFirst hands out the first free address of the pools
+	AllocateFirst AllocationStrategy = "first"
+	// AllocateSticky hands out an address derived from the identity of the
+	// client, so a server that lost its leases, or another server with the
+	// same pools, gives clients the addresses they had
+	AllocateSticky AllocationStrategy = "sticky"
+)
+
+// parseAllocationStrategy returns the allocation strategy named s
+func parseAllocationStrategy(s string) (AllocationStrategy, error) {
+	switch strategy := AllocationStrategy(s); strategy {
+	case AllocateFirst, AllocateSticky:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("invalid allocation strategy: %v", s)
+}
+
+// stickyAddress returns the nth address of the pools derived from the identity
+// of a client, a hash of it mapped onto the addresses of the pools in order.
+// The addresses for n > 0 are where to probe next when the previous ones are
+// taken. It returns nil if there are no pools.
+func stickyAddress(client string, n int, pools []ipRange) net.IP {
+	var size uint64
+	for _, pool := range pools {
+		size += uint64(pool.end-pool.start) + 1
+	}
+	if size == 0 {
+		return nil
+	}
+	// Identities differ in a few bytes, the hash has to spread them all the
+	// same over small pools
+	sum := sha256.Sum256(append([]byte(client), byte(n)))
+	offset := binary.BigEndian.Uint64(sum[:8]) % size
+	for _, pool := range pools {
+		if offset <= uint64(pool.end-pool.start) {
+			return uint32ToIP(pool.start + uint32(offset))
+		}
+		offset -= uint64(pool.end-pool.start) + 1
+	}
+	return nil
+}
+
+// allocateSticky allocates the first free address derived from the identity
+// of a client, probing up to stickyProbes addresses. It returns nil if they
+// are all taken. The caller must hold the plugin lock.
+func (p *PluginState) allocateSticky(client string) net.IP {
+	for n := 0; n < stickyProbes; n++ {
+		ip := stickyAddress(client, n, p.pools)
+		if ip == nil || !p.inRange(ip) {
+			// Excluded addresses are never handed out
+			continue
+		}
+		if err := p.reallocate(ip); err == nil {
+			return ip
+		}
+	}
+	return nil
+}
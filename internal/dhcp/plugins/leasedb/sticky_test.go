@@ -0,0 +1,76 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStickyAddress(t *testing.T) {
+	pools := mustParseIPRanges(t, "10.0.0.1-10.0.0.10", "10.0.1.1-10.0.1.10")
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		client := fmt.Sprintf("02:00:00:00:00:%02x", i)
+		ip := stickyAddress(client, 0, pools)
+		require.NotNil(t, ip)
+		assert.True(t, leasable(ip, pools, nil), "%s is not in the pools", ip)
+		assert.Equal(t, ip, stickyAddress(client, 0, pools), "the address of a client does not change")
+		seen[ip.String()] = true
+	}
+	assert.Greater(t, len(seen), 15, "clients are spread over both pools")
+
+	// Probing goes elsewhere
+	assert.NotEqual(t, stickyAddress("02:00:00:00:00:01", 0, pools), stickyAddress("02:00:00:00:00:01", 1, pools))
+	assert.Nil(t, stickyAddress("02:00:00:00:00:01", 0, nil))
+}
+
+func TestHandler4Sticky(t *testing.T) {
+	macs := make([]net.HardwareAddr, 8)
+	for i := range macs {
+		macs[i] = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)}
+	}
+	newSticky := func(t *testing.T) *PluginState {
+		t.Helper()
+		pl := newTestPluginState(t, net.IPv4(10, 0, 0, 250))
+		pl.Strategy = AllocateSticky
+		return pl
+	}
+
+	// A server that lost its leases hands out the same addresses, whatever
+	// the order clients come back in
+	first := newSticky(t)
+	want := make(map[string]string)
+	for _, mac := range macs {
+		want[mac.String()] = lease(t, first, mac).String()
+		assert.Equal(t, stickyAddress(mac.String(), 0, first.pools).String(), want[mac.String()])
+	}
+	rebuilt := newSticky(t)
+	got := make(map[string]string)
+	for i := len(macs) - 1; i >= 0; i-- {
+		got[macs[i].String()] = lease(t, rebuilt, macs[i]).String()
+	}
+	assert.Equal(t, want, got)
+
+	// A client whose address is taken probes the next one derived from its
+	// identity
+	taken := newSticky(t)
+	preferred := stickyAddress(macs[0].String(), 0, taken.pools)
+	require.NoError(t, taken.reallocate(preferred))
+	assert.Equal(t, stickyAddress(macs[0].String(), 1, taken.pools).String(), lease(t, taken, macs[0]).String())
+
+	// Clients still get an address when the probes are all taken
+	small := newTestPluginState(t, net.IPv4(10, 0, 0, 3))
+	small.Strategy = AllocateSticky
+	leased := make(map[string]bool)
+	for _, mac := range macs[:3] {
+		leased[lease(t, small, mac).String()] = true
+	}
+	assert.Len(t, leased, 3)
+}
@@ -6,84 +6,419 @@ package leasedb
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"time"
 
 	_ "github.com/chaisql/chai/driver"
 )
 
+// chaiStore keeps leases in a chai database, either in a file or in memory
+type chaiStore struct {
+	db *sql.DB
+}
+
+func init() {
+	registerLeaseStore("chai", openChaiStore)
+}
+
+// openChaiStore opens the chai database at path, which may be ":memory:"
+func openChaiStore(path string) (LeaseStore, error) {
+	db, err := loadDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &chaiStore{db: db}, nil
+}
+
 func loadDB(path string) (*sql.DB, error) {
 	db, err := sql.Open("chai", path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database (%T): %w", err, err)
 	}
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry INTEGER, PRIMARY KEY (mac, ip))"); err != nil {
-		return nil, fmt.Errorf("table creation failed: %w", err)
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("transaction start failed: %w", err)
+	}
+	defer tx.Rollback()
+	if err := migrate(tx, chaiMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("transaction commit failed: %w", err)
 	}
 	return db, nil
 }
 
+// chaiMigrations are the versions of the schema of chai databases. Appending
+// a migration upgrades existing databases on startup.
+var chaiMigrations = []migration{
+	{"create lease and quarantine tables", statements(
+		"CREATE TABLE IF NOT EXISTS leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry INTEGER, PRIMARY KEY (mac, ip))",
+		"CREATE TABLE IF NOT EXISTS quarantine4 (ip TEXT PRIMARY KEY, expiry INTEGER)",
+	)},
+	// Leases stored before are keyed by MAC
+	{"key leases by client identity", chaiAddColumns("leases4",
+		"idtype TEXT NOT NULL DEFAULT 'hwaddr'",
+	)},
+	{"record lease details", func(tx *sql.Tx) error {
+		if err := chaiAddColumns("leases4",
+			"hostname TEXT NOT NULL DEFAULT ''",
+			"hwaddr TEXT NOT NULL DEFAULT ''",
+			"vmi TEXT NOT NULL DEFAULT ''",
+			"state TEXT NOT NULL DEFAULT 'bound'",
+			"first_seen INTEGER NOT NULL DEFAULT 0",
+			"last_seen INTEGER NOT NULL DEFAULT 0",
+		)(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE leases4 SET hwaddr = mac WHERE idtype = 'hwaddr'")
+		return err
+	}},
+	{"keep a lease history", statements(
+		"CREATE TABLE history4 (at INTEGER NOT NULL, event TEXT NOT NULL, mac TEXT NOT NULL, idtype TEXT NOT NULL, ip TEXT NOT NULL, hwaddr TEXT NOT NULL, hostname TEXT NOT NULL, vmi TEXT NOT NULL, expiry INTEGER NOT NULL)",
+		"CREATE INDEX history4_ip ON history4 (ip)",
+		"CREATE INDEX history4_hwaddr ON history4 (hwaddr)",
+		"CREATE INDEX history4_expiry ON history4 (expiry)",
+	)},
+	{"keep forcerenew nonces", chaiAddColumns("leases4",
+		"nonce TEXT NOT NULL DEFAULT ''",
+	)},
+	{"remember the forcerenew configuration", statements(
+		"CREATE TABLE settings4 (name TEXT PRIMARY KEY, setting TEXT NOT NULL)",
+	)},
+}
+
+// leaseColumns are the columns of leases4 making up a lease, in the order of
+// scanLease and leaseValues
+const leaseColumns = "mac, idtype, ip, expiry, hostname, hwaddr, vmi, state, first_seen, last_seen, nonce"
+
+// scanLease reads the lease in a row of leaseColumns and returns the key of
+// the client holding it
+func scanLease(row interface{ Scan(dest ...any) error }) (string, *Record, error) {
+	var (
+		id, idType, ip, state, nonce string
+		record                       Record
+	)
+	if err := row.Scan(&id, &idType, &ip, &record.expires, &record.Hostname, &record.HWAddr, &record.VMI, &state, &record.firstSeen, &record.lastSeen, &nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to scan row: %w", err)
+	}
+	key, err := joinClientKey(id, idType)
+	if err != nil {
+		return "", nil, err
+	}
+	record.IP = net.ParseIP(ip)
+	if record.IP.To4() == nil {
+		return "", nil, fmt.Errorf("expected an IPv4 address, got: %v", ip)
+	}
+	record.State = LeaseState(state)
+	if record.nonce, err = decodeNonce(nonce); err != nil {
+		return "", nil, err
+	}
+	return key, &record, nil
+}
+
+// leaseValues returns the values of leaseColumns for the lease of a client
+func leaseValues(key string, record *Record) []any {
+	id, idType := splitClientKey(key)
+	return []any{
+		id, idType, record.IP.String(), record.expires,
+		record.Hostname, record.HWAddr, record.VMI, string(record.State),
+		record.firstSeen, record.lastSeen, hex.EncodeToString(record.nonce),
+	}
+}
+
+// sqlStatements are the statements writing the changes to a lease database,
+// whose placeholders differ between SQL dialects
+type sqlStatements struct {
+	upsert        string
+	delete        string
+	quarantine    string
+	unquarantine  string
+	appendHistory string
+	setting       string
+}
+
+// chaiStatements are the statements writing to a chai database
+var chaiStatements = sqlStatements{
+	upsert:        `INSERT INTO leases4(` + leaseColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO REPLACE`,
+	delete:        `DELETE FROM leases4 WHERE mac = ? AND ip = ? AND idtype = ?`,
+	quarantine:    `INSERT INTO quarantine4(ip, expiry) VALUES (?, ?) ON CONFLICT DO REPLACE`,
+	unquarantine:  `DELETE FROM quarantine4 WHERE ip = ?`,
+	appendHistory: `INSERT INTO history4(` + historyColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	setting:       `INSERT INTO settings4(name, setting) VALUES (?, ?) ON CONFLICT DO REPLACE`,
+}
+
+// forceRenewSetting is the setting holding the configuration the clients were
+// last asked to renew for
+const forceRenewSetting = "forcerenew-config"
+
+// setSetting stores a setting with the statements of a dialect
+func (st sqlStatements) setSetting(db sqlExecer, name, value string) error {
+	if _, err := db.Exec(st.setting, name, value); err != nil {
+		return fmt.Errorf("setting insert/update failed: %w", err)
+	}
+	return nil
+}
+
+// loadSetting returns a stored setting, empty if it was never set
+func loadSetting(db *sql.DB, query, name string) (string, error) {
+	var value string
+	switch err := db.QueryRow(query, name).Scan(&value); {
+	case errors.Is(err, sql.ErrNoRows):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to query settings table: %w", err)
+	}
+	return value, nil
+}
+
+// sqlExecer is a database or a transaction
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// exec writes a change with the statements of a dialect
+func (st sqlStatements) exec(db sqlExecer, op storeOp) error {
+	switch op.kind {
+	case opUpsert:
+		if _, err := db.Exec(st.upsert, leaseValues(op.client, &op.record)...); err != nil {
+			return fmt.Errorf("record insert/update failed: %w", err)
+		}
+	case opDelete:
+		id, idType := splitClientKey(op.client)
+		if _, err := db.Exec(st.delete, id, op.record.IP.String(), idType); err != nil {
+			return fmt.Errorf("record delete failed: %w", err)
+		}
+	case opQuarantine:
+		if _, err := db.Exec(st.quarantine, op.ip.String(), op.expires); err != nil {
+			return fmt.Errorf("quarantine insert/update failed: %w", err)
+		}
+	case opUnquarantine:
+		if _, err := db.Exec(st.unquarantine, op.ip.String()); err != nil {
+			return fmt.Errorf("quarantine delete failed: %w", err)
+		}
+	case opAppendHistory:
+		if _, err := db.Exec(st.appendHistory, historyValues(op.entry)...); err != nil {
+			return fmt.Errorf("history insert failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown lease store change: %d", op.kind)
+	}
+	return nil
+}
+
+// writeBatch writes changes with the statements of a dialect in a single
+// transaction
+func (st sqlStatements) writeBatch(db *sql.DB, ops []storeOp) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("transaction start failed: %w", err)
+	}
+	defer tx.Rollback()
+	for _, op := range ops {
+		if err := st.exec(tx, op); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return nil
+}
+
 // loadRecords loads the DHCPv6/v4 Records global map with records stored on
-// the specified file. The records have to be one per line, a mac address and an
-// IP address.
+// the specified file. The records have to be one per line, a client identity
+// and an IP address.
 func loadRecords(db *sql.DB) (map[string]*Record, error) {
-	rows, err := db.Query("SELECT mac, ip, expiry FROM leases4")
+	rows, err := db.Query("SELECT " + leaseColumns + " FROM leases4")
 	if err != nil {
 		return nil, fmt.Errorf("failed to query leases database: %w", err)
 	}
 	defer rows.Close()
+	records := make(map[string]*Record)
+	for rows.Next() {
+		key, record, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+		records[key] = record
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	return records, nil
+}
+
+// queryHistory returns the entries of the history4 table selected by a query,
+// the latest first. placeholder returns the placeholder of the nth argument.
+func queryHistory(db *sql.DB, q HistoryQuery, placeholder func(n int) string) ([]HistoryEntry, error) {
+	where, args := q.where(placeholder)
+	query := "SELECT " + historyColumns + " FROM history4" + where + " ORDER BY at DESC"
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += " LIMIT " + placeholder(len(args))
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query lease history: %w", err)
+	}
+	defer rows.Close()
+	var entries []HistoryEntry
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease history row scanning: %w", err)
+	}
+	return entries, nil
+}
+
+// loadQuarantine loads the declined addresses and when their quarantine ends
+func loadQuarantine(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query("SELECT ip, expiry FROM quarantine4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantine table: %w", err)
+	}
+	defer rows.Close()
 	var (
-		mac, ip string
-		expiry  int
-		records = make(map[string]*Record)
+		ip         string
+		expiry     int
+		quarantine = make(map[string]int)
 	)
 	for rows.Next() {
-		if err := rows.Scan(&mac, &ip, &expiry); err != nil {
+		if err := rows.Scan(&ip, &expiry); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
-		hwaddr, err := net.ParseMAC(mac)
-		if err != nil {
-			return nil, fmt.Errorf("malformed hardware address: %s", mac)
-		}
 		ipaddr := net.ParseIP(ip)
 		if ipaddr.To4() == nil {
 			return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
 		}
-		records[hwaddr.String()] = &Record{IP: ipaddr, expires: expiry}
+		quarantine[ipaddr.String()] = expiry
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+		return nil, fmt.Errorf("failed quarantine table row scanning: %w", err)
 	}
-	return records, nil
+	return quarantine, nil
 }
 
-// saveIPAddress writes out a lease to storage
-func (p *PluginState) saveIPAddress(mac net.HardwareAddr, record *Record) error {
-	stmt, err := p.leasedb.Prepare(`INSERT INTO leases4(mac, ip, expiry) VALUES (?, ?, ?) ON CONFLICT DO REPLACE`)
+// Load returns all stored leases
+func (s *chaiStore) Load() (map[string]*Record, error) {
+	return loadRecords(s.db)
+}
+
+// List returns all stored leases ordered by address
+func (s *chaiStore) List() ([]Lease, error) {
+	records, err := loadRecords(s.db)
 	if err != nil {
-		return fmt.Errorf("statement preparation failed: %w", err)
+		return nil, err
 	}
-	if _, err := stmt.Exec(
-		mac.String(),
-		record.IP.String(),
-		record.expires,
-	); err != nil {
-		return fmt.Errorf("record insert/update failed: %w", err)
+	leases := make([]Lease, 0, len(records))
+	for mac, record := range records {
+		leases = append(leases, Lease{MAC: mac, Record: *record})
 	}
-	return nil
+	sort.Slice(leases, func(i, j int) bool { return leases[i].less(leases[j]) })
+	return leases, nil
 }
 
-// registerBackingDB installs a database connection string as the backing store for leases
-func (p *PluginState) registerBackingDB(filename string) error {
-	if p.leasedb != nil {
-		return errors.New("cannot swap out a lease database while running")
-	}
-	// We never close this, but that's ok because plugins are never stopped/unregistered
-	newLeaseDB, err := loadDB(filename)
+// Upsert writes out a lease to storage
+func (s *chaiStore) Upsert(mac string, record *Record) error {
+	return chaiStatements.exec(s.db, storeOp{kind: opUpsert, client: mac, record: *record})
+}
+
+// Delete removes a lease from storage
+func (s *chaiStore) Delete(mac string, record *Record) error {
+	return chaiStatements.exec(s.db, storeOp{kind: opDelete, client: mac, record: *record})
+}
+
+// Expired calls fn for each lease that expired before t
+func (s *chaiStore) Expired(t time.Time, fn func(mac string, record *Record) error) error {
+	rows, err := s.db.Query("SELECT "+leaseColumns+" FROM leases4 WHERE expiry < ?", t.Unix())
 	if err != nil {
-		return fmt.Errorf("failed to open lease database %s: %w", filename, err)
+		return fmt.Errorf("failed to query leases database: %w", err)
+	}
+	expired := make(map[string]*Record)
+	for rows.Next() {
+		key, record, err := scanLease(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired[key] = record
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	// The rows are closed before calling fn, so it may modify the database
+	for mac, record := range expired {
+		if err := fn(mac, record); err != nil {
+			return err
+		}
 	}
-	p.leasedb = newLeaseDB
 	return nil
 }
+
+// LoadQuarantine returns the declined addresses and when their quarantine ends
+func (s *chaiStore) LoadQuarantine() (map[string]int, error) {
+	return loadQuarantine(s.db)
+}
+
+// Quarantine writes out a declined address to storage
+func (s *chaiStore) Quarantine(ip net.IP, expires int) error {
+	return chaiStatements.exec(s.db, storeOp{kind: opQuarantine, ip: ip, expires: expires})
+}
+
+// Unquarantine removes a declined address from storage
+func (s *chaiStore) Unquarantine(ip net.IP) error {
+	return chaiStatements.exec(s.db, storeOp{kind: opUnquarantine, ip: ip})
+}
+
+// ForceRenewedConfig returns the configuration the clients were last asked
+// to renew for
+func (s *chaiStore) ForceRenewedConfig() (string, error) {
+	return loadSetting(s.db, "SELECT setting FROM settings4 WHERE name = ?", forceRenewSetting)
+}
+
+// RecordForceRenew stores the configuration the clients are asked to renew for
+func (s *chaiStore) RecordForceRenew(config string) error {
+	return chaiStatements.setSetting(s.db, forceRenewSetting, config)
+}
+
+// AppendHistory adds an entry to the lease history
+func (s *chaiStore) AppendHistory(entry HistoryEntry) error {
+	return chaiStatements.exec(s.db, storeOp{kind: opAppendHistory, entry: entry})
+}
+
+// writeBatch writes changes in a single transaction
+func (s *chaiStore) writeBatch(ops []storeOp) error {
+	return chaiStatements.writeBatch(s.db, ops)
+}
+
+// History returns the entries of the lease history selected by a query
+func (s *chaiStore) History(q HistoryQuery) ([]HistoryEntry, error) {
+	return queryHistory(s.db, q, func(int) string { return "?" })
+}
+
+// PruneHistory drops the entries describing leases that ended before t
+func (s *chaiStore) PruneHistory(t time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM history4 WHERE expiry < ?", t.Unix()); err != nil {
+		return fmt.Errorf("history delete failed: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *chaiStore) Close() error {
+	return s.db.Close()
+}
@@ -8,21 +8,20 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
 	_ "github.com/chaisql/chai/driver"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func testDBSetup() (*sql.DB, error) {
-	db, err := sql.Open("chai", ":memory:")
+	db, err := loadDB(":memory:")
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry INTEGER, PRIMARY KEY (mac, ip))"); err != nil {
-		return nil, fmt.Errorf("table creation failed: %w", err)
-	}
 	for _, record := range records {
 		stmt, err := db.Prepare("INSERT INTO leases4(mac, ip, expiry) values (?, ?, ?)")
 		if err != nil {
@@ -41,12 +40,12 @@ var records = []struct {
 	mac string
 	ip  *Record
 }{
-	{"02:00:00:00:00:00", &Record{net.IPv4(10, 0, 0, 0), expire}},
-	{"02:00:00:00:00:01", &Record{net.IPv4(10, 0, 0, 1), expire}},
-	{"02:00:00:00:00:02", &Record{net.IPv4(10, 0, 0, 2), expire}},
-	{"02:00:00:00:00:03", &Record{net.IPv4(10, 0, 0, 3), expire}},
-	{"02:00:00:00:00:04", &Record{net.IPv4(10, 0, 0, 4), expire}},
-	{"02:00:00:00:00:05", &Record{net.IPv4(10, 0, 0, 5), expire}},
+	{"02:00:00:00:00:00", &Record{IP: net.IPv4(10, 0, 0, 0), expires: expire}},
+	{"02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), expires: expire}},
+	{"02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 2), expires: expire}},
+	{"02:00:00:00:00:03", &Record{IP: net.IPv4(10, 0, 0, 3), expires: expire}},
+	{"02:00:00:00:00:04", &Record{IP: net.IPv4(10, 0, 0, 4), expires: expire}},
+	{"02:00:00:00:00:05", &Record{IP: net.IPv4(10, 0, 0, 5), expires: expire}},
 }
 
 func TestLoadRecords(t *testing.T) {
@@ -69,7 +68,8 @@ func TestLoadRecords(t *testing.T) {
 		if err := db.QueryRow("SELECT mac, ip, expiry FROM leases4 WHERE mac = ?", rec.mac).Scan(&mac, &ip, &expiry); err != nil {
 			t.Fatalf("record not found for mac=%s: %v", rec.mac, err)
 		}
-		mapRec[mac] = &Record{IP: net.ParseIP(ip), expires: expiry}
+		// Rows inserted without a state are bound leases
+		mapRec[mac] = &Record{IP: net.ParseIP(ip), expires: expiry, State: LeaseBound}
 	}
 
 	assert.Equal(t, mapRec, parsedRec, "Loaded records differ from what's in the DB")
@@ -88,13 +88,13 @@ func TestWriteRecords(t *testing.T) {
 			// bug in testdata
 			panic(err)
 		}
-		if err := pl.saveIPAddress(hwaddr, rec.ip); err != nil {
+		if err := pl.saveIPAddress(hwaddr.String(), rec.ip); err != nil {
 			t.Errorf("Failed to save ip for %s: %v", hwaddr, err)
 		}
 		mapRec[hwaddr.String()] = &Record{IP: rec.ip.IP, expires: rec.ip.expires}
 	}
 
-	parsedRec, err := loadRecords(pl.leasedb)
+	parsedRec, err := pl.leasedb.Load()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,7 +115,7 @@ func TestDuplicateRec(t *testing.T) {
 			// bug in testdata
 			panic(err)
 		}
-		if err := pl.saveIPAddress(hwaddr, rec.ip); err != nil {
+		if err := pl.saveIPAddress(hwaddr.String(), rec.ip); err != nil {
 			t.Errorf("Failed to save ip for %s: %v", hwaddr, err)
 		}
 		mapRec[hwaddr.String()] = &Record{IP: rec.ip.IP, expires: rec.ip.expires}
@@ -126,11 +126,11 @@ func TestDuplicateRec(t *testing.T) {
 		// bug in testdata
 		panic(err)
 	}
-	if err := pl.saveIPAddress(hwaddr, records[0].ip); err != nil {
+	if err := pl.saveIPAddress(hwaddr.String(), records[0].ip); err != nil {
 		t.Errorf("Failed to save ip for %s: %v", hwaddr, err)
 	}
 
-	parsedRec, err := loadRecords(pl.leasedb)
+	parsedRec, err := pl.leasedb.Load()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,6 +173,31 @@ func TestLoadDB(t *testing.T) {
 	}
 }
 
+func TestLoadDBAddsIdentityType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.db")
+	db, err := sql.Open("chai", path)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry INTEGER, PRIMARY KEY (mac, ip))")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO leases4(mac, ip, expiry) VALUES ('02:00:00:00:00:01', '10.0.0.1', 0)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Leases stored before are keyed by MAC, upgrading again is a no-op
+	for i := 0; i < 2; i++ {
+		store, err := openChaiStore(path)
+		require.NoError(t, err)
+		require.NoError(t, store.Upsert("id:01:02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 2)}))
+		stored, err := store.Load()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"02:00:00:00:00:01":       "10.0.0.1 1970-01-01T00:00:00Z",
+			"id:01:02:00:00:00:00:02": "10.0.0.2 1970-01-01T00:00:00Z",
+		}, summarize(stored))
+		require.NoError(t, store.Close())
+	}
+}
+
 func TestLoadRecordsErrors(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -203,6 +228,22 @@ func TestLoadRecordsErrors(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid client identifier",
+			setupFunc: func(db *sql.DB) error {
+				_, err := db.Exec("INSERT INTO leases4(mac, ip, expiry, idtype) VALUES ('not-hex', '10.0.0.1', 0, 'client-id')")
+				return err
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown identity type",
+			setupFunc: func(db *sql.DB) error {
+				_, err := db.Exec("INSERT INTO leases4(mac, ip, expiry, idtype) VALUES ('02:00:00:00:00:08', '10.0.0.1', 0, 'duid')")
+				return err
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -279,6 +320,74 @@ func TestSaveIPAddressErrors(t *testing.T) {
 
 	mac, _ := net.ParseMAC("02:00:00:00:00:08")
 	rec := &Record{IP: net.IPv4(10, 0, 0, 8), expires: 0}
-	err = pl.saveIPAddress(mac, rec)
+	err = pl.saveIPAddress(mac.String(), rec)
 	assert.Error(t, err)
 }
+
+func TestDeleteIPAddress(t *testing.T) {
+	pl := PluginState{}
+	if err := pl.registerBackingDB(":memory:"); err != nil {
+		t.Fatalf("Could not setup file: %v", err)
+	}
+
+	mapRec := make(map[string]*Record)
+	for _, rec := range records {
+		hwaddr, err := net.ParseMAC(rec.mac)
+		if err != nil {
+			// bug in testdata
+			panic(err)
+		}
+		if err := pl.saveIPAddress(hwaddr.String(), rec.ip); err != nil {
+			t.Errorf("Failed to save ip for %s: %v", hwaddr, err)
+		}
+		mapRec[hwaddr.String()] = &Record{IP: rec.ip.IP, expires: rec.ip.expires}
+	}
+
+	hwaddr, err := net.ParseMAC(records[0].mac)
+	if err != nil {
+		// bug in testdata
+		panic(err)
+	}
+	if err := pl.deleteIPAddress(hwaddr.String(), records[0].ip); err != nil {
+		t.Fatalf("Failed to delete ip for %s: %v", hwaddr, err)
+	}
+	delete(mapRec, hwaddr.String())
+
+	parsedRec, err := pl.leasedb.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, mapRec, parsedRec, "Loaded records differ from what's in the DB")
+}
+
+func TestQuarantine(t *testing.T) {
+	pl := PluginState{}
+	if err := pl.registerBackingDB(":memory:"); err != nil {
+		t.Fatalf("Could not setup file: %v", err)
+	}
+
+	want := make(map[string]int)
+	for _, rec := range records {
+		if err := pl.saveQuarantine(rec.ip.IP, rec.ip.expires); err != nil {
+			t.Errorf("Failed to quarantine ip %s: %v", rec.ip.IP, err)
+		}
+		want[rec.ip.IP.String()] = rec.ip.expires
+	}
+	// Quarantining an address again replaces its expiry
+	if err := pl.saveQuarantine(records[0].ip.IP, expire+60); err != nil {
+		t.Errorf("Failed to quarantine ip %s: %v", records[0].ip.IP, err)
+	}
+	want[records[0].ip.IP.String()] = expire + 60
+	if err := pl.deleteQuarantine(records[1].ip.IP); err != nil {
+		t.Errorf("Failed to lift quarantine of ip %s: %v", records[1].ip.IP, err)
+	}
+	delete(want, records[1].ip.IP.String())
+
+	quarantine, err := pl.leasedb.LoadQuarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, want, quarantine, "Loaded quarantine differs from what's in the DB")
+}
@@ -0,0 +1,171 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// LeaseStore persists the leases and quarantined addresses of the range
+// plugin. Leases are keyed by client, see clientKey.
+type LeaseStore interface {
+	// Load returns all stored leases
+	Load() (map[string]*Record, error)
+	// List returns all stored leases ordered by address
+	List() ([]Lease, error)
+	// Upsert stores the lease of a client, replacing the previous one
+	Upsert(mac string, record *Record) error
+	// Delete removes the lease of a client
+	Delete(mac string, record *Record) error
+	// Expired calls fn for each lease that expired before t. fn may modify
+	// the store.
+	Expired(t time.Time, fn func(mac string, record *Record) error) error
+	// LoadQuarantine returns the declined addresses and when their quarantine ends
+	LoadQuarantine() (map[string]int, error)
+	// Quarantine stores a declined address
+	Quarantine(ip net.IP, expires int) error
+	// Unquarantine removes a declined address
+	Unquarantine(ip net.IP) error
+	// ForceRenewedConfig returns the hash of the configuration the bound
+	// clients were last asked to renew for, empty if they never were
+	ForceRenewedConfig() (string, error)
+	// RecordForceRenew stores the hash of the configuration the bound clients
+	// are asked to renew for
+	RecordForceRenew(config string) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// LeaseClaimer is implemented by lease stores that several servers share.
+// Servers allocate addresses from their own view of the pool, so the store has
+// the final say on who gets an address.
+type LeaseClaimer interface {
+	// Claim stores the lease of a client unless the address is held by another
+	// client or quarantined, in which case the unexpired lease or quarantine
+	// holding it is returned instead. A quarantine is returned as a Lease
+	// without MAC.
+	Claim(mac string, record *Record) (*Lease, error)
+}
+
+// ReplicatedLeaseStore is implemented by lease stores replicated between
+// servers, of which only the leader hands out leases and writes to the store.
+type ReplicatedLeaseStore interface {
+	// NotifyLeadership registers fn to be called with true once this server
+	// leads the replicas and its copy of the leases is up to date, and with
+	// false when it stops leading. fn is called right away if it leads already.
+	NotifyLeadership(fn func(leading bool))
+}
+
+// LeaseHistory is implemented by lease stores that can keep a history of the
+// leases next to them. The history is only appended to, entries are dropped
+// once they are older than the retention of the plugin.
+type LeaseHistory interface {
+	// AppendHistory adds an entry to the history
+	AppendHistory(entry HistoryEntry) error
+	// History returns the entries selected by a query, the latest first
+	History(q HistoryQuery) ([]HistoryEntry, error)
+	// PruneHistory drops the entries describing leases that ended before t
+	PruneHistory(t time.Time) error
+}
+
+// Lease is a stored lease and the client holding it
+type Lease struct {
+	MAC string
+	Record
+}
+
+// Expires returns when the lease expires
+func (l Lease) Expires() time.Time {
+	return time.Unix(int64(l.expires), 0)
+}
+
+// FirstSeen returns when the client was leased the address
+func (l Lease) FirstSeen() time.Time {
+	return time.Unix(int64(l.firstSeen), 0)
+}
+
+// LastSeen returns when the lease was last extended
+func (l Lease) LastSeen() time.Time {
+	return time.Unix(int64(l.lastSeen), 0)
+}
+
+// less orders leases by address
+func (l Lease) less(other Lease) bool {
+	return bytes.Compare(l.IP.To16(), other.IP.To16()) < 0
+}
+
+// leaseStores maps URI schemes to the functions opening the stores. The
+// function receives the URI with the scheme stripped.
+var leaseStores = map[string]func(location string) (LeaseStore, error){}
+
+// registerLeaseStore makes a lease store available under a URI scheme
+func registerLeaseStore(scheme string, open func(location string) (LeaseStore, error)) {
+	leaseStores[scheme] = open
+}
+
+// openLeaseStore opens the lease store for a URI like chai:///var/lib/dhcp/leases
+// or memory://. A plain file name is opened as a chai database.
+func openLeaseStore(uri string) (LeaseStore, error) {
+	scheme, location, ok := strings.Cut(uri, "://")
+	if !ok {
+		scheme, location = "chai", uri
+	}
+	open, ok := leaseStores[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported lease store: %s", scheme)
+	}
+	return open(location)
+}
+
+// saveIPAddress writes out a lease to storage
+func (p *PluginState) saveIPAddress(client string, record *Record) error {
+	return p.write(storeOp{kind: opUpsert, client: client, record: *record})
+}
+
+// claimIPAddress writes out a new lease to storage. When the store is shared
+// with other servers, the lease or quarantine holding the address is returned
+// if it is not available to the client anymore. Claims are written through,
+// after the queued changes.
+func (p *PluginState) claimIPAddress(client string, record *Record) (*Lease, error) {
+	if claimer, ok := p.leasedb.(LeaseClaimer); ok {
+		p.flushWrites()
+		return claimer.Claim(client, record)
+	}
+	return nil, p.saveIPAddress(client, record)
+}
+
+// deleteIPAddress removes a lease from storage
+func (p *PluginState) deleteIPAddress(client string, record *Record) error {
+	return p.write(storeOp{kind: opDelete, client: client, record: *record})
+}
+
+// saveQuarantine writes out a declined address to storage
+func (p *PluginState) saveQuarantine(ip net.IP, expires int) error {
+	return p.write(storeOp{kind: opQuarantine, ip: ip, expires: expires})
+}
+
+// deleteQuarantine removes a declined address from storage
+func (p *PluginState) deleteQuarantine(ip net.IP) error {
+	return p.write(storeOp{kind: opUnquarantine, ip: ip})
+}
+
+// registerBackingDB installs a lease store URI or a file name as the backing store for leases
+func (p *PluginState) registerBackingDB(uri string) error {
+	if p.leasedb != nil {
+		return errors.New("cannot swap out a lease database while running")
+	}
+	// Shutdown closes it when the server stops
+	store, err := openLeaseStore(uri)
+	if err != nil {
+		return fmt.Errorf("failed to open lease database %s: %w", uri, err)
+	}
+	p.leasedb = store
+	return nil
+}
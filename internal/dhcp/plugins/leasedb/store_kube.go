@@ -0,0 +1,545 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	hyperdhcpv1beta1 "github.com/cldmnky/hyperdhcp/api/v1beta1"
+)
+
+const (
+	// defaultFlushInterval is how often batched writes go to the API server
+	defaultFlushInterval = time.Second
+	// kubeFieldOwner is the field manager of the DHCPLease objects we apply
+	kubeFieldOwner = "hyperdhcp"
+	// kubeTimeout bounds every call to the API server
+	kubeTimeout = 10 * time.Second
+)
+
+// kubeStore keeps leases as DHCPLease objects in the namespace of the Server
+// handing them out, one object per address. Reads are served from an informer
+// cache. Writes are queued and applied in batches every flush interval, later
+// writes to an address replacing earlier ones that were not flushed yet. Until
+// the cache has caught up, queued and flushed writes are overlaid on it.
+type kubeStore struct {
+	sync.Mutex
+	client    client.Client
+	cache     cache.Cache
+	cancel    context.CancelFunc
+	namespace string
+	server    string
+	owner     metav1.OwnerReference
+	flush     time.Duration
+	// pending holds the writes not yet reflected by the cache, by object name
+	pending map[string]*kubeWrite
+	// flushing serializes flushes
+	flushing sync.Mutex
+	closed   bool
+	done     chan struct{}
+}
+
+// kubeWrite is a write of a DHCPLease. A nil lease deletes the object.
+type kubeWrite struct {
+	lease   *hyperdhcpv1beta1.DHCPLease
+	flushed bool
+}
+
+func init() {
+	registerLeaseStore("kubernetes", openKubeStore)
+}
+
+// openKubeStore opens the store for a location like <namespace>/<server>, with
+// an optional flush=<interval> query parameter. A flush interval of 0 writes
+// through to the API server. The cluster is found like kubectl does, or from
+// the service account when running in a pod.
+func openKubeStore(location string) (LeaseStore, error) {
+	u, err := url.Parse("kubernetes://" + location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubernetes lease store %q: %w", location, err)
+	}
+	namespace, server := u.Host, strings.Trim(u.Path, "/")
+	if namespace == "" || server == "" || strings.Contains(server, "/") {
+		return nil, fmt.Errorf("invalid kubernetes lease store %q, want <namespace>/<server>", location)
+	}
+	flush := defaultFlushInterval
+	if v := u.Query().Get("flush"); v != "" {
+		if flush, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid flush interval %q: %w", v, err)
+		}
+	}
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubernetes config: %w", err)
+	}
+	return newKubeStore(cfg, namespace, server, flush)
+}
+
+// newKubeStore opens the store of the leases of a Server and waits until its
+// cache is synced
+func newKubeStore(cfg *rest.Config, namespace, server string, flush time.Duration) (*kubeStore, error) {
+	scheme := runtime.NewScheme()
+	if err := hyperdhcpv1beta1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	var owner hyperdhcpv1beta1.Server
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: server}, &owner); err != nil {
+		return nil, fmt.Errorf("failed to get server %s/%s: %w", namespace, server, err)
+	}
+
+	leaseCache, err := cache.New(cfg, cache.Options{
+		Scheme:     scheme,
+		Namespaces: []string{namespace},
+		ByObject: map[client.Object]cache.ByObject{
+			&hyperdhcpv1beta1.DHCPLease{}: {
+				Label: labels.SelectorFromSet(labels.Set{hyperdhcpv1beta1.DHCPLeaseServerLabel: server}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lease cache: %w", err)
+	}
+	// The informer is only created on first use, create it before starting
+	// the cache so the store is synced when we return
+	if _, err := leaseCache.GetInformer(ctx, &hyperdhcpv1beta1.DHCPLease{}); err != nil {
+		return nil, fmt.Errorf("failed to create lease informer: %w", err)
+	}
+	cacheCtx, stop := context.WithCancel(context.Background())
+	go func() {
+		if err := leaseCache.Start(cacheCtx); err != nil {
+			log.Errorf("Lease cache of server %s/%s stopped: %v", namespace, server, err)
+		}
+	}()
+	if !leaseCache.WaitForCacheSync(ctx) {
+		stop()
+		return nil, fmt.Errorf("failed to sync lease cache of server %s/%s", namespace, server)
+	}
+
+	s := &kubeStore{
+		client:    c,
+		cache:     leaseCache,
+		cancel:    stop,
+		namespace: namespace,
+		server:    server,
+		owner: metav1.OwnerReference{
+			APIVersion: hyperdhcpv1beta1.GroupVersion.String(),
+			Kind:       "Server",
+			Name:       owner.Name,
+			UID:        owner.UID,
+		},
+		flush:   flush,
+		pending: make(map[string]*kubeWrite),
+		done:    make(chan struct{}),
+	}
+	if flush > 0 {
+		go s.run()
+	}
+	return s, nil
+}
+
+// run flushes the queued writes every flush interval until the store is closed
+func (s *kubeStore) run() {
+	ticker := time.NewTicker(s.flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flushWrites(); err != nil {
+				log.Errorf("Could not write leases of server %s/%s: %v", s.namespace, s.server, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// objectName returns the name of the DHCPLease of an address
+func (s *kubeStore) objectName(ip net.IP) string {
+	return s.server + "-" + strings.ReplaceAll(ip.String(), ".", "-")
+}
+
+// newLease builds the DHCPLease of an address
+func (s *kubeStore) newLease(ip net.IP, spec hyperdhcpv1beta1.DHCPLeaseSpec) *hyperdhcpv1beta1.DHCPLease {
+	spec.Server = s.server
+	spec.IP = ip.String()
+	return &hyperdhcpv1beta1.DHCPLease{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: hyperdhcpv1beta1.GroupVersion.String(),
+			Kind:       "DHCPLease",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            s.objectName(ip),
+			Namespace:       s.namespace,
+			Labels:          map[string]string{hyperdhcpv1beta1.DHCPLeaseServerLabel: s.server},
+			OwnerReferences: []metav1.OwnerReference{s.owner},
+		},
+		Spec: spec,
+	}
+}
+
+// leases returns the DHCPLease objects of the server by name, as the cache
+// has them with the pending writes applied. Writes the cache reflects are
+// dropped from pending. Caller must hold the store lock.
+func (s *kubeStore) leases() (map[string]*hyperdhcpv1beta1.DHCPLease, error) {
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	var list hyperdhcpv1beta1.DHCPLeaseList
+	if err := s.cache.List(ctx, &list, client.InNamespace(s.namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list leases: %w", err)
+	}
+	leases := make(map[string]*hyperdhcpv1beta1.DHCPLease, len(list.Items))
+	for i := range list.Items {
+		leases[list.Items[i].Name] = &list.Items[i]
+	}
+	for name, write := range s.pending {
+		cached, ok := leases[name]
+		if write.flushed && (write.lease == nil && !ok ||
+			write.lease != nil && ok && equality.Semantic.DeepEqual(cached.Spec, write.lease.Spec)) {
+			delete(s.pending, name)
+			continue
+		}
+		if write.lease == nil {
+			delete(leases, name)
+		} else {
+			leases[name] = write.lease
+		}
+	}
+	return leases, nil
+}
+
+// queue records a write and applies it right away when writes are not
+// batched. Caller must hold the store lock.
+func (s *kubeStore) queue(name string, lease *hyperdhcpv1beta1.DHCPLease) error {
+	if s.closed {
+		return errStoreClosed
+	}
+	write := &kubeWrite{lease: lease}
+	s.pending[name] = write
+	if s.flush > 0 {
+		return nil
+	}
+	if err := s.write(name, lease); err != nil {
+		delete(s.pending, name)
+		return err
+	}
+	write.flushed = true
+	return nil
+}
+
+// write applies a DHCPLease to the API server, or deletes it if lease is nil
+func (s *kubeStore) write(name string, lease *hyperdhcpv1beta1.DHCPLease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	if lease == nil {
+		obj := &hyperdhcpv1beta1.DHCPLease{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.namespace}}
+		if err := s.client.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete lease %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := s.client.Patch(ctx, lease.DeepCopy(), client.Apply, client.FieldOwner(kubeFieldOwner), client.ForceOwnership); err != nil {
+		return fmt.Errorf("failed to apply lease %s: %w", name, err)
+	}
+	return nil
+}
+
+// flushWrites applies the queued writes to the API server. Writes that fail
+// stay queued and are retried on the next flush.
+func (s *kubeStore) flushWrites() error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.Lock()
+	batch := make(map[string]*kubeWrite)
+	for name, write := range s.pending {
+		if !write.flushed {
+			batch[name] = write
+		}
+	}
+	s.Unlock()
+
+	// The lock is not held while talking to the API server, so the plugin is
+	// not blocked by it
+	var failed int
+	var lastErr error
+	for name, write := range batch {
+		if err := s.write(name, write.lease); err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		s.Lock()
+		// A later write may have replaced this one in the meantime
+		write.flushed = true
+		s.Unlock()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d writes failed, last error: %w", failed, len(batch), lastErr)
+	}
+	return nil
+}
+
+// leaseKey returns the key of the client holding a lease
+func leaseKey(spec hyperdhcpv1beta1.DHCPLeaseSpec) (string, error) {
+	if spec.ClientID != "" {
+		return joinClientKey(spec.ClientID, identityClientID)
+	}
+	return joinClientKey(spec.MAC, identityHWAddr)
+}
+
+// bound converts the leases bound to clients to records by client
+func bound(leases map[string]*hyperdhcpv1beta1.DHCPLease) map[string]*Record {
+	records := make(map[string]*Record, len(leases))
+	for _, lease := range leases {
+		if lease.Spec.State != hyperdhcpv1beta1.DHCPLeaseBound {
+			continue
+		}
+		key, err := leaseKey(lease.Spec)
+		if err != nil {
+			log.Warningf("Ignoring lease %s: %v", lease.Name, err)
+			continue
+		}
+		ip := net.ParseIP(lease.Spec.IP)
+		if ip.To4() == nil {
+			log.Warningf("Ignoring lease %s with malformed IPv4 address %q", lease.Name, lease.Spec.IP)
+			continue
+		}
+		record := &Record{
+			IP:       ip,
+			expires:  int(lease.Spec.Expires.Unix()),
+			Hostname: lease.Spec.Hostname,
+			HWAddr:   lease.Spec.MAC,
+			VMI:      lease.Spec.VMI,
+			State:    LeaseBound,
+		}
+		if lease.Spec.FirstSeen != nil {
+			record.firstSeen = int(lease.Spec.FirstSeen.Unix())
+		}
+		if lease.Spec.LastSeen != nil {
+			record.lastSeen = int(lease.Spec.LastSeen.Unix())
+		}
+		nonce, err := decodeNonce(lease.Spec.Nonce)
+		if err != nil {
+			log.Warningf("Ignoring forcerenew nonce of lease %s: %v", lease.Name, err)
+		}
+		record.nonce = nonce
+		records[key] = record
+	}
+	return records
+}
+
+// unixTime converts a unix time to an API time, zero to nil
+func unixTime(t int) *metav1.Time {
+	if t == 0 {
+		return nil
+	}
+	converted := metav1.Unix(int64(t), 0)
+	return &converted
+}
+
+// Load returns all stored leases
+func (s *kubeStore) Load() (map[string]*Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	leases, err := s.leases()
+	if err != nil {
+		return nil, err
+	}
+	return bound(leases), nil
+}
+
+// List returns all stored leases ordered by address
+func (s *kubeStore) List() ([]Lease, error) {
+	records, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(records))
+	for mac, record := range records {
+		leases = append(leases, Lease{MAC: mac, Record: *record})
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].less(leases[j]) })
+	return leases, nil
+}
+
+// Upsert stores the lease of a client, replacing the lease of the address.
+// Leases are stored as bound.
+func (s *kubeStore) Upsert(mac string, record *Record) error {
+	s.Lock()
+	defer s.Unlock()
+	spec := hyperdhcpv1beta1.DHCPLeaseSpec{
+		MAC:       record.HWAddr,
+		State:     hyperdhcpv1beta1.DHCPLeaseBound,
+		Expires:   metav1.Unix(int64(record.expires), 0),
+		Hostname:  record.Hostname,
+		VMI:       record.VMI,
+		FirstSeen: unixTime(record.firstSeen),
+		LastSeen:  unixTime(record.lastSeen),
+		Nonce:     hex.EncodeToString(record.nonce),
+	}
+	if id, idType := splitClientKey(mac); idType == identityClientID {
+		spec.ClientID = id
+	} else {
+		spec.MAC = id
+	}
+	lease := s.newLease(record.IP, spec)
+	return s.queue(lease.Name, lease)
+}
+
+// Delete removes the lease of a client
+func (s *kubeStore) Delete(mac string, record *Record) error {
+	s.Lock()
+	defer s.Unlock()
+	leases, err := s.leases()
+	if err != nil {
+		return err
+	}
+	name := s.objectName(record.IP)
+	lease, ok := leases[name]
+	if !ok || lease.Spec.State != hyperdhcpv1beta1.DHCPLeaseBound {
+		return nil
+	}
+	if holder, err := leaseKey(lease.Spec); err != nil || holder != mac {
+		return nil
+	}
+	return s.queue(name, nil)
+}
+
+// Expired calls fn for each lease that expired before t
+func (s *kubeStore) Expired(t time.Time, fn func(mac string, record *Record) error) error {
+	s.Lock()
+	leases, err := s.leases()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	// The lock is released before calling fn, so it may modify the store
+	for mac, record := range bound(leases) {
+		if int64(record.expires) < t.Unix() {
+			if err := fn(mac, record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadQuarantine returns the declined addresses and when their quarantine ends
+func (s *kubeStore) LoadQuarantine() (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	leases, err := s.leases()
+	if err != nil {
+		return nil, err
+	}
+	quarantine := make(map[string]int)
+	for _, lease := range leases {
+		if lease.Spec.State != hyperdhcpv1beta1.DHCPLeaseDeclined {
+			continue
+		}
+		ip := net.ParseIP(lease.Spec.IP)
+		if ip.To4() == nil {
+			log.Warningf("Ignoring declined lease %s with malformed IPv4 address %q", lease.Name, lease.Spec.IP)
+			continue
+		}
+		quarantine[ip.String()] = int(lease.Spec.Expires.Unix())
+	}
+	return quarantine, nil
+}
+
+// Quarantine stores a declined address, replacing its lease
+func (s *kubeStore) Quarantine(ip net.IP, expires int) error {
+	s.Lock()
+	defer s.Unlock()
+	lease := s.newLease(ip, hyperdhcpv1beta1.DHCPLeaseSpec{
+		State:   hyperdhcpv1beta1.DHCPLeaseDeclined,
+		Expires: metav1.Unix(int64(expires), 0),
+	})
+	return s.queue(lease.Name, lease)
+}
+
+// Unquarantine removes a declined address
+func (s *kubeStore) Unquarantine(ip net.IP) error {
+	s.Lock()
+	defer s.Unlock()
+	leases, err := s.leases()
+	if err != nil {
+		return err
+	}
+	name := s.objectName(ip)
+	lease, ok := leases[name]
+	if !ok || lease.Spec.State != hyperdhcpv1beta1.DHCPLeaseDeclined {
+		return nil
+	}
+	return s.queue(name, nil)
+}
+
+// ForceRenewedConfig returns the configuration the clients were last asked
+// to renew for, kept in the status of the Server
+func (s *kubeStore) ForceRenewedConfig() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	var server hyperdhcpv1beta1.Server
+	if err := s.client.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: s.server}, &server); err != nil {
+		return "", fmt.Errorf("failed to get server %s/%s: %w", s.namespace, s.server, err)
+	}
+	return server.Status.ForceRenewedConfig, nil
+}
+
+// RecordForceRenew stores the configuration the clients are asked to renew
+// for in the status of the Server
+func (s *kubeStore) RecordForceRenew(config string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	server := &hyperdhcpv1beta1.Server{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.server}}
+	patch := client.RawPatch(types.MergePatchType, []byte(fmt.Sprintf(`{"status":{"forceRenewedConfig":%q}}`, config)))
+	if err := s.client.Status().Patch(ctx, server, patch); err != nil {
+		return fmt.Errorf("failed to record forcerenew of server %s/%s: %w", s.namespace, s.server, err)
+	}
+	return nil
+}
+
+// Close flushes the queued writes and stops the cache, the store cannot be
+// used afterwards
+func (s *kubeStore) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.Unlock()
+	close(s.done)
+	err := s.flushWrites()
+	s.cancel()
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	hyperdhcpv1beta1 "github.com/cldmnky/hyperdhcp/api/v1beta1"
+)
+
+// startTestEnv starts an API server with our CRDs like the controller suite
+// does, skipping the test when the envtest binaries are not installed
+func startTestEnv(t *testing.T) (*rest.Config, client.Client) {
+	assets := filepath.Join("..", "..", "..", "..", "bin", "k8s",
+		fmt.Sprintf("1.27.1-%s-%s", runtime.GOOS, runtime.GOARCH))
+	if _, err := os.Stat(assets); err != nil && os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("envtest binaries not found, run make envtest or set KUBEBUILDER_ASSETS")
+	}
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "..", "..", "config", "crd", "bases")},
+		ErrorIfCRDPathMissing: true,
+		BinaryAssetsDirectory: assets,
+	}
+	cfg, err := testEnv.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, testEnv.Stop())
+	})
+
+	scheme := kruntime.NewScheme()
+	require.NoError(t, hyperdhcpv1beta1.AddToScheme(scheme))
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	return cfg, c
+}
+
+// createTestServer creates the Server owning the leases of a store
+func createTestServer(t *testing.T, c client.Client, name string) *hyperdhcpv1beta1.Server {
+	server := &hyperdhcpv1beta1.Server{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	require.NoError(t, c.Create(context.Background(), server))
+	return server
+}
+
+func TestKubeStore(t *testing.T) {
+	cfg, c := startTestEnv(t)
+
+	for _, flush := range []time.Duration{0, 10 * time.Millisecond} {
+		flush := flush
+		t.Run(fmt.Sprintf("flush=%s", flush), func(t *testing.T) {
+			name := fmt.Sprintf("flush-%d", flush.Milliseconds())
+			createTestServer(t, c, name)
+			store, err := newKubeStore(cfg, "default", name, flush)
+			require.NoError(t, err)
+			testLeaseStore(t, store)
+		})
+	}
+}
+
+func TestKubeStoreObjects(t *testing.T) {
+	cfg, c := startTestEnv(t)
+	server := createTestServer(t, c, "objects")
+	other := createTestServer(t, c, "other")
+	ctx := context.Background()
+
+	store, err := newKubeStore(cfg, "default", server.Name, time.Hour)
+	require.NoError(t, err)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, store.Upsert("02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), expires: int(expires.Unix())}))
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 2), int(expires.Unix())))
+
+	// Writes are batched, but visible through the store right away
+	var leases hyperdhcpv1beta1.DHCPLeaseList
+	require.NoError(t, c.List(ctx, &leases, client.InNamespace("default")))
+	assert.Empty(t, leases.Items)
+	records, err := store.Load()
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	require.NoError(t, store.flushWrites())
+	var lease hyperdhcpv1beta1.DHCPLease
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "objects-10-0-0-1"}, &lease))
+	assert.Equal(t, hyperdhcpv1beta1.DHCPLeaseSpec{
+		Server:  "objects",
+		MAC:     "02:00:00:00:00:01",
+		IP:      "10.0.0.1",
+		State:   hyperdhcpv1beta1.DHCPLeaseBound,
+		Expires: metav1.NewTime(expires),
+	}, lease.Spec)
+	assert.Equal(t, "objects", lease.Labels[hyperdhcpv1beta1.DHCPLeaseServerLabel])
+	require.Len(t, lease.OwnerReferences, 1)
+	assert.Equal(t, server.UID, lease.OwnerReferences[0].UID)
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "objects-10-0-0-2"}, &lease))
+	assert.Equal(t, hyperdhcpv1beta1.DHCPLeaseDeclined, lease.Spec.State)
+
+	// A reopened store sees the leases, stores of other servers do not
+	require.NoError(t, store.Close())
+	store, err = newKubeStore(cfg, "default", server.Name, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	records, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"02:00:00:00:00:01": "10.0.0.1 " + expires.UTC().Format(time.RFC3339),
+	}, summarize(records))
+	quarantine, err := store.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.2": int(expires.Unix())}, quarantine)
+
+	otherStore, err := newKubeStore(cfg, "default", other.Name, 0)
+	require.NoError(t, err)
+	defer otherStore.Close()
+	records, err = otherStore.Load()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	_, err = newKubeStore(cfg, "default", "missing", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps leases in memory only. They are lost when the process
+// exits, which makes it suitable for tests and throwaway servers.
+type memoryStore struct {
+	sync.Mutex
+	records    map[string]Record
+	quarantine map[string]int
+	history    []HistoryEntry
+	// forceRenewed is the configuration the clients were asked to renew for
+	forceRenewed string
+}
+
+func init() {
+	registerLeaseStore("memory", openMemoryStore)
+}
+
+// openMemoryStore returns an empty in-memory store. The location of memory://
+// URIs is ignored.
+func openMemoryStore(string) (LeaseStore, error) {
+	return newMemoryStore(), nil
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records:    make(map[string]Record),
+		quarantine: make(map[string]int),
+	}
+}
+
+// Load returns all stored leases
+func (s *memoryStore) Load() (map[string]*Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return nil, errStoreClosed
+	}
+	records := make(map[string]*Record, len(s.records))
+	for mac, record := range s.records {
+		record := record
+		records[mac] = &record
+	}
+	return records, nil
+}
+
+// List returns all stored leases ordered by address
+func (s *memoryStore) List() ([]Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return nil, errStoreClosed
+	}
+	leases := make([]Lease, 0, len(s.records))
+	for mac, record := range s.records {
+		leases = append(leases, Lease{MAC: mac, Record: record})
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].less(leases[j]) })
+	return leases, nil
+}
+
+// Upsert stores the lease of a client, replacing the previous one
+func (s *memoryStore) Upsert(mac string, record *Record) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return errStoreClosed
+	}
+	stored := *record
+	stored.IP = append(net.IP(nil), record.IP...)
+	stored.nonce = append([]byte(nil), record.nonce...)
+	s.records[mac] = stored
+	return nil
+}
+
+// Delete removes the lease of a client
+func (s *memoryStore) Delete(mac string, record *Record) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return errStoreClosed
+	}
+	if stored, ok := s.records[mac]; ok && stored.IP.Equal(record.IP) {
+		delete(s.records, mac)
+	}
+	return nil
+}
+
+// Expired calls fn for each lease that expired before t
+func (s *memoryStore) Expired(t time.Time, fn func(mac string, record *Record) error) error {
+	s.Lock()
+	if s.records == nil {
+		s.Unlock()
+		return errStoreClosed
+	}
+	expired := make(map[string]*Record)
+	for mac, record := range s.records {
+		if int64(record.expires) < t.Unix() {
+			record := record
+			expired[mac] = &record
+		}
+	}
+	// The lock is released before calling fn, so it may modify the store
+	s.Unlock()
+	for mac, record := range expired {
+		if err := fn(mac, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadQuarantine returns the declined addresses and when their quarantine ends
+func (s *memoryStore) LoadQuarantine() (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.quarantine == nil {
+		return nil, errStoreClosed
+	}
+	quarantine := make(map[string]int, len(s.quarantine))
+	for ip, expires := range s.quarantine {
+		quarantine[ip] = expires
+	}
+	return quarantine, nil
+}
+
+// Quarantine stores a declined address
+func (s *memoryStore) Quarantine(ip net.IP, expires int) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.quarantine == nil {
+		return errStoreClosed
+	}
+	s.quarantine[ip.String()] = expires
+	return nil
+}
+
+// Unquarantine removes a declined address
+func (s *memoryStore) Unquarantine(ip net.IP) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.quarantine == nil {
+		return errStoreClosed
+	}
+	delete(s.quarantine, ip.String())
+	return nil
+}
+
+// ForceRenewedConfig returns the configuration the clients were last asked
+// to renew for
+func (s *memoryStore) ForceRenewedConfig() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return "", errStoreClosed
+	}
+	return s.forceRenewed, nil
+}
+
+// RecordForceRenew stores the configuration the clients are asked to renew for
+func (s *memoryStore) RecordForceRenew(config string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return errStoreClosed
+	}
+	s.forceRenewed = config
+	return nil
+}
+
+// AppendHistory adds an entry to the lease history
+func (s *memoryStore) AppendHistory(entry HistoryEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return errStoreClosed
+	}
+	entry.IP = append(net.IP(nil), entry.IP...)
+	s.history = append(s.history, entry)
+	return nil
+}
+
+// History returns the entries of the lease history selected by a query
+func (s *memoryStore) History(q HistoryQuery) ([]HistoryEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return nil, errStoreClosed
+	}
+	var entries []HistoryEntry
+	for _, entry := range s.history {
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return sortHistory(entries, q), nil
+}
+
+// PruneHistory drops the entries describing leases that ended before t
+func (s *memoryStore) PruneHistory(t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records == nil {
+		return errStoreClosed
+	}
+	kept := s.history[:0]
+	for _, entry := range s.history {
+		if !entry.Expires.Before(t) {
+			kept = append(kept, entry)
+		}
+	}
+	s.history = kept
+	return nil
+}
+
+// Close drops the stored leases, the store cannot be used afterwards
+func (s *memoryStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = nil
+	s.quarantine = nil
+	s.history = nil
+	return nil
+}
+
+var errStoreClosed = errors.New("lease store is closed")
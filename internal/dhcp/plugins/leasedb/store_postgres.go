@@ -0,0 +1,316 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresSchemaLock is the advisory lock key serializing schema creation when
+// several servers start at once
+const postgresSchemaLock = 0x68797065 // "hype"
+
+// postgresStore keeps leases in a PostgreSQL database, which several servers
+// may share. The addresses are unique in the lease table and claims lock the
+// rows of an address, so two servers never lease an address to two clients.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func init() {
+	registerLeaseStore("postgres", openPostgresStore("postgres://"))
+	registerLeaseStore("postgresql", openPostgresStore("postgresql://"))
+}
+
+// openPostgresStore returns the function opening the store for a URI scheme.
+// The location is the rest of a libpq connection URI.
+func openPostgresStore(prefix string) func(location string) (LeaseStore, error) {
+	return func(location string) (LeaseStore, error) {
+		return newPostgresStore(prefix + location)
+	}
+}
+
+// newPostgresStore connects to the database of a connection string and brings
+// its schema up to date
+func newPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer tx.Rollback()
+	// Servers sharing the database migrate it one after the other
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", postgresSchemaLock)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to lock database schema: %w", err)
+	}
+	if err := migrate(tx, postgresMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("schema migration failed: %w", err)
+	}
+	return &postgresStore{db: db}, nil
+}
+
+// postgresMigrations are the versions of the schema of PostgreSQL databases.
+// Appending a migration upgrades existing databases on startup.
+var postgresMigrations = []migration{
+	{"create lease and quarantine tables", statements(
+		"CREATE TABLE IF NOT EXISTS leases4 (mac TEXT NOT NULL, ip TEXT NOT NULL, expiry BIGINT, PRIMARY KEY (mac, ip))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS leases4_ip ON leases4 (ip)",
+		"CREATE TABLE IF NOT EXISTS quarantine4 (ip TEXT PRIMARY KEY, expiry BIGINT)",
+	)},
+	// Leases stored before are keyed by MAC
+	{"key leases by client identity", statements(
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS idtype TEXT NOT NULL DEFAULT 'hwaddr'",
+	)},
+	{"record lease details", statements(
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS hostname TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS hwaddr TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS vmi TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'bound'",
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS first_seen BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS last_seen BIGINT NOT NULL DEFAULT 0",
+		"UPDATE leases4 SET hwaddr = mac WHERE idtype = 'hwaddr'",
+	)},
+	{"keep a lease history", statements(
+		"CREATE TABLE IF NOT EXISTS history4 (at BIGINT NOT NULL, event TEXT NOT NULL, mac TEXT NOT NULL, idtype TEXT NOT NULL, ip TEXT NOT NULL, hwaddr TEXT NOT NULL, hostname TEXT NOT NULL, vmi TEXT NOT NULL, expiry BIGINT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS history4_ip ON history4 (ip, at)",
+		"CREATE INDEX IF NOT EXISTS history4_hwaddr ON history4 (hwaddr, at)",
+		"CREATE INDEX IF NOT EXISTS history4_expiry ON history4 (expiry)",
+	)},
+	{"keep forcerenew nonces", statements(
+		"ALTER TABLE leases4 ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT ''",
+	)},
+	{"remember the forcerenew configuration", statements(
+		"CREATE TABLE IF NOT EXISTS settings4 (name TEXT PRIMARY KEY, setting TEXT NOT NULL)",
+	)},
+}
+
+// postgresStatements are the statements writing to a PostgreSQL database
+var postgresStatements = sqlStatements{
+	upsert: `INSERT INTO leases4 (` + leaseColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	ON CONFLICT (mac, ip) DO UPDATE SET idtype = EXCLUDED.idtype, expiry = EXCLUDED.expiry,
+	hostname = EXCLUDED.hostname, hwaddr = EXCLUDED.hwaddr, vmi = EXCLUDED.vmi, state = EXCLUDED.state,
+	first_seen = EXCLUDED.first_seen, last_seen = EXCLUDED.last_seen, nonce = EXCLUDED.nonce`,
+	delete: "DELETE FROM leases4 WHERE mac = $1 AND ip = $2 AND idtype = $3",
+	quarantine: `INSERT INTO quarantine4 (ip, expiry) VALUES ($1, $2)
+	ON CONFLICT (ip) DO UPDATE SET expiry = EXCLUDED.expiry`,
+	unquarantine:  "DELETE FROM quarantine4 WHERE ip = $1",
+	appendHistory: `INSERT INTO history4 (` + historyColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+	setting: `INSERT INTO settings4 (name, setting) VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE SET setting = EXCLUDED.setting`,
+}
+
+// Load returns all stored leases
+func (s *postgresStore) Load() (map[string]*Record, error) {
+	return loadRecords(s.db)
+}
+
+// List returns all stored leases ordered by address
+func (s *postgresStore) List() ([]Lease, error) {
+	records, err := loadRecords(s.db)
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(records))
+	for mac, record := range records {
+		leases = append(leases, Lease{MAC: mac, Record: *record})
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].less(leases[j]) })
+	return leases, nil
+}
+
+// Upsert writes out a lease to storage
+func (s *postgresStore) Upsert(mac string, record *Record) error {
+	return postgresStatements.exec(s.db, storeOp{kind: opUpsert, client: mac, record: *record})
+}
+
+// Claim writes out a new lease to storage unless another client holds an
+// unexpired lease on the address or the address is quarantined. The rows of
+// the address are locked until the lease is written, a client claiming the
+// address at the same time through another server waits for them, then finds
+// the lease.
+func (s *postgresStore) Claim(mac string, record *Record) (*Lease, error) {
+	holder, err := s.claim(mac, record)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// A lease for the address was inserted since we looked, there was
+		// no row to lock yet. Claiming again returns it.
+		holder, err = s.claim(mac, record)
+	}
+	return holder, err
+}
+
+func (s *postgresStore) claim(mac string, record *Record) (*Lease, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("transaction start failed: %w", err)
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	ip := record.IP.String()
+
+	var quarantined int
+	err = tx.QueryRow("SELECT expiry FROM quarantine4 WHERE ip = $1 FOR UPDATE", ip).Scan(&quarantined)
+	switch {
+	case err == nil && int64(quarantined) >= now:
+		return &Lease{Record: Record{IP: record.IP, expires: quarantined}}, nil
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("failed to query quarantine table: %w", err)
+	}
+
+	rows, err := tx.Query("SELECT mac, idtype, expiry FROM leases4 WHERE ip = $1 FOR UPDATE", ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases database: %w", err)
+	}
+	var (
+		id, idType string
+		expiry     int
+		expired    []string
+	)
+	for rows.Next() {
+		if err := rows.Scan(&id, &idType, &expiry); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		holder, err := joinClientKey(id, idType)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if holder == mac {
+			continue
+		}
+		if int64(expiry) >= now {
+			rows.Close()
+			return &Lease{MAC: holder, Record: Record{IP: record.IP, expires: expiry}}, nil
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+
+	// The expired leases of the address are taken over
+	for _, holder := range expired {
+		if _, err := tx.Exec("DELETE FROM leases4 WHERE mac = $1 AND ip = $2", holder, ip); err != nil {
+			return nil, fmt.Errorf("record delete failed: %w", err)
+		}
+	}
+	if err := postgresStatements.exec(tx, storeOp{kind: opUpsert, client: mac, record: *record}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("transaction commit failed: %w", err)
+	}
+	return nil, nil
+}
+
+// Delete removes a lease from storage
+func (s *postgresStore) Delete(mac string, record *Record) error {
+	return postgresStatements.exec(s.db, storeOp{kind: opDelete, client: mac, record: *record})
+}
+
+// Expired calls fn for each lease that expired before t
+func (s *postgresStore) Expired(t time.Time, fn func(mac string, record *Record) error) error {
+	rows, err := s.db.Query("SELECT "+leaseColumns+" FROM leases4 WHERE expiry < $1", t.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to query leases database: %w", err)
+	}
+	expired := make(map[string]*Record)
+	for rows.Next() {
+		key, record, err := scanLease(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired[key] = record
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	// The rows are closed before calling fn, so it may modify the database
+	for mac, record := range expired {
+		if err := fn(mac, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadQuarantine returns the declined addresses and when their quarantine ends
+func (s *postgresStore) LoadQuarantine() (map[string]int, error) {
+	return loadQuarantine(s.db)
+}
+
+// Quarantine writes out a declined address to storage
+func (s *postgresStore) Quarantine(ip net.IP, expires int) error {
+	return postgresStatements.exec(s.db, storeOp{kind: opQuarantine, ip: ip, expires: expires})
+}
+
+// Unquarantine removes a declined address from storage
+func (s *postgresStore) Unquarantine(ip net.IP) error {
+	return postgresStatements.exec(s.db, storeOp{kind: opUnquarantine, ip: ip})
+}
+
+// ForceRenewedConfig returns the configuration the clients were last asked
+// to renew for
+func (s *postgresStore) ForceRenewedConfig() (string, error) {
+	return loadSetting(s.db, "SELECT setting FROM settings4 WHERE name = $1", forceRenewSetting)
+}
+
+// RecordForceRenew stores the configuration the clients are asked to renew for
+func (s *postgresStore) RecordForceRenew(config string) error {
+	return postgresStatements.setSetting(s.db, forceRenewSetting, config)
+}
+
+// AppendHistory adds an entry to the lease history
+func (s *postgresStore) AppendHistory(entry HistoryEntry) error {
+	return postgresStatements.exec(s.db, storeOp{kind: opAppendHistory, entry: entry})
+}
+
+// writeBatch writes changes in a single transaction
+func (s *postgresStore) writeBatch(ops []storeOp) error {
+	return postgresStatements.writeBatch(s.db, ops)
+}
+
+// History returns the entries of the lease history selected by a query
+func (s *postgresStore) History(q HistoryQuery) ([]HistoryEntry, error) {
+	return queryHistory(s.db, q, func(n int) string { return fmt.Sprintf("$%d", n) })
+}
+
+// PruneHistory drops the entries describing leases that ended before t
+func (s *postgresStore) PruneHistory(t time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM history4 WHERE expiry < $1", t.Unix()); err != nil {
+		return fmt.Errorf("history delete failed: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,148 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postgresTestDSN names the environment variable holding the connection string
+// of a scratch PostgreSQL database, each test creates its tables in a schema of
+// its own and drops it
+const postgresTestDSN = "HYPERDHCP_TEST_POSTGRES"
+
+// postgresTestSchema creates an empty schema for the test and returns the
+// connection string of the database using it, skipping the test when no
+// database is configured
+func postgresTestSchema(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv(postgresTestDSN)
+	if dsn == "" {
+		t.Skipf("%s not set, e.g. postgres://postgres@localhost/postgres?sslmode=disable", postgresTestDSN)
+	}
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	schema := fmt.Sprintf("hyperdhcp_test_%d", time.Now().UnixNano())
+	_, err = db.Exec("CREATE SCHEMA " + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db, err := sql.Open("pgx", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		assert.NoError(t, err)
+	})
+	// Unknown parameters are run-time parameters of the connections
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// openTestPostgresStore opens a store on empty lease tables, skipping the test
+// when no database is configured
+func openTestPostgresStore(t *testing.T) LeaseStore {
+	t.Helper()
+	store, err := newPostgresStore(postgresTestSchema(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestPostgresStoreClaim(t *testing.T) {
+	dsn := postgresTestSchema(t)
+	first, err := newPostgresStore(dsn)
+	require.NoError(t, err)
+	defer first.Close()
+	// A second server sharing the lease table
+	second, err := newPostgresStore(dsn)
+	require.NoError(t, err)
+	defer second.Close()
+
+	now := time.Now()
+	future := int(now.Add(time.Hour).Unix())
+	past := int(now.Add(-time.Hour).Unix())
+	ip := net.IPv4(10, 0, 0, 1)
+
+	holder, err := first.Claim("02:00:00:00:00:01", &Record{IP: ip, expires: future})
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+	// Claiming again extends the lease of the client
+	holder, err = second.Claim("02:00:00:00:00:01", &Record{IP: ip, expires: future + 60})
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+
+	holder, err = second.Claim("02:00:00:00:00:02", &Record{IP: ip, expires: future})
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Equal(t, "02:00:00:00:00:01", holder.MAC)
+	assert.Equal(t, future+60, holder.expires)
+
+	// Expired leases are taken over
+	require.NoError(t, first.Upsert("02:00:00:00:00:01", &Record{IP: ip, expires: past}))
+	holder, err = second.Claim("02:00:00:00:00:02", &Record{IP: ip, expires: future})
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+	stored, err := first.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"02:00:00:00:00:02": "10.0.0.1 " + time.Unix(int64(future), 0).UTC().Format(time.RFC3339),
+	}, summarize(stored))
+
+	// Quarantined addresses cannot be claimed
+	quarantined := net.IPv4(10, 0, 0, 2)
+	require.NoError(t, first.Quarantine(quarantined, future))
+	holder, err = second.Claim("02:00:00:00:00:03", &Record{IP: quarantined, expires: future})
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Empty(t, holder.MAC)
+	assert.Equal(t, future, holder.expires)
+}
+
+func TestPostgresStoreConcurrentClaims(t *testing.T) {
+	store := openTestPostgresStore(t).(*postgresStore)
+	future := int(time.Now().Add(time.Hour).Unix())
+
+	const clients = 8
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		winners []string
+	)
+	for i := 0; i < clients; i++ {
+		mac := fmt.Sprintf("02:00:00:00:00:%02x", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			holder, err := store.Claim(mac, &Record{IP: net.IPv4(10, 0, 0, 1), expires: future})
+			assert.NoError(t, err)
+			if err == nil && holder == nil {
+				mu.Lock()
+				winners = append(winners, mac)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, winners, 1, "exactly one client gets the address")
+	stored, err := store.Load()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Contains(t, stored, winners[0])
+}
@@ -0,0 +1,736 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	// defaultRaftPort is the port replicas talk to each other on
+	defaultRaftPort = "7000"
+	// defaultRaftDiscoverInterval is how often the replicas are looked up
+	defaultRaftDiscoverInterval = 5 * time.Second
+	// raftTimeout bounds replicating a write and catching up as new leader
+	raftTimeout = 5 * time.Second
+	// raftSnapshotsRetained is how many snapshots are kept in the directory
+	// of a replica
+	raftSnapshotsRetained = 2
+)
+
+// raftStore keeps leases in memory on each replica of a DHCP server, and
+// replicates them with Raft. Only the leader writes, the followers apply its
+// writes to their copy, so one of them can take over with all the leases when
+// the leader goes away. The Raft log and snapshots are kept in a directory,
+// a replica that restarts gets its leases back from them, even if all the
+// replicas restart at once.
+//
+// Replicas are identified by their host name, which the pods of a
+// StatefulSet keep across restarts, and reach each other by the DNS names of
+// the peers, like <pod>.<headless Service>. A replica only bootstraps the
+// cluster when all its peers answer and none of them is part of a cluster
+// already, see raftStatus. From then on the leader adds the peers that are
+// not part of the cluster and removes the ones that are not peers anymore.
+type raftStore struct {
+	// state is the copy of the leases of this replica, written by raftFSM
+	state     *memoryStore
+	raft      *raft.Raft
+	transport raft.Transport
+	id        raft.ServerID
+	peers     []raft.Server
+	// peerStatus asks a peer for its status
+	peerStatus func(peer raft.Server) (raftStatus, error)
+	interval   time.Duration
+	// closers close the log store and the status endpoint, if any
+	closers []io.Closer
+
+	mu        sync.Mutex
+	leading   bool
+	listeners []func(leading bool)
+	done      chan struct{}
+}
+
+// raftOptions configures a raftStore
+type raftOptions struct {
+	// transport connects the replicas
+	transport raft.Transport
+	// id identifies this replica among the peers
+	id raft.ServerID
+	// peers are all the replicas, including this one
+	peers []raft.Server
+	// peerStatus asks a peer for its status
+	peerStatus func(peer raft.Server) (raftStatus, error)
+	// dir is the directory the log and snapshots are kept in, they are kept
+	// in memory if it is empty
+	dir string
+	// interval is how often the cluster is checked
+	interval time.Duration
+	// config overrides the Raft configuration, for tests
+	config *raft.Config
+}
+
+// raftStatus is the status a replica reports to its peers and to the
+// readiness probe of its pod
+type raftStatus struct {
+	ID raft.ServerID `json:"id"`
+	// Configured is set once the replica is part of a cluster, bootstrapped
+	// or added by a leader
+	Configured bool `json:"configured"`
+	// Joined is set while the replica is part of the cluster and follows or
+	// is its leader
+	Joined bool `json:"joined"`
+}
+
+// raftCommand is a write replicated through the Raft log
+type raftCommand struct {
+	Op  string `json:"op"`
+	MAC string `json:"mac,omitempty"`
+	// Config is the configuration the clients are asked to renew for
+	Config string `json:"config,omitempty"`
+	raftLease
+}
+
+const (
+	raftUpsert       = "upsert"
+	raftDelete       = "delete"
+	raftQuarantine   = "quarantine"
+	raftUnquarantine = "unquarantine"
+	raftForceRenew   = "forcerenew"
+)
+
+func init() {
+	registerLeaseStore("raft", openRaftStore)
+}
+
+// openRaftStore opens the store for a location like
+// <bind address>?dir=<directory>&peers=<host>[,<host>...]. The first label of
+// the host name of a peer is its ID, this replica is the peer whose ID is its
+// host name, or the one set with id=<id>. Without peers the replica is alone.
+// The status of the replica is served on the next port after the one of the
+// peers, or on status=<address>.
+func openRaftStore(location string) (LeaseStore, error) {
+	u, err := url.Parse("raft://" + location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft lease store %q: %w", location, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultRaftPort
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft port %q", port)
+	}
+	query := u.Query()
+
+	dir := query.Get("dir")
+	if dir == "" {
+		return nil, errors.New("raft lease store needs a dir to keep its log in")
+	}
+	id := query.Get("id")
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not find the ID of the replica, set id: %w", err)
+		}
+		id, _, _ = strings.Cut(hostname, ".")
+	}
+	statusAddr := query.Get("status")
+	if statusAddr == "" {
+		statusAddr = net.JoinHostPort(u.Hostname(), strconv.Itoa(portNumber+1))
+	}
+	_, statusPort, err := net.SplitHostPort(statusAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status address %q", statusAddr)
+	}
+	interval := defaultRaftDiscoverInterval
+	if v := query.Get("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid discovery interval %q", v)
+		}
+	}
+
+	var peers []raft.Server
+	if v := query.Get("peers"); v != "" {
+		for _, host := range strings.Split(v, ",") {
+			peerID, _, _ := strings.Cut(host, ".")
+			peers = append(peers, raft.Server{
+				ID:      raft.ServerID(peerID),
+				Address: raft.ServerAddress(net.JoinHostPort(host, port)),
+			})
+		}
+	} else {
+		peers = []raft.Server{{ID: raft.ServerID(id), Address: raft.ServerAddress(net.JoinHostPort(id, port))}}
+	}
+	var advertise raft.ServerAddress
+	for _, peer := range peers {
+		if peer.ID == raft.ServerID(id) {
+			advertise = peer.Address
+		}
+	}
+	if advertise == "" {
+		return nil, fmt.Errorf("replica %s is not one of the peers", id)
+	}
+
+	bind := net.JoinHostPort(u.Hostname(), port)
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for peers on %s: %w", bind, err)
+	}
+	transport := raft.NewNetworkTransport(&raftStreamLayer{Listener: ln, advertise: raftAddr(advertise)}, 3, raftTimeout, log.Writer())
+	client := &http.Client{Timeout: raftTimeout}
+	s, err := newRaftStore(raftOptions{
+		transport: transport,
+		id:        raft.ServerID(id),
+		peers:     peers,
+		peerStatus: func(peer raft.Server) (raftStatus, error) {
+			host, _, _ := net.SplitHostPort(string(peer.Address))
+			return getRaftStatus(client, "http://"+net.JoinHostPort(host, statusPort)+"/status")
+		},
+		dir:      dir,
+		interval: interval,
+	})
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	if err := s.listenStatus(statusAddr); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// raftStreamLayer connects the replicas over TCP. It advertises the DNS name
+// of the replica rather than its address, which changes when it restarts.
+type raftStreamLayer struct {
+	net.Listener
+	advertise raftAddr
+}
+
+// raftAddr is the DNS name and port of a replica
+type raftAddr string
+
+func (a raftAddr) Network() string { return "tcp" }
+func (a raftAddr) String() string  { return string(a) }
+
+// Dial connects to a replica
+func (l *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+// Addr returns the address advertised to the peers
+func (l *raftStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// getRaftStatus asks a replica for its status at url
+func getRaftStatus(client *http.Client, url string) (raftStatus, error) {
+	var status raftStatus
+	resp, err := client.Get(url)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("malformed status: %w", err)
+	}
+	return status, nil
+}
+
+// newRaftStore starts a replica. It stands by until it is elected leader,
+// see NotifyLeadership.
+func newRaftStore(opts raftOptions) (*raftStore, error) {
+	config := opts.config
+	if config == nil {
+		config = raft.DefaultConfig()
+		config.LogOutput = log.Writer()
+		config.LogLevel = "WARN"
+	}
+	config.LocalID = opts.id
+
+	var (
+		logs      raft.LogStore
+		stable    raft.StableStore
+		snapshots raft.SnapshotStore
+		closers   []io.Closer
+	)
+	if opts.dir == "" {
+		inmem := raft.NewInmemStore()
+		logs, stable, snapshots = inmem, inmem, raft.NewInmemSnapshotStore()
+	} else {
+		if err := os.MkdirAll(opts.dir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create raft directory: %w", err)
+		}
+		bolt, err := raftboltdb.NewBoltStore(filepath.Join(opts.dir, "raft.db"))
+		if err != nil {
+			return nil, fmt.Errorf("could not open raft log: %w", err)
+		}
+		files, err := raft.NewFileSnapshotStore(opts.dir, raftSnapshotsRetained, log.Writer())
+		if err != nil {
+			bolt.Close()
+			return nil, fmt.Errorf("could not open raft snapshots: %w", err)
+		}
+		logs, stable, snapshots = bolt, bolt, files
+		closers = append(closers, bolt)
+	}
+
+	state := newMemoryStore()
+	r, err := raft.NewRaft(config, &raftFSM{state: state}, logs, stable, snapshots, opts.transport)
+	if err != nil {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("could not start raft: %w", err)
+	}
+	s := &raftStore{
+		state:      state,
+		raft:       r,
+		transport:  opts.transport,
+		id:         opts.id,
+		peers:      opts.peers,
+		peerStatus: opts.peerStatus,
+		interval:   opts.interval,
+		closers:    closers,
+		done:       make(chan struct{}),
+	}
+	go s.watchLeadership()
+	go s.run()
+	return s, nil
+}
+
+// watchLeadership tells the listeners when this replica becomes or stops
+// being the leader. A new leader first waits until it has applied all the
+// writes of the previous one.
+func (s *raftStore) watchLeadership() {
+	for {
+		select {
+		case leading := <-s.raft.LeaderCh():
+			if leading {
+				if err := s.raft.Barrier(raftTimeout).Error(); err != nil {
+					log.Errorf("Could not catch up with the lease store replicas as new leader: %v", err)
+					leading = false
+				}
+			}
+			s.setLeading(leading)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// setLeading records and announces a leadership change. Becoming leader is
+// always announced, LeaderCh may have dropped the loss in between.
+func (s *raftStore) setLeading(leading bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !leading && !s.leading {
+		return
+	}
+	s.leading = leading
+	for _, fn := range s.listeners {
+		fn(leading)
+	}
+}
+
+// NotifyLeadership registers fn to be called when this replica becomes or
+// stops being the leader
+func (s *raftStore) NotifyLeadership(fn func(leading bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+	if s.leading {
+		fn(true)
+	}
+}
+
+// isLeading reports whether this replica leads and is caught up
+func (s *raftStore) isLeading() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leading
+}
+
+// status returns the status of this replica
+func (s *raftStore) status() raftStatus {
+	status := raftStatus{ID: s.id}
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return status
+	}
+	servers := future.Configuration().Servers
+	status.Configured = len(servers) > 0
+	if _, leader := s.raft.LeaderWithID(); leader != "" {
+		for _, server := range servers {
+			if server.ID == s.id {
+				status.Joined = true
+			}
+		}
+	}
+	return status
+}
+
+// statusHandler serves the status of this replica on /status, and on
+// /readyz whether it joined the cluster, for the readiness probe of its pod
+func (s *raftStore) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.status()); err != nil {
+			log.Warningf("Could not answer lease store status request: %v", err)
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.status().Joined {
+			http.Error(w, "not joined to the lease store replicas", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// listenStatus serves the status of this replica on addr until it is closed
+func (s *raftStore) listenStatus(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on raft status address %s: %w", addr, err)
+	}
+	server := &http.Server{
+		Handler:           s.statusHandler(),
+		ReadHeaderTimeout: raftTimeout,
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Raft status endpoint on %s failed: %v", addr, err)
+		}
+	}()
+	s.closers = append(s.closers, server)
+	return nil
+}
+
+// run bootstraps the cluster when it does not exist yet, then keeps the
+// replicas the leader knows of up to date with the peers
+func (s *raftStore) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		if s.raft.State() == raft.Leader {
+			s.reconcile()
+			continue
+		}
+		s.bootstrap()
+	}
+}
+
+// bootstrap creates the cluster with the peers, unless this replica is part
+// of a cluster already. A peer that is part of one adds this replica when
+// it leads, and a peer that does not answer may be part of one, so the
+// cluster is only created when all the peers answer that they are not.
+// Peers that bootstrap together do so with the same configuration, which
+// Raft allows.
+func (s *raftStore) bootstrap() {
+	if s.status().Configured {
+		return
+	}
+	for _, peer := range s.peers {
+		if peer.ID == s.id {
+			continue
+		}
+		status, err := s.peerStatus(peer)
+		if err != nil {
+			log.Printf("Waiting for lease store replica %s: %v", peer.ID, err)
+			return
+		}
+		if status.Configured {
+			log.Printf("Lease store replica %s is part of a cluster, waiting to be added", peer.ID)
+			return
+		}
+	}
+	log.Printf("Bootstrapping lease store replicas %v", s.peers)
+	if err := s.raft.BootstrapCluster(raft.Configuration{Servers: s.peers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+		log.Errorf("Could not bootstrap lease store replicas: %v", err)
+	}
+}
+
+// reconcile adds the peers that are not part of the cluster and removes the
+// replicas that are not peers anymore. Only the leader can do so. Replicas
+// that restart keep their ID and address, and stay part of the cluster.
+func (s *raftStore) reconcile() {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return
+	}
+	known := make(map[raft.ServerID]raft.ServerAddress)
+	for _, server := range future.Configuration().Servers {
+		known[server.ID] = server.Address
+	}
+	peers := make(map[raft.ServerID]bool)
+	for _, peer := range s.peers {
+		peers[peer.ID] = true
+		if address, ok := known[peer.ID]; ok && address == peer.Address {
+			continue
+		}
+		log.Printf("Adding lease store replica %s at %s", peer.ID, peer.Address)
+		if err := s.raft.AddVoter(peer.ID, peer.Address, 0, raftTimeout).Error(); err != nil {
+			log.Warningf("Could not add lease store replica %s: %v", peer.ID, err)
+		}
+	}
+	for id := range known {
+		if peers[id] || id == s.id {
+			continue
+		}
+		log.Printf("Removing lease store replica %s", id)
+		if err := s.raft.RemoveServer(id, 0, raftTimeout).Error(); err != nil {
+			log.Warningf("Could not remove lease store replica %s: %v", id, err)
+		}
+	}
+}
+
+// apply replicates a write. It fails unless this replica is the leader.
+func (s *raftStore) apply(cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := s.raft.Apply(data, raftTimeout)
+	if err := future.Error(); err != nil {
+		if cmd.IP == "" {
+			return fmt.Errorf("could not replicate %s: %w", cmd.Op, err)
+		}
+		return fmt.Errorf("could not replicate %s of %s: %w", cmd.Op, cmd.IP, err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Load returns all stored leases
+func (s *raftStore) Load() (map[string]*Record, error) {
+	return s.state.Load()
+}
+
+// List returns all stored leases ordered by address
+func (s *raftStore) List() ([]Lease, error) {
+	return s.state.List()
+}
+
+// Upsert stores the lease of a client on all replicas
+func (s *raftStore) Upsert(mac string, record *Record) error {
+	return s.apply(raftCommand{Op: raftUpsert, MAC: mac, raftLease: newRaftLease(record)})
+}
+
+// Delete removes the lease of a client from all replicas
+func (s *raftStore) Delete(mac string, record *Record) error {
+	return s.apply(raftCommand{Op: raftDelete, MAC: mac, raftLease: raftLease{IP: record.IP.String()}})
+}
+
+// Expired calls fn for each lease that expired before t
+func (s *raftStore) Expired(t time.Time, fn func(mac string, record *Record) error) error {
+	return s.state.Expired(t, fn)
+}
+
+// LoadQuarantine returns the declined addresses and when their quarantine ends
+func (s *raftStore) LoadQuarantine() (map[string]int, error) {
+	return s.state.LoadQuarantine()
+}
+
+// Quarantine stores a declined address on all replicas
+func (s *raftStore) Quarantine(ip net.IP, expires int) error {
+	return s.apply(raftCommand{Op: raftQuarantine, raftLease: raftLease{IP: ip.String(), Expires: expires}})
+}
+
+// Unquarantine removes a declined address from all replicas
+func (s *raftStore) Unquarantine(ip net.IP) error {
+	return s.apply(raftCommand{Op: raftUnquarantine, raftLease: raftLease{IP: ip.String()}})
+}
+
+// ForceRenewedConfig returns the configuration the clients were last asked
+// to renew for
+func (s *raftStore) ForceRenewedConfig() (string, error) {
+	return s.state.ForceRenewedConfig()
+}
+
+// RecordForceRenew stores the configuration the clients are asked to renew
+// for on all replicas
+func (s *raftStore) RecordForceRenew(config string) error {
+	return s.apply(raftCommand{Op: raftForceRenew, Config: config})
+}
+
+// Close leaves the replicas, the store cannot be used afterwards. The other
+// replicas elect a new leader if this one was leading.
+func (s *raftStore) Close() error {
+	close(s.done)
+	err := s.raft.Shutdown().Error()
+	if closer, ok := s.transport.(io.Closer); ok {
+		closer.Close()
+	}
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+	s.state.Close()
+	return err
+}
+
+// raftFSM applies the replicated writes to the copy of the leases of a replica
+type raftFSM struct {
+	state *memoryStore
+}
+
+// Apply applies a write, returning an error if it failed
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return fmt.Errorf("malformed replicated write: %w", err)
+	}
+	if cmd.Op == raftForceRenew {
+		return f.state.RecordForceRenew(cmd.Config)
+	}
+	ip := net.ParseIP(cmd.IP)
+	if ip == nil {
+		return fmt.Errorf("malformed address %q in replicated write", cmd.IP)
+	}
+	switch cmd.Op {
+	case raftUpsert:
+		record := cmd.record()
+		return f.state.Upsert(cmd.MAC, &record)
+	case raftDelete:
+		return f.state.Delete(cmd.MAC, &Record{IP: ip})
+	case raftQuarantine:
+		return f.state.Quarantine(ip, cmd.Expires)
+	case raftUnquarantine:
+		return f.state.Unquarantine(ip)
+	}
+	return fmt.Errorf("unknown replicated write %q", cmd.Op)
+}
+
+// raftSnapshot is a copy of the leases of a replica
+type raftSnapshot struct {
+	Leases     map[string]raftLease `json:"leases"`
+	Quarantine map[string]int       `json:"quarantine"`
+	// ForceRenewed is the configuration the clients were last asked to
+	// renew for
+	ForceRenewed string `json:"forceRenewed,omitempty"`
+}
+
+// raftLease is a lease as replicated
+type raftLease struct {
+	IP        string     `json:"ip"`
+	Expires   int        `json:"expires,omitempty"`
+	Hostname  string     `json:"hostname,omitempty"`
+	HWAddr    string     `json:"hwaddr,omitempty"`
+	VMI       string     `json:"vmi,omitempty"`
+	State     LeaseState `json:"state,omitempty"`
+	FirstSeen int        `json:"firstSeen,omitempty"`
+	LastSeen  int        `json:"lastSeen,omitempty"`
+	Nonce     []byte     `json:"nonce,omitempty"`
+}
+
+func newRaftLease(record *Record) raftLease {
+	return raftLease{
+		IP:        record.IP.String(),
+		Expires:   record.expires,
+		Hostname:  record.Hostname,
+		HWAddr:    record.HWAddr,
+		VMI:       record.VMI,
+		State:     record.State,
+		FirstSeen: record.firstSeen,
+		LastSeen:  record.lastSeen,
+		Nonce:     record.nonce,
+	}
+}
+
+func (l raftLease) record() Record {
+	return Record{
+		IP:        net.ParseIP(l.IP),
+		expires:   l.Expires,
+		Hostname:  l.Hostname,
+		HWAddr:    l.HWAddr,
+		VMI:       l.VMI,
+		State:     l.State,
+		firstSeen: l.FirstSeen,
+		lastSeen:  l.LastSeen,
+		nonce:     l.Nonce,
+	}
+}
+
+// Snapshot copies the leases, so the log can be compacted
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.state.Lock()
+	defer f.state.Unlock()
+	if f.state.records == nil {
+		return nil, errStoreClosed
+	}
+	snapshot := &raftSnapshot{
+		Leases:       make(map[string]raftLease, len(f.state.records)),
+		Quarantine:   make(map[string]int, len(f.state.quarantine)),
+		ForceRenewed: f.state.forceRenewed,
+	}
+	for mac, record := range f.state.records {
+		snapshot.Leases[mac] = newRaftLease(&record)
+	}
+	for ip, expires := range f.state.quarantine {
+		snapshot.Quarantine[ip] = expires
+	}
+	return snapshot, nil
+}
+
+// Restore replaces the leases with the ones of a snapshot
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snapshot raftSnapshot
+	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
+		return fmt.Errorf("malformed lease snapshot: %w", err)
+	}
+	records := make(map[string]Record, len(snapshot.Leases))
+	for mac, lease := range snapshot.Leases {
+		records[mac] = lease.record()
+	}
+	f.state.Lock()
+	defer f.state.Unlock()
+	f.state.records = records
+	f.state.quarantine = snapshot.Quarantine
+	f.state.forceRenewed = snapshot.ForceRenewed
+	if f.state.quarantine == nil {
+		f.state.quarantine = make(map[string]int)
+	}
+	return nil
+}
+
+// Persist writes out the snapshot
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release is a no-op, the snapshot holds a copy of the leases
+func (s *raftSnapshot) Release() {}
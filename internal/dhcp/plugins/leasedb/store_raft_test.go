@@ -0,0 +1,357 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRaftConfig returns a Raft configuration with timeouts short enough for
+// elections to take milliseconds
+func testRaftConfig() *raft.Config {
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+	return config
+}
+
+// newTestRaftCluster starts n replicas connected in memory, which ask each
+// other for their status directly
+func newTestRaftCluster(t *testing.T, n int) []*raftStore {
+	t.Helper()
+	peers := make([]raft.Server, n)
+	transports := make([]*raft.InmemTransport, n)
+	for i := range transports {
+		id := raft.ServerID(fmt.Sprintf("replica-%d", i))
+		peers[i].ID = id
+		peers[i].Address, transports[i] = raft.NewInmemTransport(raft.ServerAddress(id))
+	}
+	for i, transport := range transports {
+		for j, peer := range transports {
+			if i != j {
+				transport.Connect(peers[j].Address, peer)
+			}
+		}
+	}
+	var mu sync.Mutex
+	started := make(map[raft.ServerID]*raftStore, n)
+	peerStatus := func(peer raft.Server) (raftStatus, error) {
+		mu.Lock()
+		store := started[peer.ID]
+		mu.Unlock()
+		if store == nil {
+			return raftStatus{}, errors.New("not started")
+		}
+		return store.status(), nil
+	}
+	stores := make([]*raftStore, n)
+	for i, transport := range transports {
+		store, err := newRaftStore(raftOptions{
+			transport:  transport,
+			id:         peers[i].ID,
+			peers:      peers,
+			peerStatus: peerStatus,
+			interval:   10 * time.Millisecond,
+			config:     testRaftConfig(),
+		})
+		require.NoError(t, err)
+		mu.Lock()
+		started[peers[i].ID] = store
+		mu.Unlock()
+		stores[i] = store
+	}
+	return stores
+}
+
+// waitRaftLeader waits until one of the running replicas leads and returns it
+func waitRaftLeader(t *testing.T, stores []*raftStore) *raftStore {
+	t.Helper()
+	var leader *raftStore
+	require.Eventually(t, func() bool {
+		for _, store := range stores {
+			if store.isLeading() {
+				leader = store
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func openTestRaftStore(t *testing.T) LeaseStore {
+	stores := newTestRaftCluster(t, 1)
+	return waitRaftLeader(t, stores)
+}
+
+func TestRaftStoreReplication(t *testing.T) {
+	stores := newTestRaftCluster(t, 3)
+	defer func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}()
+	leader := waitRaftLeader(t, stores)
+
+	expires := int(time.Now().Add(time.Hour).Unix())
+	require.NoError(t, leader.Upsert("02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), expires: expires}))
+	require.NoError(t, leader.Quarantine(net.IPv4(10, 0, 0, 2), expires))
+	require.NoError(t, leader.RecordForceRenew("abc"))
+
+	for _, store := range stores {
+		if store == leader {
+			continue
+		}
+		// Followers apply the writes of the leader, but cannot write themselves
+		require.Eventually(t, func() bool {
+			records, err := store.Load()
+			quarantine, qerr := store.LoadQuarantine()
+			return err == nil && qerr == nil && len(records) == 1 && len(quarantine) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		quarantine, err := store.LoadQuarantine()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"10.0.0.2": expires}, quarantine)
+		require.Eventually(t, func() bool {
+			config, err := store.ForceRenewedConfig()
+			return err == nil && config == "abc"
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Error(t, store.Upsert("02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 3), expires: expires}))
+	}
+
+	// A replica starting from a snapshot gets the same leases
+	snapshot, err := (&raftFSM{state: leader.state}).Snapshot()
+	require.NoError(t, err)
+	sink := &testSnapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	restored := &raftFSM{state: newMemoryStore()}
+	require.NoError(t, restored.Restore(io.NopCloser(sink)))
+	records, err := restored.state.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"02:00:00:00:00:01": "10.0.0.1 " + time.Unix(int64(expires), 0).UTC().Format(time.RFC3339)}, summarize(records))
+	config, err := restored.state.ForceRenewedConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", config)
+}
+
+// testSnapshotSink keeps a persisted snapshot in memory
+type testSnapshotSink struct {
+	data []byte
+	read int
+}
+
+func (s *testSnapshotSink) Write(p []byte) (int, error) {
+	s.data = append(s.data, p...)
+	return len(p), nil
+}
+
+func (s *testSnapshotSink) Read(p []byte) (int, error) {
+	if s.read == len(s.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.read:])
+	s.read += n
+	return n, nil
+}
+
+func (s *testSnapshotSink) Close() error  { return nil }
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+
+func TestRaftStoreFailover(t *testing.T) {
+	stores := newTestRaftCluster(t, 3)
+	floating, err := parseFloatingIP("10.0.0.254%net1")
+	require.NoError(t, err)
+	var (
+		mu   sync.Mutex
+		held = make(map[*raftStore]bool)
+	)
+	// holders returns the replicas holding the floating IP
+	holders := func() []*raftStore {
+		mu.Lock()
+		defer mu.Unlock()
+		var holders []*raftStore
+		for store, holding := range held {
+			if holding {
+				holders = append(holders, store)
+			}
+		}
+		return holders
+	}
+	servers := make(map[*raftStore]*PluginState, len(stores))
+	for _, store := range stores {
+		store := store
+		pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+		pl.leasedb = store
+		pl.standby = true
+		pl.floatingIPs = []floatingIP{floating}
+		pl.setFloatingIP = func(_ floatingIP, hold bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			held[store] = hold
+			return nil
+		}
+		store.NotifyLeadership(pl.setLeading)
+		servers[store] = pl
+	}
+	leader := waitRaftLeader(t, stores)
+	// Only the leader holds the floating IP
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]*raftStore{leader}, holders())
+	}, 5*time.Second, 10*time.Millisecond)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, servers[leader], mac)
+
+	// Only the leader answers
+	for store, pl := range servers {
+		if store == leader {
+			continue
+		}
+		resp, err := dhcpv4.New()
+		require.NoError(t, err)
+		result, stop := pl.Handler4(&dhcpv4.DHCPv4{ClientHWAddr: mac}, resp)
+		assert.Nil(t, result)
+		assert.True(t, stop)
+	}
+
+	// The next leader takes over the lease and the floating IP
+	servers[leader].shutdown()
+	var running []*raftStore
+	for _, store := range stores {
+		if store != leader {
+			running = append(running, store)
+		}
+	}
+	defer func() {
+		for _, store := range running {
+			store.Close()
+		}
+	}()
+	next := waitRaftLeader(t, running)
+	assert.Equal(t, ip.String(), lease(t, servers[next], mac).String())
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]*raftStore{next}, holders())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// openTestRaftReplica starts a replica alone, keeping its log in dir
+func openTestRaftReplica(t *testing.T, dir string) *raftStore {
+	t.Helper()
+	address, transport := raft.NewInmemTransport("replica-0")
+	store, err := newRaftStore(raftOptions{
+		transport: transport,
+		id:        "replica-0",
+		peers:     []raft.Server{{ID: "replica-0", Address: address}},
+		dir:       dir,
+		interval:  10 * time.Millisecond,
+		config:    testRaftConfig(),
+	})
+	require.NoError(t, err)
+	return store
+}
+
+func TestRaftStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestRaftReplica(t, dir)
+	waitRaftLeader(t, []*raftStore{store})
+	expires := int(time.Now().Add(time.Hour).Unix())
+	require.NoError(t, store.Upsert("02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), expires: expires}))
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 2), expires))
+	require.NoError(t, store.Close())
+
+	// The replica gets its leases back from its log
+	store = openTestRaftReplica(t, dir)
+	defer store.Close()
+	waitRaftLeader(t, []*raftStore{store})
+	records, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"02:00:00:00:00:01": "10.0.0.1 " + time.Unix(int64(expires), 0).UTC().Format(time.RFC3339)}, summarize(records))
+	quarantine, err := store.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.2": expires}, quarantine)
+}
+
+func TestRaftStoreBootstrap(t *testing.T) {
+	address, transport := raft.NewInmemTransport("replica-0")
+	var mu sync.Mutex
+	var peer raftStatus
+	var peerErr error = errors.New("unreachable")
+	store, err := newRaftStore(raftOptions{
+		transport: transport,
+		id:        "replica-0",
+		peers: []raft.Server{
+			{ID: "replica-0", Address: address},
+			{ID: "replica-1", Address: "replica-1"},
+		},
+		peerStatus: func(raft.Server) (raftStatus, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return peer, peerErr
+		},
+		interval: 10 * time.Millisecond,
+		config:   testRaftConfig(),
+	})
+	require.NoError(t, err)
+	defer store.Close()
+	setPeer := func(status raftStatus, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		peer, peerErr = status, err
+	}
+
+	// A peer that does not answer may be part of a cluster already
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, store.status().Configured)
+
+	// A peer that is part of a cluster adds the replica
+	setPeer(raftStatus{ID: "replica-1", Configured: true}, nil)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, store.status().Configured)
+
+	// Peers that are not part of one create it together
+	setPeer(raftStatus{ID: "replica-1"}, nil)
+	require.Eventually(t, func() bool { return store.status().Configured }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, store.status().Joined)
+}
+
+func TestRaftStoreStatus(t *testing.T) {
+	stores := newTestRaftCluster(t, 1)
+	store := stores[0]
+	defer store.Close()
+	server := httptest.NewServer(store.statusHandler())
+	defer server.Close()
+	client := server.Client()
+	waitRaftLeader(t, stores)
+
+	status, err := getRaftStatus(client, server.URL+"/status")
+	require.NoError(t, err)
+	assert.Equal(t, raftStatus{ID: "replica-0", Configured: true, Joined: true}, status)
+	resp, err := client.Get(server.URL + "/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Replicas that are not part of the cluster are not ready
+	require.NoError(t, store.raft.Shutdown().Error())
+	resp, err = client.Get(server.URL + "/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
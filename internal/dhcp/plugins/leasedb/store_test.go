@@ -0,0 +1,222 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLeaseStores opens an empty store of each backend for the conformance tests
+var testLeaseStores = map[string]func(t *testing.T) LeaseStore{
+	"chai": func(t *testing.T) LeaseStore {
+		store, err := openChaiStore(":memory:")
+		require.NoError(t, err)
+		return store
+	},
+	"memory": func(t *testing.T) LeaseStore {
+		store, err := openMemoryStore("")
+		require.NoError(t, err)
+		return store
+	},
+	"postgres": openTestPostgresStore,
+	"raft":     openTestRaftStore,
+}
+
+func TestLeaseStores(t *testing.T) {
+	for name, open := range testLeaseStores {
+		t.Run(name, func(t *testing.T) {
+			testLeaseStore(t, open(t))
+		})
+	}
+}
+
+// summarize renders leases as MAC -> "IP expiry" for comparisons independent
+// of the IP address representation
+func summarize(records map[string]*Record) map[string]string {
+	summary := make(map[string]string, len(records))
+	for mac, record := range records {
+		summary[mac] = record.IP.String() + " " + time.Unix(int64(record.expires), 0).UTC().Format(time.RFC3339)
+	}
+	return summary
+}
+
+// testLeaseStore checks the behavior every LeaseStore must have
+func testLeaseStore(t *testing.T, store LeaseStore) {
+	now := time.Now().Truncate(time.Second)
+	past := int(now.Add(-time.Hour).Unix())
+	future := int(now.Add(time.Hour).Unix())
+
+	stored, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// The details of a lease are kept along with it
+	detailed := Record{
+		IP:        net.IPv4(10, 0, 0, 1),
+		expires:   future,
+		Hostname:  "web-1",
+		HWAddr:    "02:00:00:00:00:01",
+		VMI:       "web-1",
+		State:     LeaseBound,
+		firstSeen: past,
+		lastSeen:  int(now.Unix()),
+		nonce:     []byte("0123456789abcdef"),
+	}
+	want := map[string]*Record{
+		"id:01:02:00:00:00:00:03": {IP: net.IPv4(10, 0, 0, 3), expires: past},
+		"02:00:00:00:00:01":       &detailed,
+		"02:00:00:00:00:02":       {IP: net.IPv4(10, 0, 0, 20), expires: past},
+	}
+	for mac, record := range want {
+		require.NoError(t, store.Upsert(mac, record))
+	}
+	// Upserting replaces the lease of the client
+	want["02:00:00:00:00:02"] = &Record{IP: net.IPv4(10, 0, 0, 2), expires: future}
+	require.NoError(t, store.Delete("02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 20)}))
+	require.NoError(t, store.Upsert("02:00:00:00:00:02", want["02:00:00:00:00:02"]))
+
+	stored, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, summarize(want), summarize(stored))
+	require.Contains(t, stored, "02:00:00:00:00:01")
+	assert.Equal(t, detailed, *stored["02:00:00:00:00:01"])
+
+	leases, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, leases, 3)
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		assert.Equal(t, ip, leases[i].IP.String())
+		assert.Equal(t, want[leases[i].MAC].expires, int(leases[i].Expires().Unix()))
+	}
+
+	// Expired leases may be deleted while iterating
+	var expired []string
+	require.NoError(t, store.Expired(now, func(mac string, record *Record) error {
+		expired = append(expired, mac)
+		assert.Equal(t, "10.0.0.3", record.IP.String())
+		return store.Delete(mac, record)
+	}))
+	assert.Equal(t, []string{"id:01:02:00:00:00:00:03"}, expired)
+	delete(want, "id:01:02:00:00:00:00:03")
+	stored, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, summarize(want), summarize(stored))
+
+	// Deleting a lease for another address leaves the client's lease alone
+	require.NoError(t, store.Delete("02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 99)}))
+	stored, err = store.Load()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 5), future))
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 6), future))
+	require.NoError(t, store.Quarantine(net.IPv4(10, 0, 0, 5), past))
+	require.NoError(t, store.Unquarantine(net.IPv4(10, 0, 0, 6)))
+	quarantine, err := store.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.5": past}, quarantine)
+
+	// The configuration the clients were asked to renew for is replaced
+	config, err := store.ForceRenewedConfig()
+	require.NoError(t, err)
+	assert.Empty(t, config)
+	require.NoError(t, store.RecordForceRenew("abc"))
+	require.NoError(t, store.RecordForceRenew("def"))
+	config, err = store.ForceRenewedConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "def", config)
+
+	require.NoError(t, store.Close())
+	assert.Error(t, store.Upsert("02:00:00:00:00:04", &Record{IP: net.IPv4(10, 0, 0, 4)}))
+}
+
+func TestOpenLeaseStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    interface{}
+		wantErr string
+	}{
+		{
+			name: "plain file name",
+			uri:  ":memory:",
+			want: &chaiStore{},
+		},
+		{
+			name: "chai URI",
+			uri:  "chai://:memory:",
+			want: &chaiStore{},
+		},
+		{
+			name: "chai URI with absolute path",
+			uri:  "chai://" + t.TempDir() + "/leases",
+			want: &chaiStore{},
+		},
+		{
+			name: "memory URI",
+			uri:  "memory://",
+			want: &memoryStore{},
+		},
+		{
+			name:    "kubernetes URI without server",
+			uri:     "kubernetes://default",
+			wantErr: "want <namespace>/<server>",
+		},
+		{
+			name:    "kubernetes URI with bad flush interval",
+			uri:     "kubernetes://default/server?flush=often",
+			wantErr: "invalid flush interval",
+		},
+		{
+			name:    "raft URI without directory",
+			uri:     "raft://127.0.0.1:0?id=replica-0",
+			wantErr: "needs a dir",
+		},
+		{
+			name:    "raft URI of a replica that is not a peer",
+			uri:     "raft://127.0.0.1:0?dir=/tmp&id=replica-3&peers=replica-0.raft,replica-1.raft",
+			wantErr: "replica replica-3 is not one of the peers",
+		},
+		{
+			name:    "raft URI with bad discovery interval",
+			uri:     "raft://127.0.0.1:0?dir=/tmp&id=replica-0&interval=-1s",
+			wantErr: "invalid discovery interval",
+		},
+		{
+			name:    "unknown scheme",
+			uri:     "floppy:///dev/fd0",
+			wantErr: "unsupported lease store: floppy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := openLeaseStore(tt.uri)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer store.Close()
+			assert.IsType(t, tt.want, store)
+		})
+	}
+}
+
+func TestSetupRangeLeaseStoreURI(t *testing.T) {
+	handler, err := setupRange("memory://", "10.0.0.1", "10.0.0.10", "1h", "sweep=0s")
+	require.NoError(t, err)
+	assert.NotNil(t, handler)
+
+	handler, err = setupRange("floppy:///dev/fd0", "10.0.0.1", "10.0.0.10", "1h")
+	assert.Error(t, err)
+	assert.Nil(t, handler)
+}
@@ -0,0 +1,180 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCommitWindow is how long lease changes may wait to be written
+	// to the lease store unless configured otherwise with the commit argument
+	defaultCommitWindow = 20 * time.Millisecond
+	// maxCommitBatch is how many queued changes are written right away
+	// without waiting for the end of the commit window
+	maxCommitBatch = 256
+)
+
+// storeOpKind is the kind of a change to a lease store
+type storeOpKind int
+
+const (
+	opUpsert storeOpKind = iota
+	opDelete
+	opQuarantine
+	opUnquarantine
+	opAppendHistory
+)
+
+// storeOp is a change to a lease store waiting to be written
+type storeOp struct {
+	kind    storeOpKind
+	client  string
+	record  Record
+	ip      net.IP
+	expires int
+	entry   HistoryEntry
+}
+
+// apply writes the change to a lease store
+func (op storeOp) apply(store LeaseStore) error {
+	switch op.kind {
+	case opUpsert:
+		return store.Upsert(op.client, &op.record)
+	case opDelete:
+		return store.Delete(op.client, &op.record)
+	case opQuarantine:
+		return store.Quarantine(op.ip, op.expires)
+	case opUnquarantine:
+		return store.Unquarantine(op.ip)
+	case opAppendHistory:
+		history, ok := store.(LeaseHistory)
+		if !ok {
+			return errNoHistory
+		}
+		return history.AppendHistory(op.entry)
+	}
+	return fmt.Errorf("unknown lease store change: %d", op.kind)
+}
+
+// batchWriter is implemented by lease stores that write several changes at
+// once, in a single transaction
+type batchWriter interface {
+	writeBatch(ops []storeOp) error
+}
+
+// writeBehind queues the changes to a lease store and writes them in the
+// background, so requests are answered without waiting for the store. The
+// changes queued within a commit window are written together, in a single
+// transaction if the store supports it. Reads of the store have to flush the
+// queue first.
+type writeBehind struct {
+	store  LeaseStore
+	window time.Duration
+	mu     sync.Mutex
+	queue  []storeOp
+	// queued is signaled when the queue stops being empty, full when it
+	// holds maxCommitBatch changes
+	queued chan struct{}
+	full   chan struct{}
+	// flushing serializes flushes, so a flush returns once the changes
+	// queued before it are written
+	flushing sync.Mutex
+}
+
+// newWriteBehind returns a queue of changes to store written at most window
+// after they are queued. Its writer runs until the process exits, the changes
+// queued within the last commit window are written out by Shutdown when the
+// server stops, and lost if it does not stop cleanly.
+func newWriteBehind(store LeaseStore, window time.Duration) *writeBehind {
+	w := &writeBehind{
+		store:  store,
+		window: window,
+		queued: make(chan struct{}, 1),
+		full:   make(chan struct{}, 1),
+	}
+	go w.run()
+	return w
+}
+
+// run flushes the queue at the end of the commit window of the first change
+// queued, or as soon as it is full
+func (w *writeBehind) run() {
+	for range w.queued {
+		timer := time.NewTimer(w.window)
+		select {
+		case <-timer.C:
+		case <-w.full:
+			timer.Stop()
+		}
+		w.flush()
+	}
+}
+
+// enqueue adds a change to the queue
+func (w *writeBehind) enqueue(op storeOp) {
+	w.mu.Lock()
+	w.queue = append(w.queue, op)
+	n := len(w.queue)
+	w.mu.Unlock()
+	signal := w.queued
+	if n >= maxCommitBatch {
+		signal = w.full
+	} else if n > 1 {
+		return
+	}
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes the queued changes. A batch the store fails to write is
+// written change by change, so one bad change does not lose the others.
+// Changes that cannot be written are logged and dropped, like failed writes
+// are when writing through.
+func (w *writeBehind) flush() {
+	w.flushing.Lock()
+	defer w.flushing.Unlock()
+	w.mu.Lock()
+	batch := w.queue
+	w.queue = nil
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if batcher, ok := w.store.(batchWriter); ok {
+		err := batcher.writeBatch(batch)
+		if err == nil {
+			return
+		}
+		log.Warningf("Could not write %d lease changes at once, writing them one by one: %v", len(batch), err)
+	}
+	for _, op := range batch {
+		if err := op.apply(w.store); err != nil {
+			log.Errorf("Could not write lease change: %v", err)
+		}
+	}
+}
+
+// write writes out a change to the lease store, or queues it if the plugin
+// writes behind
+func (p *PluginState) write(op storeOp) error {
+	if p.writes == nil {
+		return op.apply(p.leasedb)
+	}
+	p.writes.enqueue(op)
+	return nil
+}
+
+// flushWrites writes the queued changes to the lease store before it is read
+func (p *PluginState) flushWrites() {
+	if p.writes != nil {
+		p.writes.flush()
+	}
+}
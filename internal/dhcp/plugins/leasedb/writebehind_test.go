@@ -0,0 +1,238 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasedb
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBehind(t *testing.T) {
+	store := newMemoryStore()
+	w := newWriteBehind(store, time.Hour)
+	record := Record{IP: net.IPv4(10, 0, 0, 1), expires: 100}
+
+	// Changes wait for the end of the commit window, or a flush
+	w.enqueue(storeOp{kind: opUpsert, client: "02:00:00:00:00:01", record: record})
+	w.enqueue(storeOp{kind: opQuarantine, ip: net.IPv4(10, 0, 0, 2), expires: 200})
+	w.enqueue(storeOp{kind: opUpsert, client: "02:00:00:00:00:03", record: Record{IP: net.IPv4(10, 0, 0, 3), expires: 300}})
+	w.enqueue(storeOp{kind: opDelete, client: "02:00:00:00:00:03", record: Record{IP: net.IPv4(10, 0, 0, 3)}})
+	stored, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	w.flush()
+	stored, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"02:00:00:00:00:01": summarize(map[string]*Record{"": &record})[""]}, summarize(stored))
+	quarantine, err := store.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.2": 200}, quarantine)
+
+	// A full queue is written right away
+	for i := 0; i < maxCommitBatch; i++ {
+		w.enqueue(storeOp{kind: opUpsert, client: fmt.Sprintf("02:00:00:00:01:%02x", i), record: record})
+	}
+	assert.Eventually(t, func() bool {
+		stored, err := store.Load()
+		return err == nil && len(stored) == maxCommitBatch+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteBehindCommitWindow(t *testing.T) {
+	store := newMemoryStore()
+	w := newWriteBehind(store, 10*time.Millisecond)
+	w.enqueue(storeOp{kind: opUpsert, client: "02:00:00:00:00:01", record: Record{IP: net.IPv4(10, 0, 0, 1), expires: 100}})
+	assert.Eventually(t, func() bool {
+		stored, err := store.Load()
+		return err == nil && len(stored) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWriteBehindBatchFailure(t *testing.T) {
+	store, err := openChaiStore(":memory:")
+	require.NoError(t, err)
+	w := newWriteBehind(store, time.Hour)
+
+	// The changes of a failed batch are written one by one
+	w.enqueue(storeOp{kind: opUpsert, client: "02:00:00:00:00:01", record: Record{IP: net.IPv4(10, 0, 0, 1), expires: 100}})
+	w.enqueue(storeOp{kind: storeOpKind(-1)})
+	w.enqueue(storeOp{kind: opQuarantine, ip: net.IPv4(10, 0, 0, 3), expires: 200})
+	w.flush()
+
+	stored, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"02:00:00:00:00:01": "10.0.0.1 1970-01-01T00:01:40Z"}, summarize(stored))
+	quarantine, err := store.LoadQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.3": 200}, quarantine)
+}
+
+func TestHandler4WriteBehind(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 10))
+	pl.writes = newWriteBehind(pl.leasedb, time.Hour)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	ip := lease(t, pl, mac)
+
+	// The lease is answered before it is written
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// Reading the store writes the queued changes first
+	pl.sweep(time.Now())
+	stored, err = pl.leasedb.Load()
+	require.NoError(t, err)
+	require.Contains(t, stored, mac.String())
+	assert.True(t, stored[mac.String()].IP.Equal(ip))
+
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(ip),
+	)
+	require.NoError(t, err)
+	pl.Handler4(req, nil)
+	require.NoError(t, pl.load())
+	assert.Empty(t, pl.Recordsv4, "the release is written before the leases are loaded")
+}
+
+func TestHandler4ConcurrentRenewals(t *testing.T) {
+	pl := newTestPluginState(t, net.IPv4(10, 0, 0, 200))
+	pl.writes = newWriteBehind(pl.leasedb, time.Millisecond)
+	serverID := net.IPv4(10, 0, 0, 254)
+	macs := make([]net.HardwareAddr, 100)
+	leased := make([]net.IP, len(macs))
+	for i := range macs {
+		macs[i] = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)}
+		leased[i] = lease(t, pl, macs[i])
+	}
+
+	// Clients renew concurrently
+	var (
+		wg   sync.WaitGroup
+		acks atomic.Int64
+	)
+	for i := range macs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				req, err := dhcpv4.New(
+					dhcpv4.WithHwAddr(macs[i]),
+					dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+					dhcpv4.WithClientIP(leased[i]),
+				)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := dhcpv4.NewReplyFromRequest(req,
+					dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+				)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if reply, _ := pl.Handler4(req, resp); reply != nil && reply.MessageType() == dhcpv4.MessageTypeAck {
+					acks.Add(1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int64(len(macs)*20), acks.Load())
+
+	pl.flushWrites()
+	stored, err := pl.leasedb.Load()
+	require.NoError(t, err)
+	require.Len(t, stored, len(macs))
+	for i, mac := range macs {
+		assert.True(t, stored[mac.String()].IP.Equal(leased[i]))
+		assert.Equal(t, pl.Recordsv4[mac.String()].expires, stored[mac.String()].expires)
+	}
+}
+
+// BenchmarkHandler4Renewals measures how many renewals the plugin answers with
+// a chai database in a file, writing leases through like the plugin used to,
+// and writing them behind
+func BenchmarkHandler4Renewals(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		window time.Duration
+	}{
+		{name: "write-through", window: 0},
+		{name: "write-behind", window: defaultCommitWindow},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			pl := &PluginState{
+				LeaseTime:      time.Hour,
+				MinLeaseTime:   time.Hour,
+				MaxLeaseTime:   time.Hour,
+				RenewalRatio:   defaultRenewalRatio,
+				RebindingRatio: defaultRebindingRatio,
+				Recordsv4:      make(map[string]*Record),
+				Offersv4:       make(map[string]*Record),
+				Quarantinev4:   make(map[string]int),
+			}
+			require.NoError(b, pl.registerBackingDB(filepath.Join(b.TempDir(), "leases.db")))
+			defer pl.leasedb.Close()
+			if bench.window > 0 {
+				pl.writes = newWriteBehind(pl.leasedb, bench.window)
+			}
+			var err error
+			pl.allocator, err = bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 3, 254))
+			require.NoError(b, err)
+			pl.pools = []ipRange{{start: ipToUint32(net.IPv4(10, 0, 0, 1)), end: ipToUint32(net.IPv4(10, 0, 3, 254))}}
+
+			requests := make([]*dhcpv4.DHCPv4, 1000)
+			for i := range requests {
+				mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, byte(i >> 8), byte(i)}
+				resp, err := dhcpv4.New()
+				require.NoError(b, err)
+				reply, _ := pl.Handler4(&dhcpv4.DHCPv4{ClientHWAddr: mac}, resp)
+				require.NotNil(b, reply)
+				requests[i], err = dhcpv4.New(
+					dhcpv4.WithHwAddr(mac),
+					dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+					dhcpv4.WithClientIP(reply.YourIPAddr),
+				)
+				require.NoError(b, err)
+			}
+			pl.flushWrites()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req := requests[next.Add(1)%int64(len(requests))]
+					resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if reply, _ := pl.Handler4(req, resp); reply == nil {
+						b.Error("no reply")
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			pl.flushWrites()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build !linux
+
+package dhcp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func sendEthernet(iface net.Interface, resp *dhcpv4.DHCPv4) error {
+	return fmt.Errorf("not implemented")
+}
@@ -1,6 +1,10 @@
 package dhcp
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	dhcpconfig "github.com/coredhcp/coredhcp/config"
 	dhcplogger "github.com/coredhcp/coredhcp/logger"
 	dhcpplugins "github.com/coredhcp/coredhcp/plugins"
@@ -14,7 +18,6 @@ import (
 	pl_serverid "github.com/coredhcp/coredhcp/plugins/serverid"
 	pl_sleep "github.com/coredhcp/coredhcp/plugins/sleep"
 	pl_staticroute "github.com/coredhcp/coredhcp/plugins/staticroute"
-	dhcpserver "github.com/coredhcp/coredhcp/server"
 
 	pl_kubevirt "github.com/cldmnky/hyperdhcp/internal/dhcp/plugins/kubevirt"
 	pl_leasedb "github.com/cldmnky/hyperdhcp/internal/dhcp/plugins/leasedb"
@@ -52,12 +55,18 @@ func Run(config *Config) error {
 			return err
 		}
 	}
-	srv, err := dhcpserver.Start(cfg)
+	// Pods are stopped with SIGTERM, the leases are written out before the
+	// server exits so the next one gets them all
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	srv, err := start(cfg)
 	if err != nil {
 		log.WithError(err).Error("failed to start server")
 		return err
 	}
-	if err := srv.Wait(); err != nil {
+	err = srv.wait(stop)
+	pl_leasedb.Shutdown()
+	if err != nil {
 		log.WithError(err).Error("failed to wait for server")
 		return err
 	}